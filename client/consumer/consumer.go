@@ -1,22 +1,32 @@
 package consumer
 
 import (
-	"encoding/json"
+	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 	"yithQ/message"
 	"yithQ/meta"
+	"yithQ/status"
 )
 
+var ErrOffsetOutOfRange error = errors.New(status.OffsetOutOfRange)
+var ErrPartitionNotFound error = errors.New("topic partition not found")
+
 type Consumer struct {
 	rw            sync.RWMutex
 	zeroAddress   string
 	topicOffset   map[string]int64 // key is topic_partitionID, ep:  yith_100
 	metadata      *meta.Metadata
 	consumeAmount int
+	//ReadUncommitted by default
+	isolation message.IsolationLevel
+
+	consumerPort string
 }
 
 func NewConsumer(zeroAddress string) *Consumer {
@@ -24,15 +34,28 @@ func NewConsumer(zeroAddress string) *Consumer {
 }
 
 func NewConsumerWithAmount(zeroAddress string, consumeAmount int) *Consumer {
+	return NewConsumerWithAmountAndPort(zeroAddress, consumeAmount, ":9971")
+}
+
+func NewConsumerWithAmountAndPort(zeroAddress string, consumeAmount int, consumerPort string) *Consumer {
 	return &Consumer{
 		zeroAddress: zeroAddress,
 		//offset is the last consumed index
 		topicOffset:   make(map[string]int64),
 		metadata:      meta.NewMetadata(),
 		consumeAmount: consumeAmount,
+		isolation:     message.ReadUncommitted,
+		consumerPort:  consumerPort,
 	}
 }
 
+//SetIsolationLevel with ReadCommitted consumes only the committed messages of transactions, up to the first
+//transaction still open. The markers ending transactions are never returned whatever the level
+func (c *Consumer) SetIsolationLevel(isolation message.IsolationLevel) {
+	c.isolation = isolation
+}
+
+//Consume calls fn for each consumed message, its Key and Headers are as published
 func (c *Consumer) Consume(topic string, fn func(msg *message.Message) error) <-chan error {
 	errChan := make(chan error)
 	nodeTopics := c.metadata.FindTopicAllPartitions(topic)
@@ -40,7 +63,7 @@ func (c *Consumer) Consume(topic string, fn func(msg *message.Message) error) <-
 		go func(node string, topicmeta meta.TopicMetadata) {
 			partitionID := topicmeta.PartitionID
 			offset := c.Offset(topic, partitionID)
-			msgs, err := c.consumeFromBroker(node, topic, partitionID, offset+1)
+			msgs, nextOffset, err := c.consumeFromBroker(node, topic, partitionID, offset+1)
 			if err != nil {
 				errChan <- err
 				return
@@ -50,7 +73,7 @@ func (c *Consumer) Consume(topic string, fn func(msg *message.Message) error) <-
 					errChan <- err
 				}
 			}
-			c.addOffset(topic, partitionID, int64(len(msgs))-1)
+			c.commitOffset(topic, partitionID, nextOffset)
 		}(node, topicmeta)
 	}
 	return errChan
@@ -66,14 +89,44 @@ func (c *Consumer) ConsumePartitionWithOffset(topic string, partitionID int, off
 		c.setOffset(topic, partitionID, offset-1)
 	}
 	node := c.metadata.FindNodeWithTopicPartitionID(topic, partitionID, false)
-	msgs, err := c.consumeFromBroker(node, topic, partitionID, offset)
+	msgs, nextOffset, err := c.consumeFromBroker(node, topic, partitionID, offset)
 	if err != nil {
 		return nil, err
 	}
-	c.addOffset(topic, partitionID, int64(len(msgs))-1)
+	c.commitOffset(topic, partitionID, nextOffset)
 	return msgs, nil
 }
 
+//SeekToTime moves the offset so the next consume starts from the first message at or after t
+func (c *Consumer) SeekToTime(topic string, partitionID int, t time.Time) error {
+	node := c.metadata.FindNodeWithTopicPartitionID(topic, partitionID, false)
+	if node == "" {
+		return ErrPartitionNotFound
+	}
+	resp, err := http.PostForm(c.brokerURL(node, "/offset-for-time"), url.Values{
+		"topic":       []string{topic},
+		"partitionID": []string{strconv.Itoa(partitionID)},
+		"timestamp":   []string{strconv.FormatInt(t.UnixNano(), 10)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(byt))
+	}
+	offset, err := strconv.ParseInt(string(byt), 10, 64)
+	if err != nil {
+		return err
+	}
+	c.setOffset(topic, partitionID, offset-1)
+	return nil
+}
+
 func (c *Consumer) Offset(topic string, partitionID int) int64 {
 	c.rw.RLock()
 	defer c.rw.RUnlock()
@@ -87,39 +140,77 @@ func (c *Consumer) setOffset(topic string, partitionID int, offset int64) {
 	c.topicOffset[topic+"_"+strconv.Itoa(partitionID)] = offset
 }
 
-func (c *Consumer) addOffset(topic string, partitionID int, deltaOffset int64) {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	c.topicOffset[topic+"_"+strconv.Itoa(partitionID)] += deltaOffset
+//commitOffset moves the offset to the last record read, nextOffset is the one after it
+func (c *Consumer) commitOffset(topic string, partitionID int, nextOffset int64) {
+	c.setOffset(topic, partitionID, nextOffset-1)
 }
 
-func (c *Consumer) consumeFromBroker(node, topic string, partitionID int, offset int64) ([]*message.Message, error) {
-	resp, err := http.PostForm(node, url.Values{
+//consumeFromBroker returns the messages from offset and the offset to consume from next,
+//which is past the control records and the aborted messages skipped
+func (c *Consumer) consumeFromBroker(node, topic string, partitionID int, offset int64) ([]*message.Message, int64, error) {
+	if node == "" {
+		return nil, 0, ErrPartitionNotFound
+	}
+	resp, err := http.PostForm(c.brokerURL(node, "/consume"), url.Values{
 		"topic":       []string{topic},
 		"partitionID": []string{strconv.Itoa(partitionID)},
 		"offset":      []string{strconv.FormatInt(offset, 10)},
 		"version":     []string{strconv.FormatUint(uint64(c.metadata.GetVersion()), 10)},
 		"amount":      []string{strconv.Itoa(c.consumeAmount)},
+		"isolation":   []string{string(c.isolation)},
 	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusMovedPermanently {
 		metadata, err := c.obtainMetaFromZero()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		c.metadata.SetMetadata(metadata)
 		return c.consumeFromBroker(node, topic, partitionID, offset)
 	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		//the offset was deleted by retention
+		return nil, 0, ErrOffsetOutOfRange
+	}
 	byt, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	decoded, err := message.DecodeRecords(byt)
+	if err != nil {
+		return nil, 0, err
+	}
+	nextOffset := offset
+	msgs := make([]*message.Message, 0, len(decoded))
+	for _, msg := range decoded {
+		if msg.Offset >= nextOffset {
+			nextOffset = msg.Offset + 1
+		}
+		//a compressed batch is served whole, drop its records before offset
+		if msg.Offset < offset || msg.IsControl() {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	//read_committed, the records read may all be aborted
+	if header := resp.Header.Get(message.NextOffsetHeader); header != "" {
+		if nextOffset, err = strconv.ParseInt(header, 10, 64); err != nil {
+			return nil, 0, err
+		}
+	}
+	return msgs, nextOffset, nil
+}
+
+//brokerURL replaces the port of node with the consumer port
+func (c *Consumer) brokerURL(node, path string) string {
+	node = node[:strings.LastIndex(node, ":")] + c.consumerPort + path
+	if !strings.HasPrefix(node, "http") {
+		node = "http://" + node
 	}
-	var msgs []*message.Message
-	err = json.Unmarshal([]byte("["+string(byt)+"]"), &msgs)
-	return msgs, err
+	return node
 }
 
 func (c *Consumer) obtainMetaFromZero() (*meta.Metadata, error) {
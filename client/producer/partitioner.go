@@ -0,0 +1,124 @@
+package producer
+
+import (
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"yithQ/message"
+)
+
+var ErrNoPartition error = errors.New("topic has no partition")
+var ErrInvalidPartition error = errors.New("partition is not of the topic")
+
+//Partitioner picks the partition of each message published, partitionIDs are the partitions of topic in increasing order
+//and never empty. It is called for the messages of a batch in order and may be called by several goroutines
+type Partitioner interface {
+	Partition(topic string, msg *message.Message, partitionIDs []int) (int, error)
+}
+
+//HashPartitioner sends the messages of a key to the same partition as long as the partition count is unchanged,
+//the messages without a key go round robin
+type HashPartitioner struct {
+	keyless RoundRobinPartitioner
+}
+
+func NewHashPartitioner() *HashPartitioner {
+	return &HashPartitioner{}
+}
+
+func (p *HashPartitioner) Partition(topic string, msg *message.Message, partitionIDs []int) (int, error) {
+	if msg.Key == nil {
+		return p.keyless.Partition(topic, msg, partitionIDs)
+	}
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return partitionIDs[h.Sum32()%uint32(len(partitionIDs))], nil
+}
+
+//RoundRobinPartitioner spreads the messages evenly over the partitions, the key is ignored
+type RoundRobinPartitioner struct {
+	lock sync.Mutex
+	next map[string]int
+}
+
+func NewRoundRobinPartitioner() *RoundRobinPartitioner {
+	return &RoundRobinPartitioner{}
+}
+
+func (p *RoundRobinPartitioner) Partition(topic string, msg *message.Message, partitionIDs []int) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.next == nil {
+		p.next = make(map[string]int)
+	}
+	i := p.next[topic] % len(partitionIDs)
+	p.next[topic] = i + 1
+	return partitionIDs[i], nil
+}
+
+//StickyPartitioner sends batchSize messages in a row to a random partition before it moves to another one,
+//so the batches are larger than round robin while the partitions are even over time. The key is ignored
+type StickyPartitioner struct {
+	batchSize int
+	lock      sync.Mutex
+	sticky    map[string]*stickyPartition
+}
+
+type stickyPartition struct {
+	partitionID int
+	sent        int
+}
+
+//NewStickyPartitioner sticks to a partition for 1 message if batchSize < 1
+func NewStickyPartitioner(batchSize int) *StickyPartitioner {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &StickyPartitioner{batchSize: batchSize, sticky: make(map[string]*stickyPartition)}
+}
+
+func (p *StickyPartitioner) Partition(topic string, msg *message.Message, partitionIDs []int) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	sp, ok := p.sticky[topic]
+	if !ok || sp.sent >= p.batchSize || !containsPartition(partitionIDs, sp.partitionID) {
+		sp = &stickyPartition{partitionID: pickOther(partitionIDs, sp)}
+		p.sticky[topic] = sp
+	}
+	sp.sent++
+	return sp.partitionID, nil
+}
+
+//pickOther picks a random partition other than the current one if there are more
+func pickOther(partitionIDs []int, current *stickyPartition) int {
+	if current == nil || len(partitionIDs) == 1 {
+		return partitionIDs[rand.Intn(len(partitionIDs))]
+	}
+	for {
+		if id := partitionIDs[rand.Intn(len(partitionIDs))]; id != current.partitionID {
+			return id
+		}
+	}
+}
+
+//ManualPartitioner leaves the partition to the caller, ep: read from a header of msg.
+//An error matching ErrInvalidPartition is returned if it is not a partition of the topic
+type ManualPartitioner func(topic string, msg *message.Message) int
+
+func (p ManualPartitioner) Partition(topic string, msg *message.Message, partitionIDs []int) (int, error) {
+	partitionID := p(topic, msg)
+	if !containsPartition(partitionIDs, partitionID) {
+		return 0, errors.Wrapf(ErrInvalidPartition, "%s partition %d", topic, partitionID)
+	}
+	return partitionID, nil
+}
+
+func containsPartition(partitionIDs []int, partitionID int) bool {
+	for _, id := range partitionIDs {
+		if id == partitionID {
+			return true
+		}
+	}
+	return false
+}
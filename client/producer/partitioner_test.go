@@ -0,0 +1,128 @@
+package producer
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"yithQ/message"
+	"yithQ/meta"
+)
+
+func TestHashPartitioner(t *testing.T) {
+	p := NewHashPartitioner()
+	partitionIDs := []int{1, 2, 3, 4}
+	keyPartitions := make(map[string]int)
+	used := make(map[int]bool)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := "user-" + strconv.Itoa(i)
+			partitionID, err := p.Partition("yith", &message.Message{Key: []byte(key)}, partitionIDs)
+			if err != nil {
+				t.Fatalf("partition error : %v", err)
+			}
+			if last, ok := keyPartitions[key]; ok && last != partitionID {
+				t.Fatalf("key %s moved from partition %d to %d", key, last, partitionID)
+			}
+			keyPartitions[key] = partitionID
+			used[partitionID] = true
+		}
+	}
+	if len(used) != len(partitionIDs) {
+		t.Fatalf("keys hashed to partitions %v only", used)
+	}
+	//the messages without a key go round robin
+	for i := 0; i < 8; i++ {
+		if partitionID, _ := p.Partition("yith", &message.Message{}, partitionIDs); partitionID != partitionIDs[i%4] {
+			t.Fatalf("message %d without a key went to partition %d", i, partitionID)
+		}
+	}
+}
+
+func TestStickyAndManualPartitioner(t *testing.T) {
+	p := NewStickyPartitioner(3)
+	partitionIDs := []int{1, 2, 3}
+	var last int
+	for i := 0; i < 9; i++ {
+		partitionID, _ := p.Partition("yith", &message.Message{}, partitionIDs)
+		if i%3 != 0 && partitionID != last {
+			t.Fatalf("message %d left partition %d for %d", i, last, partitionID)
+		}
+		if i%3 == 0 && i != 0 && partitionID == last {
+			t.Fatalf("message %d stuck to partition %d after the batch", i, partitionID)
+		}
+		last = partitionID
+	}
+
+	manual := ManualPartitioner(func(topic string, msg *message.Message) int {
+		partitionID, _ := strconv.Atoi(string(msg.Header("partition")))
+		return partitionID
+	})
+	msg := &message.Message{Headers: []message.Header{{Key: "partition", Value: []byte("2")}}}
+	if partitionID, err := manual.Partition("yith", msg, partitionIDs); err != nil || partitionID != 2 {
+		t.Fatalf("manual partition is %d error %v", partitionID, err)
+	}
+	msg.Headers[0].Value = []byte("5")
+	if _, err := manual.Partition("yith", msg, partitionIDs); !errors.Is(err, ErrInvalidPartition) {
+		t.Fatalf("manual partition 5 error is %v", err)
+	}
+}
+
+func TestPublishByKey(t *testing.T) {
+	var lock sync.Mutex
+	received := make(map[int][]string)
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		byt, _ := ioutil.ReadAll(r.Body)
+		msgs := &message.Messages{}
+		if err := json.Unmarshal(byt, msgs); err != nil {
+			t.Errorf("unmarshal produce request error : %v", err)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, msg := range msgs.Msgs {
+			received[msgs.PartitionID] = append(received[msgs.PartitionID], string(msg.Key)+":"+string(msg.Body))
+		}
+	}))
+	defer broker.Close()
+
+	//every partition is led by the test broker, the producer port replaces the port of the node
+	metadata := meta.NewMetadata()
+	for partitionID := 1; partitionID <= 3; partitionID++ {
+		metadata.SetTopic("127.0.0.1:1", meta.TopicMetadata{Topic: "yith", PartitionID: partitionID})
+	}
+	p := &Producer{metadata: metadata, producerPort: broker.URL[strings.LastIndex(broker.URL, ":"):], partitioner: NewHashPartitioner()}
+	msgs := make([]*message.Message, 0)
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, &message.Message{Key: []byte("k" + strconv.Itoa(i%4)), Body: []byte(strconv.Itoa(i))})
+	}
+	for err := range p.MultiPublishMessages("yith", msgs) {
+		t.Fatalf("multi publish error : %v", err)
+	}
+	total := 0
+	keyPartition := make(map[string]int)
+	for partitionID, records := range received {
+		last := -1
+		for _, record := range records {
+			kv := strings.SplitN(record, ":", 2)
+			if other, ok := keyPartition[kv[0]]; ok && other != partitionID {
+				t.Fatalf("key %s reached partitions %d and %d", kv[0], other, partitionID)
+			}
+			keyPartition[kv[0]] = partitionID
+			if seq, _ := strconv.Atoi(kv[1]); seq <= last {
+				t.Fatalf("partition %d received %v out of order", partitionID, records)
+			} else {
+				last = seq
+			}
+		}
+		total += len(records)
+	}
+	if total != len(msgs) {
+		t.Fatalf("brokers received %d messages, want %d", total, len(msgs))
+	}
+}
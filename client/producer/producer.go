@@ -4,15 +4,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"yithQ/message"
 	"yithQ/meta"
 	"yithQ/status"
 )
 
+const (
+	//a batch is sent again if the connection to the broker fails, its retry is dropped if it was written
+	produceRetries      = 3
+	produceRetryBackoff = 100 * time.Millisecond
+)
+
+var ErrOutOfOrderSequence error = errors.New(status.OutOfOrderSequence)
+
 type Producer struct {
 	zeroAddress string
 	metadata    *meta.Metadata
@@ -20,6 +33,23 @@ type Producer struct {
 	partitionFactory float64
 
 	producerPort string
+
+	//batches are compressed with codec before sent, CodecNone by default
+	codec message.Codec
+	//picks the partition of each message, HashPartitioner by default
+	partitioner Partitioner
+
+	//the id from zero stamped on every batch with the sequence of its partition, see sendBatch
+	producerID int64
+	sequences  sync.Map //map[string]*partitionSequence, key is topic_partitionID, ep: yith_1
+
+	txnLock sync.Mutex
+	txn     *transaction
+}
+
+type partitionSequence struct {
+	lock sync.Mutex
+	next uint64
 }
 
 func NewProducer(zeroAddress string) (*Producer, error) {
@@ -31,73 +61,183 @@ func NewProducerWithPfAndPort(zeroAddress string, producerPort string, partition
 		zeroAddress:      zeroAddress,
 		partitionFactory: partitionFactory,
 		producerPort:     producerPort,
+		partitioner:      NewHashPartitioner(),
 	}
 	metadata, err := p.obtainMetaFromZero()
 	if err != nil {
 		return nil, err
 	}
 	p.metadata = metadata
+	if err := p.initProducerID(); err != nil {
+		return nil, err
+	}
 	return p, nil
 }
 
+//SetCompression compresses every batch sent afterwards with codec
+func (p *Producer) SetCompression(codec message.Codec) {
+	p.codec = codec
+}
+
+//SetPartitioner picks the partitions of the messages published afterwards with partitioner,
+//PublishPartition and MultiPublishPartition are not affected
+func (p *Producer) SetPartitioner(partitioner Partitioner) {
+	p.partitioner = partitioner
+}
+
 func (p *Producer) Publish(topic string, msg []byte) error {
-	errChan := make(chan error)
-	p.send(topic, [][]byte{msg}, errChan)
-	return <-errChan
+	return p.PublishWithKey(topic, nil, nil, msg)
+}
+
+//PublishWithKey publishes msg with a key and headers, both may be nil
+func (p *Producer) PublishWithKey(topic string, key []byte, headers []message.Header, msg []byte) error {
+	return <-p.send(topic, 0, []*message.Message{{Key: key, Headers: headers, Body: msg}})
 }
 
+//PublishAt publishes msg to be delivered at deliverAt, the broker holds it until then so consumers do not see it
+//before. A deliverAt passed already delivers it at once. It cannot be published in a transaction
+func (p *Producer) PublishAt(topic string, deliverAt time.Time, msg []byte) error {
+	return <-p.send(topic, deliverAt.UnixNano(), []*message.Message{{Body: msg}})
+}
+
+//PublishWithDelay publishes msg to be delivered after delay, ep: the retry of a webhook in 5 minutes
+func (p *Producer) PublishWithDelay(topic string, delay time.Duration, msg []byte) error {
+	return p.PublishAt(topic, time.Now().Add(delay), msg)
+}
+
+//MultiPublish returns a channel of the errors of the partitions sent to, it is closed once all are sent
 func (p *Producer) MultiPublish(topic string, msgs [][]byte) <-chan error {
-	errChan := make(chan error)
-	p.send(topic, msgs, errChan)
-	return errChan
+	return p.send(topic, 0, bodiesToMessages(msgs))
+}
+
+//MultiPublishMessages publishes msgs with their Key, Headers and Body, the other fields are set by the producer
+func (p *Producer) MultiPublishMessages(topic string, msgs []*message.Message) <-chan error {
+	return p.send(topic, 0, msgs)
+}
+
+//MultiPublishMessagesAt publishes msgs to be delivered at deliverAt, see PublishAt
+func (p *Producer) MultiPublishMessagesAt(topic string, deliverAt time.Time, msgs []*message.Message) <-chan error {
+	return p.send(topic, deliverAt.UnixNano(), msgs)
 }
 
 func (p *Producer) PublishPartition(topic string, partitionID int, msg []byte) error {
-	return p.sendPartition(topic, partitionID, [][]byte{msg})
+	return p.sendPartition(topic, partitionID, bodiesToMessages([][]byte{msg}))
+}
+
+//PublishPartitionWithKey publishes msg with a key and headers to a partition, both may be nil
+func (p *Producer) PublishPartitionWithKey(topic string, partitionID int, key []byte, headers []message.Header, msg []byte) error {
+	return p.sendPartition(topic, partitionID, []*message.Message{{Key: key, Headers: headers, Body: msg}})
 }
 
 func (p *Producer) MultiPublishPartition(topic string, partitionID int, msgs [][]byte) error {
-	return p.sendPartition(topic, partitionID, msgs)
-}
-
-func (p *Producer) send(topic string, msgsByt [][]byte, errChan chan<- error) {
-	nodeTopicMeta := p.metadata.FindTopicAllPartitions(topic)
-	if len(nodeTopicMeta) == 0 {
-		nodes := p.metadata.GetAllNodes()
-		for i, node := range nodes {
-			nodeTopicMeta[node] = meta.TopicMetadata{
-				Topic:       topic,
-				PartitionID: i + 1,
-				IsReplica:   false,
-			}
+	return p.sendPartition(topic, partitionID, bodiesToMessages(msgs))
+}
+
+func bodiesToMessages(bodies [][]byte) []*message.Message {
+	msgs := make([]*message.Message, 0, len(bodies))
+	for _, body := range bodies {
+		msgs = append(msgs, &message.Message{Body: body})
+	}
+	return msgs
+}
+
+//send splits published by the partitioner keeping their order within a partition, the partitions are sent concurrently.
+//deliverAt is 0 for messages delivered at once
+func (p *Producer) send(topic string, deliverAt int64, published []*message.Message) <-chan error {
+	partitionNodes := p.topicPartitions(topic)
+	if len(partitionNodes) == 0 {
+		return failed(errors.Wrap(ErrNoPartition, topic))
+	}
+	partitionIDs := make([]int, 0, len(partitionNodes))
+	for partitionID := range partitionNodes {
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	sort.Ints(partitionIDs)
+	partitionMsgs := make(map[int][]*message.Message)
+	for _, msg := range published {
+		partitionID, err := p.partitioner.Partition(topic, msg, partitionIDs)
+		if err != nil {
+			return failed(err)
 		}
+		partitionMsgs[partitionID] = append(partitionMsgs[partitionID], msg)
 	}
-	fmt.Println("node topicmeta are ", nodeTopicMeta)
-	length := len(msgsByt) / len(nodeTopicMeta)
-	i := 0
-	j := length
+	errChan := make(chan error, len(partitionMsgs))
 	var wg sync.WaitGroup
-	wg.Add(len(nodeTopicMeta))
-	for node, tm := range nodeTopicMeta {
-		go func(node string, topicmeta meta.TopicMetadata, msgsByt [][]byte, wg sync.WaitGroup, errChan chan<- error) {
-			err := p.sendToBroker(node, p.makeMessages(topic, msgsByt, topicmeta.PartitionID))
-			if err != nil {
+	wg.Add(len(partitionMsgs))
+	for partitionID, msgs := range partitionMsgs {
+		go func(node string, partitionID int, msgs []*message.Message) {
+			defer wg.Done()
+			if err := p.sendBatch(node, topic, partitionID, deliverAt, msgs); err != nil {
 				errChan <- err
 			}
-			wg.Done()
-		}(node, tm, msgsByt[i:j], wg, errChan)
-		i = j
-		j += length
+		}(partitionNodes[partitionID], partitionID, msgs)
+	}
+	go func() {
+		wg.Wait()
+		close(errChan)
+	}()
+	return errChan
+}
+
+//failed returns a closed channel holding err, nothing was sent
+func failed(err error) <-chan error {
+	errChan := make(chan error, 1)
+	errChan <- err
+	close(errChan)
+	return errChan
+}
+
+//topicPartitions returns the node of each partition of topic, a topic not created yet takes one partition a node
+func (p *Producer) topicPartitions(topic string) map[int]string {
+	partitionNodes := p.metadata.FindTopicPartitionNodes(topic)
+	if len(partitionNodes) == 0 {
+		for i, node := range p.metadata.GetAllNodes() {
+			partitionNodes[i+1] = node
+		}
 	}
-	wg.Wait()
+	return partitionNodes
 }
 
-func (p *Producer) sendPartition(topic string, partitionID int, msgsByt [][]byte) error {
+func (p *Producer) sendPartition(topic string, partitionID int, published []*message.Message) error {
 	node := p.metadata.FindNodeWithTopicPartitionID(topic, partitionID, false)
 	if node == "" {
 		node = p.metadata.GetAllNodes()[0]
 	}
-	return p.sendToBroker(node, p.makeMessages(topic, msgsByt, partitionID))
+	return p.sendBatch(node, topic, partitionID, 0, published)
+}
+
+//sendBatch sends the batches of a partition one at a time, each with the next sequence of the partition.
+//The sequence moves on even if sending failed, so a batch written before the failure is not taken for a retry
+//by the next one. The next one is then refused for a gap and returned with ErrOutOfOrderSequence, it is not written.
+//A new producer id is taken for the batches after it, so a caller sending the refused batch again has it written
+//after them, the order of the batches across the gap is lost. In a transaction the gap fails the transaction instead
+func (p *Producer) sendBatch(node, topic string, partitionID int, deliverAt int64, published []*message.Message) error {
+	msgs, err := p.makeMessages(topic, published, partitionID)
+	if err != nil {
+		return err
+	}
+	msgs.DeliverAt = deliverAt
+	if msgs.TransactionID, err = p.addToTransaction(node, topic, partitionID, deliverAt != 0); err != nil {
+		return err
+	}
+	sequenceI, _ := p.sequences.LoadOrStore(topic+"_"+strconv.Itoa(partitionID), &partitionSequence{})
+	sequence := sequenceI.(*partitionSequence)
+	sequence.lock.Lock()
+	defer sequence.lock.Unlock()
+	msgs.ProducerID, msgs.Sequence = atomic.LoadInt64(&p.producerID), sequence.next
+	sequence.next++
+	err = p.sendToBroker(node, msgs)
+	if msgs.TransactionID != 0 && err != nil {
+		p.failTransaction(msgs.TransactionID, err)
+		return err
+	}
+	if !errors.Is(err, ErrOutOfOrderSequence) {
+		return err
+	}
+	if initErr := p.initProducerID(); initErr != nil {
+		return errors.Wrapf(err, "init producer id : %v", initErr)
+	}
+	return err
 }
 
 func (p *Producer) sendToBroker(node string, msgs *message.Messages) error {
@@ -129,7 +269,16 @@ func (p *Producer) sendToBroker(node string, msgs *message.Messages) error {
 
 //bool is that if Meta changed
 func (p *Producer) httpSendToBroker(node string, msgsByt []byte) (bool, error) {
-	resp, err := http.Post(node, "application/json", bytes.NewBuffer(msgsByt))
+	var resp *http.Response
+	var err error
+	for i := 0; i <= produceRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * produceRetryBackoff)
+		}
+		if resp, err = http.Post(node, "application/json", bytes.NewBuffer(msgsByt)); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return false, err
 	}
@@ -138,9 +287,44 @@ func (p *Producer) httpSendToBroker(node string, msgsByt []byte) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if resp.StatusCode == http.StatusConflict {
+		switch string(data) {
+		case status.OutOfOrderSequence:
+			return false, ErrOutOfOrderSequence
+		case status.TransactionFenced:
+			return false, ErrTransactionFenced
+		case status.InvalidTransaction:
+			return false, ErrInvalidTransaction
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New(string(data))
+	}
 	return status.MetaChanged == string(data), nil
 }
 
+//initProducerID takes a new producer id from zero, the brokers write the first batch of an id whatever its sequence
+func (p *Producer) initProducerID() error {
+	resp, err := http.Post(p.zeroAddress+"/"+meta.InitProducerID.String(), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(data))
+	}
+	producerID, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&p.producerID, producerID)
+	return nil
+}
+
 func (p *Producer) obtainMetaFromZero() (*meta.Metadata, error) {
 	resp, err := http.Get(p.zeroAddress + "/" + meta.FetchMetadata.String())
 	if err != nil {
@@ -161,21 +345,34 @@ func (p *Producer) obtainMetaFromZero() (*meta.Metadata, error) {
 	return metadata, nil
 }
 
-func (p *Producer) makeMessages(topic string, msgsByt [][]byte, partitionID int) *message.Messages {
+func (p *Producer) makeMessages(topic string, published []*message.Message, partitionID int) (*message.Messages, error) {
 	msgs := make([]*message.Message, 0)
-	for _, msgByt := range msgsByt {
+	now := time.Now().UnixNano()
+	for i, pub := range published {
 		msgs = append(msgs, &message.Message{
-			Body:    msgByt,
-			IsRetry: false,
+			//relative offset in a compressed batch, the broker assigns the real one
+			Offset:    int64(i),
+			Key:       pub.Key,
+			Headers:   pub.Headers,
+			Body:      pub.Body,
+			Timestamp: now,
+			IsRetry:   false,
 			//SeqNum:
 		})
 	}
+	if p.codec != message.CodecNone && len(msgs) != 0 {
+		batch, err := message.CompressMessages(p.codec, msgs)
+		if err != nil {
+			return nil, err
+		}
+		msgs = []*message.Message{batch}
+	}
 	return &message.Messages{
 		Topic:       topic,
 		Msgs:        msgs,
 		PartitionID: partitionID,
 		MetaVersion: p.metadata.GetVersion(),
-	}
+	}, nil
 }
 
 /*
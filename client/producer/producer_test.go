@@ -1 +1,78 @@
 package producer
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"yithQ/message"
+	"yithQ/meta"
+	"yithQ/status"
+)
+
+func TestProducerSequence(t *testing.T) {
+	var lock sync.Mutex
+	var lastProducerID int64 = 100
+	var batches []*message.Messages
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+meta.InitProducerIDStr, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		lastProducerID++
+		w.Write([]byte(strconv.FormatInt(lastProducerID, 10)))
+	})
+	mux.HandleFunc("/produce", func(w http.ResponseWriter, r *http.Request) {
+		byt, _ := ioutil.ReadAll(r.Body)
+		msgs := &message.Messages{}
+		if err := json.Unmarshal(byt, msgs); err != nil {
+			t.Errorf("unmarshal produce request error : %v", err)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, msgs)
+		//the broker lost a batch of the first producer id
+		if len(batches) == 3 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(status.OutOfOrderSequence))
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	metadata := meta.NewMetadata()
+	metadata.SetTopic("127.0.0.1:1", meta.TopicMetadata{Topic: "yith", PartitionID: 1})
+	p := &Producer{zeroAddress: server.URL, metadata: metadata, producerPort: server.URL[strings.LastIndex(server.URL, ":"):], partitioner: NewHashPartitioner()}
+	if err := p.initProducerID(); err != nil {
+		t.Fatalf("init producer id error : %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Publish("yith", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("publish error : %v", err)
+		}
+	}
+	//the batch refused for a gap is returned to the caller, the next one goes on with a new producer id
+	if err := p.Publish("yith", []byte("2")); !errors.Is(err, ErrOutOfOrderSequence) {
+		t.Fatalf("publish after a gap error is %v", err)
+	}
+	if err := p.PublishPartition("yith", 1, []byte("3")); err != nil {
+		t.Fatalf("publish partition error : %v", err)
+	}
+	want := []struct {
+		producerID int64
+		sequence   uint64
+	}{{101, 0}, {101, 1}, {101, 2}, {102, 3}}
+	if len(batches) != len(want) {
+		t.Fatalf("broker received %d batches, want %d", len(batches), len(want))
+	}
+	for i, batch := range batches {
+		if batch.ProducerID != want[i].producerID || batch.Sequence != want[i].sequence {
+			t.Fatalf("batch %d is producer %d sequence %d, want %v", i, batch.ProducerID, batch.Sequence, want[i])
+		}
+	}
+}
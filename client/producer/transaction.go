@@ -0,0 +1,158 @@
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"yithQ/meta"
+	"yithQ/status"
+)
+
+var ErrTransactionInProgress error = errors.New("a transaction is in progress")
+var ErrNoTransaction error = errors.New("no transaction is in progress")
+var ErrInvalidTransaction error = errors.New(status.InvalidTransaction)
+var ErrTransactionFenced error = errors.New(status.TransactionFenced)
+var ErrDelayedInTransaction error = errors.New("a delayed message cannot be published in a transaction")
+
+//transaction of the producer between BeginTransaction and its end
+type transaction struct {
+	producerID int64
+	id         int64
+	//partitions added to the transaction in zero, key is topic_partitionID
+	partitions map[string]bool
+	//the error that left a batch out of the transaction, it can only be aborted
+	failed error
+}
+
+//BeginTransaction starts a transaction, the messages published until CommitTransaction or AbortTransaction are
+//read by read_committed consumers only once it is committed, and never if it is aborted. The publishes of a
+//transaction must have returned before it is ended. A transaction not ended within transaction_timeout of zero is aborted
+func (p *Producer) BeginTransaction() error {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+	if p.txn != nil {
+		return ErrTransactionInProgress
+	}
+	producerID := atomic.LoadInt64(&p.producerID)
+	data, err := p.txnRequest(meta.BeginTxn, &meta.TxnRequest{ProducerID: producerID})
+	if err != nil {
+		return err
+	}
+	transactionID, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	p.txn = &transaction{producerID: producerID, id: transactionID, partitions: make(map[string]bool)}
+	return nil
+}
+
+//CommitTransaction makes the messages of the transaction visible, a transaction a batch of which failed is not
+//committed, AbortTransaction must end it
+func (p *Producer) CommitTransaction() error {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+	if p.txn == nil {
+		return ErrNoTransaction
+	}
+	if p.txn.failed != nil {
+		return errors.Wrap(p.txn.failed, "abort the transaction")
+	}
+	return p.endTransaction(true)
+}
+
+func (p *Producer) AbortTransaction() error {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+	if p.txn == nil {
+		return ErrNoTransaction
+	}
+	failed := p.txn.failed
+	if err := p.endTransaction(false); err != nil {
+		return err
+	}
+	//the sequences of the partitions have a gap, go on with a new id
+	if errors.Is(failed, ErrOutOfOrderSequence) {
+		return p.initProducerID()
+	}
+	return nil
+}
+
+//endTransaction asks zero to end the transaction, it is ended even if zero has aborted it for the timeout,
+//the caller holds txnLock
+func (p *Producer) endTransaction(commit bool) error {
+	_, err := p.txnRequest(meta.EndTxn, &meta.TxnRequest{
+		ProducerID:    p.txn.producerID,
+		TransactionID: p.txn.id,
+		Commit:        commit,
+	})
+	if err != nil && !errors.Is(err, ErrInvalidTransaction) {
+		return err
+	}
+	p.txn = nil
+	return err
+}
+
+//addToTransaction adds the partition to the transaction in progress before its first batch and returns its id,
+//0 out of a transaction
+func (p *Producer) addToTransaction(node, topic string, partitionID int, delayed bool) (int64, error) {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+	if p.txn == nil {
+		return 0, nil
+	}
+	if delayed {
+		return 0, ErrDelayedInTransaction
+	}
+	if p.txn.failed != nil {
+		return 0, errors.Wrap(p.txn.failed, "abort the transaction")
+	}
+	key := topic + "_" + strconv.Itoa(partitionID)
+	if !p.txn.partitions[key] {
+		_, err := p.txnRequest(meta.AddPartitionsToTxn, &meta.TxnRequest{
+			ProducerID:    p.txn.producerID,
+			TransactionID: p.txn.id,
+			Partitions:    []meta.TxnPartition{{Topic: topic, PartitionID: partitionID, Node: node}},
+		})
+		if err != nil {
+			return 0, err
+		}
+		p.txn.partitions[key] = true
+	}
+	return p.txn.id, nil
+}
+
+//failTransaction leaves the transaction transactionID to abort
+func (p *Producer) failTransaction(transactionID int64, err error) {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+	if p.txn != nil && p.txn.id == transactionID && p.txn.failed == nil {
+		p.txn.failed = err
+	}
+}
+
+func (p *Producer) txnRequest(signal meta.Signal, txnReq *meta.TxnRequest) ([]byte, error) {
+	byt, err := json.Marshal(txnReq)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(p.zeroAddress+"/"+signal.String(), "application/json", bytes.NewReader(byt))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusConflict && string(data) == status.InvalidTransaction {
+		return nil, ErrInvalidTransaction
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(string(data))
+	}
+	return data, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"yithQ/yith/queue"
+)
+
+//yith-backup talks to the admin port of the yith nodes, a backup holds the partitions of one topic
+const usage = `usage: yith-backup <command> [flags] ...
+
+commands:
+  backup   -topic <topic> -o <archive> <admin addr>...
+           take a backup of the topic from every node holding its partitions, writes go on meanwhile
+  restore  <archive> <admin addr>...
+           recreate the partitions on the nodes of another cluster, spread over them, with their offsets
+  show     <archive>
+           print the manifest and the topic config of a backup
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		topic := flags.String("topic", "", "the topic to back up")
+		output := flags.String("o", "", "the archive to write")
+		flags.Parse(os.Args[2:])
+		if *topic == "" || *output == "" || flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = backup(*topic, *output, flags.Args())
+	case "restore":
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = restore(flags.Arg(0), flags.Args()[1:])
+	case "show":
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = show(flags.Arg(0))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func adminURL(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+//backup merges the archives of all nodes into one, every node snapshots its partitions when asked,
+//so the nodes are asked before any archive is read
+func backup(topic, output string, addrs []string) error {
+	readers := make([]*queue.BackupReader, 0, len(addrs))
+	manifest := &queue.BackupManifest{
+		Version:   queue.BackupVersion,
+		Topic:     topic,
+		CreatedAt: time.Now(),
+	}
+	var br *queue.BackupReader
+	for _, addr := range addrs {
+		resp, err := http.Get(adminURL(addr, "/backup?topic="+url.QueryEscape(topic)))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		//the node holds no leader partition of the topic
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("backup from %s : %s %s", addr, resp.Status, body)
+		}
+		if br, err = queue.NewBackupReader(resp.Body); err != nil {
+			return fmt.Errorf("backup from %s : %v", addr, err)
+		}
+		for _, bp := range br.Manifest.Partitions {
+			if _, ok := manifest.Partition(bp.PartitionID); ok {
+				return fmt.Errorf("partition %d is held by more than one node", bp.PartitionID)
+			}
+			manifest.Partitions = append(manifest.Partitions, bp)
+		}
+		readers = append(readers, br)
+	}
+	if len(readers) == 0 {
+		return fmt.Errorf("no node holds topic %s", topic)
+	}
+	sort.Slice(manifest.Partitions, func(i, j int) bool {
+		return manifest.Partitions[i].PartitionID < manifest.Partitions[j].PartitionID
+	})
+
+	f, err := os.OpenFile(output+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output + ".tmp")
+	defer f.Close()
+	bw, err := queue.NewBackupWriter(f, manifest, readers[0].TopicConf)
+	if err != nil {
+		return err
+	}
+	for _, br := range readers {
+		if err := copyFiles(br, func(bf *queue.BackupFile) (*queue.BackupWriter, error) { return bw, nil }); err != nil {
+			return err
+		}
+	}
+	if err := bw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(output+".tmp", output); err != nil {
+		return err
+	}
+	fmt.Printf("backup topic %s partitions %d to %s\n", topic, len(manifest.Partitions), output)
+	return nil
+}
+
+//copyFiles copies every segment file left in br to the writer route returns for it
+func copyFiles(br *queue.BackupReader, route func(bf *queue.BackupFile) (*queue.BackupWriter, error)) error {
+	for {
+		bf, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		bw, err := route(bf)
+		if err != nil {
+			return err
+		}
+		if err := bw.WriteFile(bf); err != nil {
+			return err
+		}
+	}
+}
+
+type restoreResult struct {
+	addr string
+	err  error
+}
+
+//restore streams the archive to the nodes at once, partition i of the manifest goes to node i%len(addrs)
+func restore(archive string, addrs []string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br, err := queue.NewBackupReader(f)
+	if err != nil {
+		return err
+	}
+	nodeManifests := make([]*queue.BackupManifest, len(addrs))
+	nodeOf := make(map[int]int)
+	for i, bp := range br.Manifest.Partitions {
+		node := i % len(addrs)
+		if nodeManifests[node] == nil {
+			nodeManifest := *br.Manifest
+			nodeManifest.Partitions = nil
+			nodeManifests[node] = &nodeManifest
+		}
+		nodeManifests[node].Partitions = append(nodeManifests[node].Partitions, bp)
+		nodeOf[bp.PartitionID] = node
+	}
+
+	writers := make([]*queue.BackupWriter, len(addrs))
+	pipes := make([]*io.PipeWriter, len(addrs))
+	results := make(chan restoreResult, len(addrs))
+	posts := 0
+	for node, nodeManifest := range nodeManifests {
+		if nodeManifest == nil {
+			continue
+		}
+		pr, pw := io.Pipe()
+		go func(addr string) {
+			resp, err := http.Post(adminURL(addr, "/restore"), "application/gzip", pr)
+			if err == nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("%s %s", resp.Status, body)
+				}
+			}
+			//a node that failed before reading the whole archive must not block the others
+			if err != nil {
+				pr.CloseWithError(err)
+			}
+			results <- restoreResult{addr: addr, err: err}
+		}(addrs[node])
+		posts++
+		pipes[node] = pw
+		if writers[node], err = queue.NewBackupWriter(pw, nodeManifest, br.TopicConf); err != nil {
+			return err
+		}
+	}
+	copyErr := copyFiles(br, func(bf *queue.BackupFile) (*queue.BackupWriter, error) {
+		return writers[nodeOf[bf.PartitionID]], nil
+	})
+	for node, bw := range writers {
+		if bw == nil {
+			continue
+		}
+		if copyErr == nil {
+			pipes[node].CloseWithError(bw.Close())
+		} else {
+			pipes[node].CloseWithError(copyErr)
+		}
+	}
+	failed := 0
+	for i := 0; i < posts; i++ {
+		result := <-results
+		if result.err != nil {
+			fmt.Fprintf(os.Stderr, "restore to %s failed : %v\n", result.addr, result.err)
+			failed++
+		}
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if failed != 0 {
+		return fmt.Errorf("restore failed on %d of %d nodes", failed, posts)
+	}
+	for node, nodeManifest := range nodeManifests {
+		if nodeManifest == nil {
+			continue
+		}
+		for _, bp := range nodeManifest.Partitions {
+			fmt.Printf("restored %s-%d to %s, offsets %d-%d\n", br.Manifest.Topic, bp.PartitionID, addrs[node], bp.LogStartOffset, bp.LastOffset)
+		}
+	}
+	return printTopicConf(br)
+}
+
+func show(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br, err := queue.NewBackupReader(f)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(br.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return printTopicConf(br)
+}
+
+//printTopicConf prints the topic config of the backup, it is not applied to the nodes, they read it from yith.yml
+func printTopicConf(br *queue.BackupReader) error {
+	data, err := yaml.Marshal(map[string]interface{}{"topics": map[string]interface{}{br.Manifest.Topic: br.TopicConf}})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("topic config of the backup, for yith.yml:\n%s", data)
+	return nil
+}
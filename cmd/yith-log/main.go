@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"yithQ/message"
+	"yithQ/util/logger"
+	"yithQ/yith/queue"
+)
+
+//yith-log inspects the segment files of a stopped broker, it needs neither the config nor zero
+const usage = `usage: yith-log <command> [flags] <segment .data file or partition dir>...
+
+commands:
+  dump           print every record with its offset, timestamp, key and body,
+                 the records of encrypted segments are printed with -keyfile only
+  verify         check the records, report offset gaps, corruption and index entries not matching the data
+  rebuild-index  rewrite the .index and .timeindex of a segment from its data file
+`
+
+func main() {
+	//the key file warns on stderr if it can not be read again
+	logger.NewLogger(os.Stderr, "warn")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	var err error
+	ok := true
+	switch os.Args[1] {
+	case "dump":
+		bodies := flags.Bool("bodies", true, "print the record bodies")
+		expand := flags.Bool("expand", true, "print the records inside compressed batches")
+		keyFile := flags.String("keyfile", "", "the key file of the encrypted segments")
+		flags.Parse(os.Args[2:])
+		var keys queue.KeyProvider
+		if *keyFile != "" {
+			if keys, err = queue.NewKeyFile(*keyFile); err != nil {
+				break
+			}
+		}
+		err = forEachSegment(flags.Args(), func(path string) error {
+			return dump(path, keys, *bodies, *expand)
+		})
+	case "verify":
+		flags.Parse(os.Args[2:])
+		ok, err = verify(flags.Args())
+	case "rebuild-index":
+		flags.Parse(os.Args[2:])
+		err = forEachSegment(flags.Args(), rebuildIndex)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+//segmentPaths expands the partition dirs in paths to their data files
+func segmentPaths(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no segment file or partition dir given")
+	}
+	segments := make([]string, 0)
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			segments = append(segments, path)
+			continue
+		}
+		files, err := queue.SegmentFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, files...)
+	}
+	return segments, nil
+}
+
+func forEachSegment(paths []string, fn func(path string) error) error {
+	segments, err := segmentPaths(paths)
+	if err != nil {
+		return err
+	}
+	for _, path := range segments {
+		if err := fn(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dump(path string, keys queue.KeyProvider, bodies bool, expand bool) error {
+	fmt.Printf("segment %s\n", path)
+	err := queue.ForEachSegmentRecord(path, keys, func(rec *queue.SegmentRecord) error {
+		msg := rec.Msg
+		fmt.Printf("offset: %d position: %d size: %d timestamp: %s", msg.Offset, rec.Position, rec.Size, formatTimestamp(msg.Timestamp))
+		if rec.Encrypted {
+			fmt.Printf(" base offset: %d encrypted\n", rec.BaseOffset)
+			return nil
+		}
+		if msg.IsCompressed() {
+			fmt.Printf(" codec: %s base offset: %d count: %d\n", msg.Codec(), rec.BaseOffset, msg.OffsetCount())
+			if !expand {
+				return nil
+			}
+			inners, err := msg.InnerMessages()
+			if err != nil {
+				return err
+			}
+			for _, inner := range inners {
+				fmt.Printf("  | offset: %d timestamp: %s", inner.Offset, formatTimestamp(inner.Timestamp))
+				printKeyBody(inner, bodies)
+			}
+			return nil
+		}
+		printKeyBody(msg, bodies)
+		return nil
+	})
+	if corruption, ok := err.(*queue.CorruptionError); ok {
+		fmt.Printf("corrupted record at %v\n", corruption)
+		return nil
+	}
+	return err
+}
+
+func printKeyBody(msg *message.Message, bodies bool) {
+	if msg.Key != nil {
+		fmt.Printf(" key: %q", msg.Key)
+	}
+	for _, header := range msg.Headers {
+		fmt.Printf(" header: %s=%q", header.Key, header.Value)
+	}
+	if bodies {
+		fmt.Printf(" body: %q", msg.Body)
+	}
+	fmt.Println()
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(0, timestamp).Format(time.RFC3339Nano)
+}
+
+//verify returns false if any segment has problems, gaps alone are reported but fine
+func verify(paths []string) (bool, error) {
+	segments, err := segmentPaths(paths)
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	var last *queue.SegmentReport
+	for _, path := range segments {
+		report, err := queue.VerifySegment(path)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("segment %s: %d records, offsets %d-%d, %d of %d bytes valid\n",
+			path, report.Records, report.StartOffset, report.EndOffset, report.ValidSize, report.Size)
+		//the segments of a partition dir follow each other
+		if last != nil && last.Records != 0 && report.Records != 0 {
+			if report.StartOffset <= last.EndOffset {
+				report.Problems = append(report.Problems, fmt.Sprintf("starts at offset %d, not after %d of the previous segment", report.StartOffset, last.EndOffset))
+			} else if report.StartOffset > last.EndOffset+1 {
+				report.Gaps = append([]queue.OffsetGap{{From: last.EndOffset + 1, To: report.StartOffset - 1}}, report.Gaps...)
+			}
+		}
+		for _, gap := range report.Gaps {
+			fmt.Printf("  gap: offsets %d-%d are missing\n", gap.From, gap.To)
+		}
+		for _, problem := range report.Problems {
+			fmt.Printf("  problem: %s\n", problem)
+			ok = false
+		}
+		if report.Records != 0 {
+			last = report
+		}
+	}
+	return ok, nil
+}
+
+func rebuildIndex(path string) error {
+	report, err := queue.RebuildSegmentIndex(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("segment %s: rebuild index of %d records, last offset %d\n", path, report.Records, report.EndOffset)
+	if report.ValidSize < report.Size {
+		fmt.Printf("  %d bytes after position %d are not valid records and not indexed\n",
+			report.Size-report.ValidSize, report.ValidSize)
+	}
+	return nil
+}
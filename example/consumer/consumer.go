@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -40,10 +39,9 @@ func main() {
 		panic("read consumer http response error : " + err.Error())
 	}
 	//fmt.Println("data is ", string(data))
-	var msgs []*message.Message
-	err = json.Unmarshal([]byte("["+string(data)+"]"), &msgs)
+	msgs, err := message.DecodeRecords(data)
 	if err != nil {
-		panic("json unmarshal msgs by consume from yith error : " + err.Error())
+		panic("decode msgs by consume from yith error : " + err.Error())
 	}
 	fmt.Println("consume bench is ", time.Since(start).Seconds())
 	for _, msg := range msgs {
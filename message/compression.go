@@ -0,0 +1,228 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+//a compressed batch is a single wrapper record whose attributes hold the codec and whose body is the
+//compressed records of the batch. Inner records carry offsets relative to the first one, the wrapper
+//carries the absolute offset of the last one, so inner offset = wrapper offset - last relative + relative
+type Codec int8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecLz4
+	CodecZstd
+
+	codecMask = 0x07
+)
+
+var codecNames = []string{"none", "gzip", "snappy", "lz4", "zstd"}
+
+var ErrUnknownCodec error = errors.New("unknown compression codec")
+var ErrInvalidBatch error = errors.New("invalid compressed batch")
+
+//MaxBatchRecords bounds the offsets one compressed batch takes
+const MaxBatchRecords = 1 << 20
+
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+	return "unknown"
+}
+
+//ParseCodec accepts the codec names and "uncompressed" for CodecNone
+func ParseCodec(name string) (Codec, error) {
+	if name == "uncompressed" || name == "" {
+		return CodecNone, nil
+	}
+	for i, codecName := range codecNames {
+		if codecName == name {
+			return Codec(i), nil
+		}
+	}
+	return CodecNone, errors.Wrap(ErrUnknownCodec, name)
+}
+
+func (m *Message) Codec() Codec {
+	return Codec(m.Attributes & codecMask)
+}
+
+func (m *Message) IsCompressed() bool {
+	return m.Codec() != CodecNone
+}
+
+//CompressMessages wraps msgs into one record compressed with codec, msgs must have contiguous offsets,
+//ep: 0..n-1 assigned by the producer
+func CompressMessages(codec Codec, msgs []*Message) (*Message, error) {
+	if len(msgs) == 0 || len(msgs) > MaxBatchRecords {
+		return nil, ErrInvalidBatch
+	}
+	first, last := msgs[0], msgs[len(msgs)-1]
+	records := make([]byte, 0)
+	var maxTimestamp int64
+	for i, msg := range msgs {
+		if msg.IsCompressed() {
+			return nil, errors.Wrap(ErrInvalidBatch, "nested compressed batch")
+		}
+		if msg.Offset != first.Offset+int64(i) {
+			return nil, errors.Wrap(ErrInvalidBatch, "offsets not contiguous")
+		}
+		inner := *msg
+		inner.Offset = msg.Offset - first.Offset
+		records = AppendRecord(records, &inner)
+		if msg.Timestamp > maxTimestamp {
+			maxTimestamp = msg.Timestamp
+		}
+	}
+	body, err := Compress(codec, records)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Offset:     last.Offset,
+		Attributes: int8(codec),
+		Body:       body,
+		Timestamp:  maxTimestamp,
+		Count:      len(msgs),
+	}, nil
+}
+
+//CompressRuns compresses msgs with increasing offsets into one batch per run of contiguous offsets,
+//ep: the records a compaction keeps of a batch
+func CompressRuns(codec Codec, msgs []*Message) ([]*Message, error) {
+	batches := make([]*Message, 0, 1)
+	for start := 0; start < len(msgs); {
+		end := start + 1
+		for end < len(msgs) && msgs[end].Offset == msgs[end-1].Offset+1 {
+			end++
+		}
+		batch, err := CompressMessages(codec, msgs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+		start = end
+	}
+	return batches, nil
+}
+
+//CountFromHeader sets Count of a compressed batch of a produce request from its header without decompressing it,
+//the wrapper of such a batch carries the relative offset of its last record
+func (m *Message) CountFromHeader() error {
+	if m.Offset < 0 || m.Offset >= MaxBatchRecords {
+		return errors.Wrapf(ErrInvalidBatch, "last relative offset %d", m.Offset)
+	}
+	m.Count = int(m.Offset) + 1
+	return nil
+}
+
+//InnerMessages decompresses a wrapper record and returns its records with absolute offsets,
+//the inner records must carry the relative offsets 0..n-1
+func (m *Message) InnerMessages() ([]*Message, error) {
+	records, err := Decompress(m.Codec(), m.Body)
+	if err != nil {
+		return nil, err
+	}
+	inners := make([]*Message, 0)
+	for len(records) > 0 {
+		inner, n, err := DecodeRecord(records)
+		if err != nil {
+			return nil, err
+		}
+		inners = append(inners, inner)
+		records = records[n:]
+	}
+	if len(inners) == 0 || len(inners) > MaxBatchRecords {
+		return nil, ErrInvalidBatch
+	}
+	for i, inner := range inners {
+		if inner.IsCompressed() || inner.Offset != int64(i) {
+			return nil, ErrInvalidBatch
+		}
+	}
+	for _, inner := range inners {
+		inner.Offset = m.Offset - int64(len(inners)-1) + inner.Offset
+	}
+	m.Count = len(inners)
+	return inners, nil
+}
+
+//OffsetCount is the number of offsets the record takes, Count of a compressed batch, otherwise 1
+func (m *Message) OffsetCount() int64 {
+	if m.Count > 1 {
+		return int64(m.Count)
+	}
+	return 1
+}
+
+//BaseOffset is the offset of the first record in a compressed batch, Offset itself otherwise
+func (m *Message) BaseOffset() int64 {
+	return m.Offset - m.OffsetCount() + 1
+}
+
+func Compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, data), nil
+	case CodecLz4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+func Decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	case CodecLz4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, ErrUnknownCodec
+}
+
+//zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
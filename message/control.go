@@ -0,0 +1,63 @@
+package message
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+//control records are written by the broker into the log, ep: the markers ending a transaction in a partition.
+//They take an offset like any record, consumers skip them. The body of a control record:
+//
+//	type       int8
+//	producerID int64
+const (
+	controlAttribute int8 = 0x20
+	controlBodyLen        = 1 + 8
+)
+
+type ControlType int8
+
+const (
+	ControlAbort ControlType = iota
+	ControlCommit
+)
+
+//IsolationLevel tells the broker which records of transactions a consumer sees
+type IsolationLevel string
+
+const (
+	//ReadUncommitted serves every record, the default
+	ReadUncommitted IsolationLevel = "read_uncommitted"
+	//ReadCommitted stops at the first record of an open transaction and hides the records of aborted ones
+	ReadCommitted IsolationLevel = "read_committed"
+)
+
+//NextOffsetHeader of a read_committed consume response is the offset to consume from next,
+//the records hidden from the response may be the last ones read
+const NextOffsetHeader = "Yith-Next-Offset"
+
+var ErrInvalidControlRecord error = errors.New("invalid control record")
+
+//NewControlRecord returns the marker of controlType ending the transaction of producerID
+func NewControlRecord(controlType ControlType, producerID int64, timestamp int64) *Message {
+	body := make([]byte, controlBodyLen)
+	body[0] = byte(controlType)
+	binary.BigEndian.PutUint64(body[1:], uint64(producerID))
+	return &Message{
+		Attributes: controlAttribute,
+		Body:       body,
+		Timestamp:  timestamp,
+	}
+}
+
+func (m *Message) IsControl() bool {
+	return m.Attributes&controlAttribute != 0
+}
+
+//Control returns the type and producer id of a control record
+func (m *Message) Control() (ControlType, int64, error) {
+	if !m.IsControl() || len(m.Body) != controlBodyLen {
+		return 0, 0, errors.Wrapf(ErrInvalidControlRecord, "offset %d", m.Offset)
+	}
+	return ControlType(m.Body[0]), int64(binary.BigEndian.Uint64(m.Body[1:])), nil
+}
@@ -1,12 +1,25 @@
 package message
 
 type Message struct {
-	ID         int64  `json:"id"`
-	Body       []byte `json:"body"`
-	Timestamp  int64  `json:"timestamp"`
-	ProducerIP string `json:"producer_ip"`
-	SeqNum     uint64 `json:"seq_num"`
-	IsRetry    bool   `json:"is_retry"`
+	ID         int64    `json:"id"`
+	Offset     int64    `json:"offset"`
+	Key        []byte   `json:"key"`        //optional, compacted topics keep the newest record of each key
+	Headers    []Header `json:"headers"`    //optional, ep: trace id, content type
+	Attributes int8     `json:"attributes"` //low 3 bits are the Codec of a compressed batch
+	Body       []byte   `json:"body"`
+	Timestamp  int64    `json:"timestamp"`
+	ProducerIP string   `json:"producer_ip"`
+	SeqNum     uint64   `json:"seq_num"`
+	IsRetry    bool     `json:"is_retry"`
+
+	//offsets taken by a compressed batch, set by CompressMessages and InnerMessages
+	Count int `json:"-"`
+}
+
+//Header is metadata of a message kept apart from its body, keys may repeat and their order is kept
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
 }
 
 type Messages struct {
@@ -14,4 +27,26 @@ type Messages struct {
 	PartitionID int        `json:"partition_id"`
 	Msgs        []*Message `json:"msgs"`
 	MetaVersion uint32     `json:"meta_version"`
+	//an idempotent producer sets both, Sequence increases by 1 for each batch to the partition, 0 ProducerID is not idempotent
+	ProducerID int64  `json:"producer_id"`
+	Sequence   uint64 `json:"sequence"`
+	//the transaction from zero the batch is written in, 0 if it is not transactional
+	TransactionID int64 `json:"transaction_id"`
+	//unix nano the batch is held by the broker until, 0 or a time passed delivers it at once
+	DeliverAt int64 `json:"deliver_at,omitempty"`
+}
+
+//IsTombstone reports whether msg deletes its key from a compacted topic
+func (m *Message) IsTombstone() bool {
+	return m.Key != nil && len(m.Body) == 0
+}
+
+//Header returns the value of the last header of key, nil if there is none
+func (m *Message) Header(key string) []byte {
+	for i := len(m.Headers) - 1; i >= 0; i-- {
+		if m.Headers[i].Key == key {
+			return m.Headers[i].Value
+		}
+	}
+	return nil
 }
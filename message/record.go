@@ -0,0 +1,250 @@
+package message
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
+)
+
+//record layout on disk and on the consume wire:
+//
+//	offset      int64
+//	length      int32  bytes after this field
+//	magic       int8
+//	crc         uint32 castagnoli of attributes..body, since RecordMagicV2
+//	attributes  int8
+//	timestamp   int64
+//	keyLength   int32  -1 means no key
+//	key         []byte
+//	headerCount int32
+//	headers     [keyLength int32, key, valueLength int32, value], a -1 valueLength means no value
+//	bodyLength  int32
+//	body        []byte
+const (
+	RecordMagicV1 int8 = 1
+	//adds crc
+	RecordMagicV2 int8 = 2
+
+	CurrentRecordMagic = RecordMagicV2
+
+	//offset + length
+	RecordLogOverhead = 12
+	//magic + attributes + timestamp + keyLength + headerCount + bodyLength
+	recordV1FixedLen = 1 + 1 + 8 + 4 + 4 + 4
+	//magic + crc + attributes + timestamp + keyLength + headerCount + bodyLength
+	recordFixedLen = 1 + 4 + 1 + 8 + 4 + 4 + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrRecordTruncated error = errors.New("record truncated")
+var ErrRecordCorrupted error = errors.New("record corrupted")
+var ErrUnknownRecordMagic error = errors.New("unknown record magic")
+var ErrRecordChecksum error = errors.New("record checksum mismatch")
+
+//RecordSize is the encoded size of msg, including offset and length
+func (m *Message) RecordSize() int {
+	size := RecordLogOverhead + recordFixedLen + len(m.Key) + len(m.Body)
+	for _, header := range m.Headers {
+		size += 8 + len(header.Key) + len(header.Value)
+	}
+	return size
+}
+
+func EncodeRecord(msg *Message) []byte {
+	return AppendRecord(make([]byte, 0, msg.RecordSize()), msg)
+}
+
+//AppendRecord appends the record encoding of msg to dst, msg.Offset must be assigned
+func AppendRecord(dst []byte, msg *Message) []byte {
+	start := len(dst)
+	dst = appendInt64(dst, msg.Offset)
+	dst = appendInt32(dst, 0) //length, filled below
+	dst = append(dst, byte(CurrentRecordMagic))
+	dst = appendInt32(dst, 0) //crc, filled below
+	crcStart := len(dst)
+	dst = append(dst, byte(msg.Attributes))
+	dst = appendInt64(dst, msg.Timestamp)
+	dst = appendBytes(dst, msg.Key)
+	dst = appendInt32(dst, int32(len(msg.Headers)))
+	for _, header := range msg.Headers {
+		dst = appendInt32(dst, int32(len(header.Key)))
+		dst = append(dst, header.Key...)
+		dst = appendBytes(dst, header.Value)
+	}
+	dst = appendInt32(dst, int32(len(msg.Body)))
+	dst = append(dst, msg.Body...)
+	binary.BigEndian.PutUint32(dst[start+8:], uint32(len(dst)-start-RecordLogOverhead))
+	binary.BigEndian.PutUint32(dst[crcStart-4:], crc32.Checksum(dst[crcStart:], crcTable))
+	return dst
+}
+
+//RecordHead reads offset and total record size from the first RecordLogOverhead bytes of a record
+func RecordHead(data []byte) (offset int64, size int, err error) {
+	if len(data) < RecordLogOverhead {
+		return 0, 0, ErrRecordTruncated
+	}
+	offset = int64(binary.BigEndian.Uint64(data))
+	length := int32(binary.BigEndian.Uint32(data[8:]))
+	if length < recordV1FixedLen {
+		return 0, 0, ErrRecordCorrupted
+	}
+	return offset, RecordLogOverhead + int(length), nil
+}
+
+//RecordLength reads offset and total record size from the head of data, data must hold the whole record
+func RecordLength(data []byte) (offset int64, size int, err error) {
+	offset, size, err = RecordHead(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) < size {
+		return 0, 0, ErrRecordTruncated
+	}
+	return offset, size, nil
+}
+
+//ValidateRecord checks the length and crc of the first record in data without decoding it
+func ValidateRecord(data []byte) (offset int64, size int, err error) {
+	offset, size, err = RecordLength(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch int8(data[RecordLogOverhead]) {
+	case RecordMagicV1:
+	case RecordMagicV2:
+		if size < RecordLogOverhead+recordFixedLen {
+			return 0, 0, ErrRecordCorrupted
+		}
+		crc := binary.BigEndian.Uint32(data[RecordLogOverhead+1:])
+		if crc32.Checksum(data[RecordLogOverhead+5:size], crcTable) != crc {
+			return 0, 0, ErrRecordChecksum
+		}
+	default:
+		return 0, 0, ErrUnknownRecordMagic
+	}
+	return offset, size, nil
+}
+
+//DecodeRecord decodes the first record in data and returns the bytes it occupies
+func DecodeRecord(data []byte) (*Message, int, error) {
+	offset, size, err := ValidateRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := recordReader{buf: data[RecordLogOverhead:size]}
+	if int8(r.byte()) == RecordMagicV2 {
+		r.int32() //crc
+	}
+	msg := &Message{
+		Offset:     offset,
+		Attributes: int8(r.byte()),
+		Timestamp:  r.int64(),
+	}
+	msg.Key = r.bytes()
+	headerCount := r.int32()
+	if headerCount < 0 || int(headerCount) > len(r.buf)/8 {
+		return nil, 0, ErrRecordCorrupted
+	}
+	if headerCount > 0 {
+		msg.Headers = make([]Header, 0, headerCount)
+	}
+	for i := int32(0); i < headerCount && r.err == nil; i++ {
+		msg.Headers = append(msg.Headers, Header{Key: string(r.bytes()), Value: r.bytes()})
+	}
+	msg.Body = r.bytes()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return msg, size, nil
+}
+
+//DecodeRecords decodes a sequence of records, ep: the body of a consume response,
+//compressed batches are decompressed into their records
+func DecodeRecords(data []byte) ([]*Message, error) {
+	msgs := make([]*Message, 0)
+	for len(data) > 0 {
+		msg, n, err := DecodeRecord(data)
+		if err != nil {
+			return msgs, err
+		}
+		if msg.IsCompressed() {
+			inners, err := msg.InnerMessages()
+			if err != nil {
+				return msgs, err
+			}
+			msgs = append(msgs, inners...)
+		} else {
+			msgs = append(msgs, msg)
+		}
+		data = data[n:]
+	}
+	return msgs, nil
+}
+
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = ErrRecordCorrupted
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *recordReader) int32() int32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.err = ErrRecordCorrupted
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *recordReader) int64() int64 {
+	if r.err != nil || len(r.buf) < 8 {
+		r.err = ErrRecordCorrupted
+		return 0
+	}
+	v := int64(binary.BigEndian.Uint64(r.buf))
+	r.buf = r.buf[8:]
+	return v
+}
+
+//bytes returns nil for a -1 length
+func (r *recordReader) bytes() []byte {
+	n := r.int32()
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	if int(n) > len(r.buf) {
+		r.err = ErrRecordCorrupted
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+//appendBytes writes a -1 length for nil
+func appendBytes(dst []byte, b []byte) []byte {
+	if b == nil {
+		return appendInt32(dst, -1)
+	}
+	dst = appendInt32(dst, int32(len(b)))
+	return append(dst, b...)
+}
+
+func appendInt32(dst []byte, v int32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendInt64(dst []byte, v int64) []byte {
+	return append(dst, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
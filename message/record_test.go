@@ -0,0 +1,129 @@
+package message
+
+import (
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	msgs := []*Message{
+		{Offset: 7, Body: []byte("abcde"), Timestamp: time.Now().UnixNano()},
+		{Offset: 8, Key: []byte("k"), Body: []byte{}, Timestamp: time.Now().UnixNano()},
+		{Offset: 9, Key: []byte("k"), Headers: []Header{{Key: "trace-id", Value: []byte("t1")}, {Key: "empty", Value: []byte{}},
+			{Key: "trace-id", Value: nil}}, Body: []byte("fghij"), Timestamp: time.Now().UnixNano()},
+	}
+	var data []byte
+	for _, msg := range msgs {
+		data = AppendRecord(data, msg)
+	}
+	decoded, err := DecodeRecords(data)
+	if err != nil {
+		t.Fatalf("decode records error : %v", err)
+	}
+	if len(decoded) != len(msgs) {
+		t.Fatalf("decode %d records, want %d", len(decoded), len(msgs))
+	}
+	for i, msg := range decoded {
+		if msg.Offset != msgs[i].Offset || msg.Timestamp != msgs[i].Timestamp || string(msg.Body) != string(msgs[i].Body) ||
+			string(msg.Key) != string(msgs[i].Key) || (msg.Key == nil) != (msgs[i].Key == nil) || !headersEqual(msg.Headers, msgs[i].Headers) {
+			t.Fatalf("record %d is %v, want %v", i, msg, msgs[i])
+		}
+		if len(EncodeRecord(msgs[i])) != msgs[i].RecordSize() {
+			t.Fatalf("record %d size is %d, encoded to %d bytes", i, msgs[i].RecordSize(), len(EncodeRecord(msgs[i])))
+		}
+	}
+	if value := decoded[2].Header("trace-id"); value != nil {
+		t.Fatalf("last trace-id header is %q, want nil", value)
+	}
+
+	if _, err := DecodeRecords(data[:len(data)-1]); err != ErrRecordTruncated {
+		t.Fatalf("decode truncated records error is %v", err)
+	}
+}
+
+func headersEqual(a, b []Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || string(a[i].Value) != string(b[i].Value) || (a[i].Value == nil) != (b[i].Value == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecordChecksum(t *testing.T) {
+	data := EncodeRecord(&Message{Offset: 1, Body: []byte("abcde"), Timestamp: time.Now().UnixNano()})
+	data[len(data)-1] ^= 0xff
+	if _, _, err := DecodeRecord(data); err != ErrRecordChecksum {
+		t.Fatalf("decode corrupted record error is %v", err)
+	}
+}
+
+func TestCompressedBatch(t *testing.T) {
+	for _, codec := range []Codec{CodecGzip, CodecSnappy, CodecLz4, CodecZstd} {
+		msgs := []*Message{
+			{Offset: 0, Body: []byte("abcde"), Timestamp: 100},
+			{Offset: 1, Key: []byte("k"), Headers: []Header{{Key: "content-type", Value: []byte("text/plain")}}, Body: []byte("fghijk"), Timestamp: 200},
+			{Offset: 2, Body: []byte("lmnopq"), Timestamp: 150},
+		}
+		batch, err := CompressMessages(codec, msgs)
+		if err != nil {
+			t.Fatalf("compress with %s error : %v", codec, err)
+		}
+		if batch.Codec() != codec || batch.Count != 3 || batch.Timestamp != 200 {
+			t.Fatalf("batch compressed with %s is %v", codec, batch)
+		}
+		//the broker places the batch at offsets 10..12
+		batch.Offset = 12
+		data := append(EncodeRecord(&Message{Offset: 9, Body: []byte("plain")}), EncodeRecord(batch)...)
+		decoded, err := DecodeRecords(data)
+		if err != nil {
+			t.Fatalf("decode batch compressed with %s error : %v", codec, err)
+		}
+		if len(decoded) != 4 {
+			t.Fatalf("decode %d records from batch compressed with %s, want 4", len(decoded), codec)
+		}
+		for i, msg := range decoded[1:] {
+			if msg.Offset != int64(10+i) || string(msg.Body) != string(msgs[i].Body) || msg.Timestamp != msgs[i].Timestamp ||
+				!headersEqual(msg.Headers, msgs[i].Headers) {
+				t.Fatalf("record %d compressed with %s is %v", i, codec, msg)
+			}
+		}
+	}
+}
+
+func TestInvalidBatch(t *testing.T) {
+	if _, err := CompressMessages(CodecGzip, []*Message{{Offset: 0}, {Offset: 2}}); errors.Cause(err) != ErrInvalidBatch {
+		t.Fatalf("compress non contiguous offsets error is %v", err)
+	}
+	//inner offsets 0 and 1<<40 are rejected instead of taking 1<<40 offsets
+	for _, offsets := range [][]int64{{0, 1 << 40}, {0, 2}, {1, 2}, {0, 0}} {
+		records := make([]byte, 0)
+		for _, offset := range offsets {
+			records = AppendRecord(records, &Message{Offset: offset, Body: []byte("v")})
+		}
+		body, err := Compress(CodecGzip, records)
+		if err != nil {
+			t.Fatalf("compress error : %v", err)
+		}
+		batch := &Message{Offset: 10, Attributes: int8(CodecGzip), Body: body}
+		if _, err := batch.InnerMessages(); errors.Cause(err) != ErrInvalidBatch {
+			t.Fatalf("inner messages of offsets %v error is %v", offsets, err)
+		}
+	}
+	if err := (&Message{Offset: 1 << 40, Attributes: int8(CodecGzip)}).CountFromHeader(); errors.Cause(err) != ErrInvalidBatch {
+		t.Fatalf("count from header error is %v", err)
+	}
+
+	batches, err := CompressRuns(CodecSnappy, []*Message{{Offset: 3}, {Offset: 4}, {Offset: 7}})
+	if err != nil || len(batches) != 2 || batches[0].Offset != 4 || batches[0].Count != 2 || batches[1].Offset != 7 || batches[1].Count != 1 {
+		t.Fatalf("compress runs %v error %v", batches, err)
+	}
+	inners, err := batches[0].InnerMessages()
+	if err != nil || len(inners) != 2 || inners[0].Offset != 3 || inners[1].Offset != 4 {
+		t.Fatalf("inner messages of run %v error %v", inners, err)
+	}
+}
@@ -106,6 +106,19 @@ func (m *Metadata) FindTopicAllPartitions(topic string) map[string]TopicMetadata
 	return nodeTopic
 }
 
+//FindTopicPartitionNodes returns the leader node of each partition of topic, a node may lead several of them
+func (m *Metadata) FindTopicPartitionNodes(topic string) map[int]string {
+	partitionNodes := make(map[int]string)
+	m.TopicNodeMap.Range(func(tmi, node interface{}) bool {
+		tm := tmi.(TopicMetadata)
+		if tm.Topic == topic && !tm.IsReplica {
+			partitionNodes[tm.PartitionID] = node.(string)
+		}
+		return true
+	})
+	return partitionNodes
+}
+
 func (m *Metadata) FindPatitionID(topic, nodeIP string, isReplica bool) (parititionID int) {
 	m.TopicNodeMap.Range(func(tm, node interface{}) bool {
 		if tm.(TopicMetadata).Topic == topic && node.(string) == nodeIP && isReplica == tm.(TopicMetadata).IsReplica {
@@ -150,3 +163,18 @@ type TopicMetadata struct {
 	IsReplica      bool   `json:"is_replica"`
 	ReplicaFactory int    `json:"replica_factory"`
 }
+
+//NodeHeartbeat is the body of the heartbeat a yith node sends to zero
+type NodeHeartbeat struct {
+	LogDirs           []LogDirUsage   `json:"log_dirs"`
+	OfflinePartitions []TopicMetadata `json:"offline_partitions"`
+}
+
+type LogDirUsage struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	Partitions int    `json:"partitions"`
+	Offline    bool   `json:"offline"`
+	Error      string `json:"error,omitempty"`
+}
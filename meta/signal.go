@@ -11,6 +11,11 @@ const (
 	TopicPartitionDeleteChange
 	FetchMetadata
 	Pickup
+	InitProducerID
+	BeginTxn
+	AddPartitionsToTxn
+	EndTxn
+	WriteTxnMarkers
 )
 
 var (
@@ -22,6 +27,11 @@ var (
 	TopicPartitionDeleteChangeStr = "topic-partition-delete-change"
 	FetchMetadataStr              = "fetch-metadata"
 	PickupStr                     = "pickup"
+	InitProducerIDStr             = "init-producer-id"
+	BeginTxnStr                   = "begin-txn"
+	AddPartitionsToTxnStr         = "add-partitions-to-txn"
+	EndTxnStr                     = "end-txn"
+	WriteTxnMarkersStr            = "write-txn-markers"
 )
 
 var SignalTypes = []string{
@@ -33,6 +43,11 @@ var SignalTypes = []string{
 	TopicPartitionDeleteChangeStr,
 	FetchMetadataStr,
 	PickupStr,
+	InitProducerIDStr,
+	BeginTxnStr,
+	AddPartitionsToTxnStr,
+	EndTxnStr,
+	WriteTxnMarkersStr,
 }
 
 func (st Signal) String() string {
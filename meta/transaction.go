@@ -0,0 +1,43 @@
+package meta
+
+import "time"
+
+//states of a transaction in zero
+const (
+	TxnOngoing       = "ongoing"
+	TxnPrepareCommit = "prepare_commit"
+	TxnPrepareAbort  = "prepare_abort"
+)
+
+type TxnPartition struct {
+	Topic       string `json:"topic"`
+	PartitionID int    `json:"partition_id"`
+	//the node the producer sends the partition to, zero writes the marker to the leader of the partition
+	//and falls back to it when it does not know the leader
+	Node string `json:"node,omitempty"`
+}
+
+//Transaction is a transaction of a producer kept by zero until its markers are written into all its partitions
+type Transaction struct {
+	ProducerID    int64          `json:"producer_id"`
+	TransactionID int64          `json:"transaction_id"`
+	Partitions    []TxnPartition `json:"partitions"`
+	State         string         `json:"state"`
+	Updated       time.Time      `json:"updated"`
+}
+
+//TxnRequest is the body of begin-txn, add-partitions-to-txn and end-txn of a producer
+type TxnRequest struct {
+	ProducerID    int64          `json:"producer_id"`
+	TransactionID int64          `json:"transaction_id"`
+	Partitions    []TxnPartition `json:"partitions,omitempty"`
+	Commit        bool           `json:"commit,omitempty"`
+}
+
+//TxnMarkers is the body of write-txn-markers from zero to the node leading Partitions
+type TxnMarkers struct {
+	ProducerID    int64          `json:"producer_id"`
+	TransactionID int64          `json:"transaction_id"`
+	Commit        bool           `json:"commit"`
+	Partitions    []TxnPartition `json:"partitions"`
+}
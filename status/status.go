@@ -1,3 +1,13 @@
 package status
 
 const MetaChanged = "meta changed"
+
+const OffsetOutOfRange = "offset out of range"
+
+const PartitionOffline = "partition offline"
+
+const OutOfOrderSequence = "out of order sequence"
+
+const InvalidTransaction = "invalid transaction"
+
+const TransactionFenced = "transaction fenced"
@@ -0,0 +1,158 @@
+package yith
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"yithQ/yith/conf"
+	"yithQ/yith/queue"
+)
+
+var RestoreNotDurable error = errors.New("can not restore a topic whose storage engine is not durable")
+
+//TopicSnapshot holds the snapshots of the leader partitions of a topic on this node, taken one after another
+//before any of them is written, so a backup stays consistent with the writes going on
+type TopicSnapshot struct {
+	Manifest     *queue.BackupManifest
+	topicConf    *conf.TopicConf
+	partitionIDs []int
+	snapshots    []*queue.PartitionSnapshot
+}
+
+func (n *Node) SnapshotTopic(topic string) (*TopicSnapshot, error) {
+	partitions := make([]*Partition, 0)
+	n.topicPartition.Range(func(tpi, partitionI interface{}) bool {
+		partition := partitionI.(*Partition)
+		//the replicas hold the same records as their leader
+		if partition.topicName == topic && !partition.isRepplica {
+			partitions = append(partitions, partition)
+		}
+		return true
+	})
+	if len(partitions) == 0 {
+		return nil, TopicNotExist
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].id < partitions[j].id
+	})
+	ts := &TopicSnapshot{
+		Manifest: &queue.BackupManifest{
+			Version:   queue.BackupVersion,
+			Topic:     topic,
+			CreatedAt: time.Now(),
+		},
+		topicConf: n.cfg.TopicConfig(topic),
+	}
+	for _, partition := range partitions {
+		snapshot, err := partition.Snapshot()
+		if err != nil {
+			n.checkStorageError(partition, err)
+			ts.Close()
+			return nil, err
+		}
+		ts.partitionIDs = append(ts.partitionIDs, partition.id)
+		ts.snapshots = append(ts.snapshots, snapshot)
+		ts.Manifest.Partitions = append(ts.Manifest.Partitions, queue.NewBackupPartition(partition.id, snapshot))
+	}
+	return ts, nil
+}
+
+//WriteArchive writes the backup archive, see queue.BackupWriter
+func (ts *TopicSnapshot) WriteArchive(w io.Writer) error {
+	bw, err := queue.NewBackupWriter(w, ts.Manifest, ts.topicConf)
+	if err != nil {
+		return err
+	}
+	for i, snapshot := range ts.snapshots {
+		if err := bw.WriteSnapshot(ts.partitionIDs[i], snapshot); err != nil {
+			return err
+		}
+	}
+	return bw.Close()
+}
+
+func (ts *TopicSnapshot) Close() error {
+	var err error
+	for _, snapshot := range ts.snapshots {
+		if closeErr := snapshot.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+//RestoreTopic recreates the partitions of a backup archive on this node with their offsets,
+//none of them may exist here. The files are staged next to each partition dir until the archive is read in full
+func (n *Node) RestoreTopic(r io.Reader) (*queue.BackupManifest, error) {
+	br, err := queue.NewBackupReader(r)
+	if err != nil {
+		return nil, err
+	}
+	topic := br.Manifest.Topic
+	engine, err := queue.NewStorageEngine(n.cfg.TopicConfig(topic).StorageEngine)
+	if err != nil {
+		return nil, err
+	}
+	if !engine.Durable() {
+		return nil, errors.Wrap(RestoreNotDurable, topic)
+	}
+	dataDirs := make(map[int]string)
+	defer func() {
+		for partitionID, dataDir := range dataDirs {
+			os.RemoveAll(queue.RestoreDir(dataDir, topic, partitionID))
+		}
+	}()
+	for _, bp := range br.Manifest.Partitions {
+		if n.ExistTopicPartition(topic, bp.PartitionID) {
+			return nil, errors.Wrapf(queue.ErrPartitionExists, "%s-%d", topic, bp.PartitionID)
+		}
+		dataDir, err := n.logDirs.Select(topic, bp.PartitionID)
+		if err != nil {
+			return nil, err
+		}
+		stagingDir := queue.RestoreDir(dataDir, topic, bp.PartitionID)
+		if err := os.RemoveAll(stagingDir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(stagingDir, 0755); err != nil {
+			return nil, err
+		}
+		dataDirs[bp.PartitionID] = dataDir
+	}
+	for {
+		f, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := writeRestoreFile(filepath.Join(queue.RestoreDir(dataDirs[f.PartitionID], topic, f.PartitionID), f.Name), f); err != nil {
+			return nil, err
+		}
+	}
+	for _, bp := range br.Manifest.Partitions {
+		if err := queue.RestorePartition(dataDirs[bp.PartitionID], topic, bp); err != nil {
+			return nil, err
+		}
+		if err := n.AddTopicPartition(topic, bp.PartitionID, false); err != nil {
+			return nil, err
+		}
+	}
+	return br.Manifest, nil
+}
+
+func writeRestoreFile(name string, bf *queue.BackupFile) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, bf.Reader, bf.Size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,84 @@
+package yith
+
+import (
+	"time"
+	. "yithQ/util/logger"
+)
+
+const defaultRetentionCheckInterval = 5 * time.Minute
+
+//Cleaner uploads the sealed segments of tiered topics to remote storage, deletes the sealed segments
+//of every partition once they are out of retention, and compacts the partitions of compacted topics
+type Cleaner struct {
+	node     *Node
+	interval time.Duration
+}
+
+func NewCleaner(node *Node, checkInterval string) (*Cleaner, error) {
+	interval := defaultRetentionCheckInterval
+	if checkInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(checkInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cleaner{
+		node:     node,
+		interval: interval,
+	}, nil
+}
+
+func (c *Cleaner) Run() {
+	ticker := time.NewTicker(c.interval)
+	for {
+		select {
+		case <-ticker.C:
+			c.clean()
+		}
+	}
+}
+
+func (c *Cleaner) clean() {
+	c.node.topicPartition.Range(func(tpi, partitionI interface{}) bool {
+		tp := tpi.(TopicPartitionInfo)
+		partition := partitionI.(*Partition)
+		//upload before retention, local copies are only deleted once uploaded
+		uploaded, err := partition.Offload()
+		if err != nil {
+			c.node.checkStorageError(partition, err)
+			Lg.Errorf("upload segments of topic(%s) partition(%d) error : %v", tp.Topic, tp.PartitionID, err)
+		}
+		if uploaded != 0 {
+			Lg.Infof("upload %d segments of topic(%s) partition(%d) to remote storage", uploaded, tp.Topic, tp.PartitionID)
+		}
+		deleted, err := partition.DeleteExpiredSegments()
+		if err != nil {
+			c.node.checkStorageError(partition, err)
+			Lg.Errorf("delete expired segments of topic(%s) partition(%d) error : %v", tp.Topic, tp.PartitionID, err)
+		}
+		if deleted != 0 {
+			Lg.Infof("delete %d expired segments of topic(%s) partition(%d)", deleted, tp.Topic, tp.PartitionID)
+		}
+		removed, err := partition.Compact()
+		if err != nil {
+			c.node.checkStorageError(partition, err)
+			Lg.Errorf("compact topic(%s) partition(%d) error : %v", tp.Topic, tp.PartitionID, err)
+		}
+		if removed != 0 {
+			Lg.Infof("compact topic(%s) partition(%d) remove %d records", tp.Topic, tp.PartitionID, removed)
+		}
+		if expired := partition.ExpireProducers(); expired != 0 {
+			Lg.Infof("topic(%s) partition(%d) forget %d idempotent producers", tp.Topic, tp.PartitionID, expired)
+		}
+		dropped, err := partition.CleanTransactions()
+		if err != nil {
+			c.node.checkStorageError(partition, err)
+			Lg.Errorf("clean transactions of topic(%s) partition(%d) error : %v", tp.Topic, tp.PartitionID, err)
+		}
+		if dropped != 0 {
+			Lg.Infof("topic(%s) partition(%d) forget %d aborted ranges before the log start", tp.Topic, tp.PartitionID, dropped)
+		}
+		return true
+	})
+}
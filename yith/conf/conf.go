@@ -3,6 +3,7 @@ package conf
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"strings"
 )
 
 type Config struct {
@@ -11,6 +12,8 @@ type Config struct {
 	ReplicaTcpPort string `yaml:"replica_tcp_port"`
 	ProducerPort   string `yaml:"producer_port"`
 	ConsumerPort   string `yaml:"consumer_port"`
+	//operator endpoints, ep: delete-records, not served if empty
+	AdminPort string `yaml:"admin_port"`
 
 	ReplicaFactory int `yaml:"replica_factory"`
 
@@ -19,8 +22,100 @@ type Config struct {
 	HeartbeatInterval string `yaml:"heartbeat_interval"`
 
 	LoggerLevel string `yaml:"logger_level"`
+
+	//partitions are stored in <data dir>/<topic>/<partition id>/
+	DataDirs []string `yaml:"data_dirs"`
+
+	//object store the sealed segments of topics with remote.storage.enable are uploaded to
+	RemoteStorage *RemoteStorageConf `yaml:"remote_storage"`
+
+	//keys the segments of topics with encryption.enable are encrypted with
+	Encryption *EncryptionConf `yaml:"encryption"`
+
+	//how often the cleaner applies retention to the partitions, ep: 5m
+	RetentionCheckInterval string `yaml:"retention_check_interval"`
+
+	//TopicDefaults apply to every topic, Topics override them for a single topic
+	TopicDefaults *TopicConf            `yaml:"topic_defaults"`
+	Topics        map[string]*TopicConf `yaml:"topics"`
 }
 
+//TopicConf holds per-topic settings, a zero value means not set
+type TopicConf struct {
+	//segments older than retention.ms are deleted, <=0 means never
+	RetentionMs int64 `yaml:"retention.ms"`
+	//segments are deleted while the partition is larger than retention.bytes, <=0 means no limit
+	RetentionBytes int64 `yaml:"retention.bytes"`
+	//delete, compact or compact,delete
+	CleanupPolicy string `yaml:"cleanup.policy"`
+	//tombstones of a compacted topic are kept delete.retention.ms after their segment was sealed
+	DeleteRetentionMs int64 `yaml:"delete.retention.ms"`
+
+	//batch: fsync every produce batch before ack, messages: every flush.messages messages,
+	//time: every flush.ms milliseconds, os: leave it to the os
+	FlushPolicy   string `yaml:"flush.policy"`
+	FlushMessages int64  `yaml:"flush.messages"`
+	FlushMs       int64  `yaml:"flush.ms"`
+
+	//producer keeps the codec of the producer, otherwise uncompressed, gzip, snappy, lz4 or zstd
+	CompressionType string `yaml:"compression.type"`
+
+	//upload sealed segments to remote_storage, retention.* then applies to the whole log
+	//and local.retention.* to the copies of the uploaded segments kept on local disk
+	RemoteStorageEnable *bool `yaml:"remote.storage.enable"`
+	//not set means the same as retention.*, <=0 means never
+	LocalRetentionMs    int64 `yaml:"local.retention.ms"`
+	LocalRetentionBytes int64 `yaml:"local.retention.bytes"`
+
+	//segment keeps the partitions in segment files, memory keeps them in memory only and loses them on restart
+	StorageEngine string `yaml:"storage.engine"`
+
+	//encrypt the new segments with the current key of encryption, the encrypted ones stay readable once it is off
+	EncryptionEnable *bool `yaml:"encryption.enable"`
+
+	//a segment is rolled once it holds segment.bytes or its records are segment.ms old, whichever comes first.
+	//segment.bytes is at most 1GiB, segment.ms <=0 means never
+	SegmentBytes int64 `yaml:"segment.bytes"`
+	SegmentMs    int64 `yaml:"segment.ms"`
+	//reserve the blocks of the .data and .index of a new segment with fallocate
+	SegmentPreallocate *bool `yaml:"segment.preallocate"`
+}
+
+type RemoteStorageConf struct {
+	//local is the only type for now, a dir that may be a mounted network disk
+	Type string `yaml:"type"`
+	Dir  string `yaml:"dir"`
+}
+
+const RemoteStorageLocal = "local"
+
+type EncryptionConf struct {
+	//keyfile is the only type for now, see queue.KeyFile
+	Type    string `yaml:"type"`
+	KeyFile string `yaml:"key_file"`
+}
+
+const EncryptionKeyFile = "keyfile"
+
+const (
+	CleanupPolicyDelete  = "delete"
+	CleanupPolicyCompact = "compact"
+)
+
+const CompressionTypeProducer = "producer"
+
+const (
+	StorageEngineSegment = "segment"
+	StorageEngineMemory  = "memory"
+)
+
+const (
+	FlushPolicyBatch    = "batch"
+	FlushPolicyMessages = "messages"
+	FlushPolicyTime     = "time"
+	FlushPolicyOS       = "os"
+)
+
 type QueueConf struct {
 	MemoryQueueConf *MemoryQueueConf `yaml:"memory_queue_conf"`
 }
@@ -29,6 +124,110 @@ type MemoryQueueConf struct {
 	RingBufferCapacity int64 `yaml:"ring_buffer_capacity"`
 }
 
+//TopicConfig returns the settings of topic merged with the defaults
+func (c *Config) TopicConfig(topic string) *TopicConf {
+	tc := &TopicConf{}
+	if t, ok := c.Topics[topic]; ok && t != nil {
+		*tc = *t
+	}
+	if c.TopicDefaults != nil {
+		tc.merge(c.TopicDefaults)
+	}
+	return tc
+}
+
+func (tc *TopicConf) merge(defaults *TopicConf) {
+	if tc.RetentionMs == 0 {
+		tc.RetentionMs = defaults.RetentionMs
+	}
+	if tc.RetentionBytes == 0 {
+		tc.RetentionBytes = defaults.RetentionBytes
+	}
+	if tc.CleanupPolicy == "" {
+		tc.CleanupPolicy = defaults.CleanupPolicy
+	}
+	if tc.DeleteRetentionMs == 0 {
+		tc.DeleteRetentionMs = defaults.DeleteRetentionMs
+	}
+	if tc.FlushPolicy == "" {
+		tc.FlushPolicy = defaults.FlushPolicy
+	}
+	if tc.FlushMessages == 0 {
+		tc.FlushMessages = defaults.FlushMessages
+	}
+	if tc.FlushMs == 0 {
+		tc.FlushMs = defaults.FlushMs
+	}
+	if tc.CompressionType == "" {
+		tc.CompressionType = defaults.CompressionType
+	}
+	if tc.RemoteStorageEnable == nil {
+		tc.RemoteStorageEnable = defaults.RemoteStorageEnable
+	}
+	if tc.LocalRetentionMs == 0 {
+		tc.LocalRetentionMs = defaults.LocalRetentionMs
+	}
+	if tc.LocalRetentionBytes == 0 {
+		tc.LocalRetentionBytes = defaults.LocalRetentionBytes
+	}
+	if tc.StorageEngine == "" {
+		tc.StorageEngine = defaults.StorageEngine
+	}
+	if tc.EncryptionEnable == nil {
+		tc.EncryptionEnable = defaults.EncryptionEnable
+	}
+	if tc.SegmentBytes == 0 {
+		tc.SegmentBytes = defaults.SegmentBytes
+	}
+	if tc.SegmentMs == 0 {
+		tc.SegmentMs = defaults.SegmentMs
+	}
+	if tc.SegmentPreallocate == nil {
+		tc.SegmentPreallocate = defaults.SegmentPreallocate
+	}
+}
+
+//DeleteEnabled is true if old segments are deleted by retention, it is the default cleanup policy
+func (tc *TopicConf) DeleteEnabled() bool {
+	return tc.CleanupPolicy == "" || strings.Contains(tc.CleanupPolicy, CleanupPolicyDelete)
+}
+
+func (tc *TopicConf) CompactEnabled() bool {
+	return strings.Contains(tc.CleanupPolicy, CleanupPolicyCompact)
+}
+
+func (tc *TopicConf) RemoteStorageEnabled() bool {
+	return tc.RemoteStorageEnable != nil && *tc.RemoteStorageEnable
+}
+
+func (tc *TopicConf) EncryptionEnabled() bool {
+	return tc.EncryptionEnable != nil && *tc.EncryptionEnable
+}
+
+func (tc *TopicConf) SegmentPreallocateEnabled() bool {
+	return tc.SegmentPreallocate != nil && *tc.SegmentPreallocate
+}
+
+//LocalRetention returns local.retention.ms and local.retention.bytes, retention.* for the ones not set
+func (tc *TopicConf) LocalRetention() (int64, int64) {
+	ms, bytes := tc.LocalRetentionMs, tc.LocalRetentionBytes
+	if ms == 0 {
+		ms = tc.RetentionMs
+	}
+	if bytes == 0 {
+		bytes = tc.RetentionBytes
+	}
+	return ms, bytes
+}
+
+//GetDataDirs returns ./data if data_dirs is not set
+func (c *Config) GetDataDirs() []string {
+	if len(c.DataDirs) == 0 {
+		return []string{"./data"}
+	}
+	return c.DataDirs
+}
+
 func InitConfig() *Config {
 	data, err := ioutil.ReadFile("./yith.yml")
 	if err != nil {
@@ -0,0 +1,342 @@
+package yith
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+	"yithQ/message"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
+	"yithQ/yith/queue"
+)
+
+//delayed messages of a partition: a batch produced with a deliverAt in the future is written to the delay log of the
+//partition, <partition dir>/delayed/<topic>/<partition id>/, and its offset is put on a timing wheel. Once due it is read back from the
+//delay log, produced to the partition and a release record of its offset is written to the delay log, which is trimmed
+//up to the oldest batch not released.
+//On open the delay log is read again and the batches without a release record go back on the wheel, so a batch
+//released right before a crash may be delivered twice. The delay log is kept by the leader only
+const (
+	delayedDirName  = "delayed"
+	deliverAtHeader = "yith-deliver-at"
+	releasedHeader  = "yith-released"
+
+	delayTick      = 100 * time.Millisecond
+	delayWheelSize = 512
+	//a batch failing to be released is retried after it, ep: the partition is offline
+	delayRetryBackoff = time.Second
+	//records read at a time when the delay log is loaded
+	delayLoadAmount = 256
+)
+
+var InvalidDelayRecord error = errors.New("invalid delay record")
+
+//delayedBatch is a batch not released, its messages are kept in the delay log only
+type delayedBatch struct {
+	//offset of the batch in the delay log
+	offset    int64
+	deliverAt int64
+}
+
+//timingWheel hashes the batches into slots by the tick they are due, a slot is checked once a rotation
+//and keeps the batches due in a later rotation
+type timingWheel struct {
+	tick  time.Duration
+	slots [][]*delayedBatch
+	//the last tick advanced to
+	lastTick int64
+}
+
+func newTimingWheel(tick time.Duration, size int, now time.Time) *timingWheel {
+	return &timingWheel{
+		tick:     tick,
+		slots:    make([][]*delayedBatch, size),
+		lastTick: now.UnixNano() / int64(tick),
+	}
+}
+
+//add puts batch in the slot of the first tick at or after both its deliverAt and notBefore,
+//a batch due already goes to the next tick
+func (tw *timingWheel) add(batch *delayedBatch, notBefore int64) {
+	at := batch.deliverAt
+	if notBefore > at {
+		at = notBefore
+	}
+	tick := (at + int64(tw.tick) - 1) / int64(tw.tick)
+	if tick <= tw.lastTick {
+		tick = tw.lastTick + 1
+	}
+	slot := tick % int64(len(tw.slots))
+	tw.slots[slot] = append(tw.slots[slot], batch)
+}
+
+//advance moves to the tick of now and returns the batches due in the order of their deliverAt
+func (tw *timingWheel) advance(now time.Time) []*delayedBatch {
+	nowNano := now.UnixNano()
+	nowTick := nowNano / int64(tw.tick)
+	ticks := nowTick - tw.lastTick
+	if ticks > int64(len(tw.slots)) {
+		ticks = int64(len(tw.slots))
+	}
+	due := make([]*delayedBatch, 0)
+	for tick := nowTick - ticks + 1; tick <= nowTick; tick++ {
+		slot := tick % int64(len(tw.slots))
+		kept := tw.slots[slot][:0]
+		for _, batch := range tw.slots[slot] {
+			if batch.deliverAt <= nowNano {
+				due = append(due, batch)
+			} else {
+				kept = append(kept, batch)
+			}
+		}
+		tw.slots[slot] = kept
+	}
+	if nowTick > tw.lastTick {
+		tw.lastTick = nowTick
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].deliverAt != due[j].deliverAt {
+			return due[i].deliverAt < due[j].deliverAt
+		}
+		return due[i].offset < due[j].offset
+	})
+	return due
+}
+
+type delayedMessages struct {
+	//ep: topic(yith) partition(1), for the logs
+	name string
+	//guards pending and wheel, it is not held while a batch is released
+	lock sync.Mutex
+	log  queue.DiskQueue
+	//the batches not released by their offset in the delay log
+	pending map[int64]*delayedBatch
+	wheel   *timingWheel
+	release func([]*message.Message) (int64, error)
+	closing chan struct{}
+	done    chan struct{}
+}
+
+//openDelayedMessages loads the batches not released from log and releases them with release once due,
+//the caller closes log on error
+func openDelayedMessages(name string, log queue.DiskQueue, release func([]*message.Message) (int64, error)) (*delayedMessages, error) {
+	d := &delayedMessages{
+		name:    name,
+		log:     log,
+		pending: make(map[int64]*delayedBatch),
+		wheel:   newTimingWheel(delayTick, delayWheelSize, time.Now()),
+		release: release,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	for _, batch := range d.pending {
+		d.wheel.add(batch, 0)
+	}
+	go d.run()
+	return d, nil
+}
+
+//delayLogConfig is the config of the topic without retention, the delay log is trimmed as its batches are released
+func delayLogConfig(tc *conf.TopicConf) *conf.TopicConf {
+	delayConf := *tc
+	delayConf.RetentionMs = -1
+	delayConf.RetentionBytes = -1
+	delayConf.CleanupPolicy = conf.CleanupPolicyDelete
+	delayConf.CompressionType = conf.CompressionTypeProducer
+	delayConf.RemoteStorageEnable = nil
+	return &delayConf
+}
+
+func (d *delayedMessages) load() error {
+	for offset := d.log.LogStartOffset(); offset <= d.log.LastOffset(); {
+		records, err := d.log.PopFromDisk(offset, delayLoadAmount)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		_, err = records.WriteTo(&buf)
+		records.Close()
+		if err != nil {
+			return err
+		}
+		msgs, err := message.DecodeRecords(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for _, msg := range msgs {
+			if err := d.apply(msg); err != nil {
+				return errors.Wrapf(err, "%s delay log offset %d", d.name, msg.Offset)
+			}
+			offset = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (d *delayedMessages) apply(record *message.Message) error {
+	if released := record.Header(releasedHeader); released != nil {
+		if len(released) != 8 {
+			return InvalidDelayRecord
+		}
+		delete(d.pending, int64(binary.BigEndian.Uint64(released)))
+		return nil
+	}
+	deliverAt := record.Header(deliverAtHeader)
+	if len(deliverAt) != 8 {
+		return InvalidDelayRecord
+	}
+	d.pending[record.Offset] = &delayedBatch{
+		offset:    record.Offset,
+		deliverAt: int64(binary.BigEndian.Uint64(deliverAt)),
+	}
+	return nil
+}
+
+//read returns the messages of the batch at offset of the delay log
+func (d *delayedMessages) read(offset int64) ([]*message.Message, error) {
+	records, err := d.log.PopFromDisk(offset, 1)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = records.WriteTo(&buf)
+	records.Close()
+	if err != nil {
+		return nil, err
+	}
+	batches, err := message.DecodeRecords(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range batches {
+		if record.Offset != offset {
+			continue
+		}
+		msgs := make([]*message.Message, 0)
+		for body := record.Body; len(body) > 0; {
+			msg, n, err := message.DecodeRecord(body)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+			body = body[n:]
+		}
+		return msgs, nil
+	}
+	return nil, errors.Wrapf(InvalidDelayRecord, "offset %d not found", offset)
+}
+
+//add writes msgs to the delay log, they are released at deliverAt
+func (d *delayedMessages) add(deliverAt int64, msgs []*message.Message) error {
+	body := make([]byte, 0)
+	for _, msg := range msgs {
+		body = message.AppendRecord(body, msg)
+	}
+	record := &message.Message{
+		Headers:   []message.Header{{Key: deliverAtHeader, Value: int64Bytes(deliverAt)}},
+		Body:      body,
+		Timestamp: time.Now().UnixNano(),
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	offset, _, err := d.log.FillToDisk([]*message.Message{record})
+	if err != nil {
+		return err
+	}
+	batch := &delayedBatch{offset: offset, deliverAt: deliverAt}
+	d.pending[offset] = batch
+	d.wheel.add(batch, 0)
+	return nil
+}
+
+func (d *delayedMessages) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.wheel.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case now := <-ticker.C:
+			d.releaseDue(now)
+		}
+	}
+}
+
+//releaseDue produces the batches due in order, the ones after a failure are retried after delayRetryBackoff.
+//Only run calls it, so the batches due are not trimmed from the delay log while they are read without lock
+func (d *delayedMessages) releaseDue(now time.Time) {
+	d.lock.Lock()
+	due := d.wheel.advance(now)
+	d.lock.Unlock()
+	released := make([]*message.Message, 0, len(due))
+	for i, batch := range due {
+		msgs, err := d.read(batch.offset)
+		if err == nil {
+			_, err = d.release(msgs)
+		}
+		if err != nil {
+			Lg.Errorf("%s release delayed batch %d error : %v", d.name, batch.offset, err)
+			d.lock.Lock()
+			for _, retried := range due[i:] {
+				d.wheel.add(retried, now.Add(delayRetryBackoff).UnixNano())
+			}
+			d.lock.Unlock()
+			break
+		}
+		released = append(released, &message.Message{
+			Headers:   []message.Header{{Key: releasedHeader, Value: int64Bytes(batch.offset)}},
+			Timestamp: now.UnixNano(),
+		})
+	}
+	if len(released) == 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, batch := range due[:len(released)] {
+		delete(d.pending, batch.offset)
+	}
+	if _, _, err := d.log.FillToDisk(released); err != nil {
+		Lg.Errorf("%s write %d release records error : %v, they are released again after a restart", d.name, len(released), err)
+		return
+	}
+	d.trim()
+}
+
+//trim deletes the delay log before the oldest batch not released, the caller holds lock
+func (d *delayedMessages) trim() {
+	start := d.log.LastOffset() + 1
+	for offset := range d.pending {
+		if offset < start {
+			start = offset
+		}
+	}
+	if start <= d.log.LogStartOffset() {
+		return
+	}
+	if _, err := d.log.DeleteRecords(start); err != nil {
+		Lg.Errorf("%s trim delay log before %d error : %v", d.name, start, err)
+	}
+}
+
+func (d *delayedMessages) close() error {
+	close(d.closing)
+	<-d.done
+	return d.log.Close()
+}
+
+func int64Bytes(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
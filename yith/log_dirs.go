@@ -0,0 +1,123 @@
+package yith
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+	"syscall"
+	"yithQ/meta"
+	. "yithQ/util/logger"
+	"yithQ/yith/queue"
+)
+
+var NoOnlineLogDir error = errors.New("no online log dir")
+
+//LogDirs places partitions on the data dirs and keeps the dirs that failed offline
+type LogDirs struct {
+	dirs    []string
+	offline *sync.Map //map[string]error
+}
+
+func NewLogDirs(dirs []string) *LogDirs {
+	return &LogDirs{
+		dirs:    dirs,
+		offline: &sync.Map{},
+	}
+}
+
+//Select returns the dir already holding the partition, otherwise the online dir with the most free space
+func (l *LogDirs) Select(topic string, partitionID int) (string, error) {
+	if dir := queue.FindDataDir(l.dirs, topic, partitionID); dir != "" {
+		return dir, nil
+	}
+	var selected string
+	var maxFree uint64
+	for _, dir := range l.dirs {
+		if l.IsOffline(dir) {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			Lg.Warnf("log dir(%s) is not usable for new partitions : %v", dir, err)
+			continue
+		}
+		_, free, err := diskUsage(dir)
+		if err != nil {
+			Lg.Warnf("log dir(%s) is not usable for new partitions : %v", dir, err)
+			continue
+		}
+		if selected == "" || free > maxFree {
+			selected, maxFree = dir, free
+		}
+	}
+	if selected == "" {
+		return "", NoOnlineLogDir
+	}
+	return selected, nil
+}
+
+//MarkOffline returns false if dir is offline already
+func (l *LogDirs) MarkOffline(dir string, err error) bool {
+	_, loaded := l.offline.LoadOrStore(dir, err)
+	return !loaded
+}
+
+func (l *LogDirs) IsOffline(dir string) bool {
+	_, ok := l.offline.Load(dir)
+	return ok
+}
+
+//Usage statfs every online dir, Error is set for a dir that failed or can not be stat
+func (l *LogDirs) Usage() []meta.LogDirUsage {
+	usages := make([]meta.LogDirUsage, 0, len(l.dirs))
+	for _, dir := range l.dirs {
+		usage := meta.LogDirUsage{Path: dir}
+		if errI, ok := l.offline.Load(dir); ok {
+			usage.Offline = true
+			usage.Error = errI.(error).Error()
+		} else {
+			total, free, err := diskUsage(dir)
+			//a dir without partitions yet may not exist
+			if err != nil && !os.IsNotExist(err) {
+				usage.Error = err.Error()
+			}
+			usage.TotalBytes, usage.FreeBytes = total, free
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+func diskUsage(dir string) (total uint64, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
+
+//mediaErrors are the errnos of a failing or full disk, the other io errors, ep: ENOENT of a segment deleted by
+//retention while it is read, are errors of the request and leave the log dir online
+var mediaErrors = []syscall.Errno{
+	syscall.EIO,
+	syscall.EROFS,
+	syscall.ENOSPC,
+	syscall.EDQUOT,
+	syscall.ENXIO,
+	syscall.ENODEV,
+	//EFSCORRUPTED of ext4 and xfs
+	syscall.EUCLEAN,
+}
+
+//isStorageError tells an error of the disk itself apart from the other errors, the log dir is taken offline for it
+func isStorageError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, mediaErr := range mediaErrors {
+		if errno == mediaErr {
+			return true
+		}
+	}
+	return false
+}
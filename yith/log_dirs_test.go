@@ -0,0 +1,95 @@
+package yith
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+	"yithQ/yith/queue"
+)
+
+func TestLogDirsSelect(t *testing.T) {
+	dirs := []string{filepath.Join(t.TempDir(), "data"), t.TempDir()}
+	logDirs := NewLogDirs(dirs)
+	dir, err := logDirs.Select("orders", 0)
+	if err != nil || (dir != dirs[0] && dir != dirs[1]) {
+		t.Fatalf("select dir %s error %v", dir, err)
+	}
+	//a partition stays on the dir holding it, offline or not
+	diskQ, err := queue.NewDiskQueue(dirs[1], "orders", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	diskQ.Close()
+	logDirs.MarkOffline(dirs[1], errors.New("disk failed"))
+	if dir, err := logDirs.Select("orders", 1); err != nil || dir != dirs[1] {
+		t.Fatalf("select dir of an existing partition %s error %v", dir, err)
+	}
+	if dir, err := logDirs.Select("orders", 2); err != nil || dir != dirs[0] {
+		t.Fatalf("select dir of a new partition %s error %v", dir, err)
+	}
+	logDirs.MarkOffline(dirs[0], errors.New("disk failed"))
+	if _, err := logDirs.Select("orders", 2); err != NoOnlineLogDir {
+		t.Fatalf("select dir with all dirs offline error is %v", err)
+	}
+	if usages := logDirs.Usage(); len(usages) != 2 || !usages[0].Offline || !usages[1].Offline {
+		t.Fatalf("usage %+v", usages)
+	}
+}
+
+func TestIsStorageError(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		storage bool
+	}{
+		{&os.PathError{Op: "write", Path: "segment_1.data", Err: syscall.EIO}, true},
+		{errors.Wrap(&os.PathError{Op: "write", Path: "segment_1.data", Err: syscall.ENOSPC}, "fill"), true},
+		{&os.SyscallError{Syscall: "fsync", Err: syscall.EROFS}, true},
+		{&os.PathError{Op: "open", Path: "segment_1.data", Err: syscall.ENOENT}, false},
+		{errors.Wrap(os.ErrClosed, "read"), false},
+		{queue.ErrOffsetOutOfRange, false},
+		{nil, false},
+	} {
+		if storage := isStorageError(tc.err); storage != tc.storage {
+			t.Fatalf("isStorageError(%v) is %v", tc.err, storage)
+		}
+	}
+}
+
+func TestNodeStorageError(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	node := NewNode("127.0.0.1", &conf.Config{DataDirs: dirs}, nil, nil)
+	for partitionID := 0; partitionID < 2; partitionID++ {
+		//one partition a dir
+		diskQ, err := queue.NewDiskQueue(dirs[partitionID], "orders", partitionID, &conf.TopicConf{}, nil, nil)
+		if err != nil {
+			t.Fatalf("new disk queue error : %v", err)
+		}
+		diskQ.Close()
+		if err := node.AddTopicPartition("orders", partitionID, false); err != nil {
+			t.Fatalf("add topic partition error : %v", err)
+		}
+	}
+	partitionI, _ := node.topicPartition.Load(TopicPartitionInfo{Topic: "orders", PartitionID: 0})
+	partition := partitionI.(*Partition)
+	node.checkStorageError(partition, &os.PathError{Op: "open", Path: "segment_1.data", Err: syscall.ENOENT})
+	if partition.Offline() || node.logDirs.IsOffline(partition.dataDir) {
+		t.Fatalf("log dir(%s) is offline for ENOENT", partition.dataDir)
+	}
+	node.checkStorageError(partition, &os.PathError{Op: "write", Path: "segment_1.data", Err: syscall.EIO})
+	if !node.logDirs.IsOffline(partition.dataDir) {
+		t.Fatalf("log dir(%s) is online after EIO", partition.dataDir)
+	}
+	if _, err := node.ProduceTopicPartition("orders", 0, []*message.Message{{Body: []byte("a")}}); err != PartitionOffline {
+		t.Fatalf("produce to an offline partition error is %v", err)
+	}
+	//the partitions of the other log dir keep serving
+	if _, err := node.ProduceTopicPartition("orders", 1, []*message.Message{{Body: []byte("a")}}); err != nil {
+		t.Fatalf("produce to the partition of the other log dir error : %v", err)
+	}
+	node.DeleteTopicPartition("orders", 0)
+	node.DeleteTopicPartition("orders", 1)
+}
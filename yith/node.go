@@ -5,14 +5,22 @@ import (
 	"net/http"
 	"sync"
 	"yithQ/message"
+	"yithQ/meta"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
+	"yithQ/yith/queue"
 )
 
 var TopicNotExist error = errors.New("topic not exist")
 
 type Node struct {
 	IP                string
-	topicPartition    *sync.Map //map[TopicPartitionInfo]*Partition
-	partitionID2Topic *sync.Map //map[int]string
+	cfg               *conf.Config
+	logDirs           *LogDirs
+	objectStore       queue.ObjectStore //nil without remote storage
+	keys              queue.KeyProvider //nil without encryption
+	topicPartition    *sync.Map         //map[TopicPartitionInfo]*Partition
+	partitionID2Topic *sync.Map         //map[int]string
 }
 
 type TopicPartitionInfo struct {
@@ -20,31 +28,56 @@ type TopicPartitionInfo struct {
 	PartitionID int
 }
 
-func NewNode(ip string) *Node {
+func NewNode(ip string, cfg *conf.Config, objectStore queue.ObjectStore, keys queue.KeyProvider) *Node {
 	return &Node{
 		IP:                ip,
+		cfg:               cfg,
+		logDirs:           NewLogDirs(cfg.GetDataDirs()),
+		objectStore:       objectStore,
+		keys:              keys,
 		topicPartition:    &sync.Map{},
 		partitionID2Topic: &sync.Map{},
 	}
 }
 
 func (n *Node) AddTopicPartition(topic string, partitionID int, isReplica bool) error {
-	newPartition, err := NewPartition(partitionID, topic, isReplica)
+	engine, err := queue.NewStorageEngine(n.cfg.TopicConfig(topic).StorageEngine)
 	if err != nil {
 		return err
 	}
+	var dataDir string
+	if engine.Durable() {
+		if dataDir, err = n.logDirs.Select(topic, partitionID); err != nil {
+			return err
+		}
+	}
+	newPartition, err := NewPartition(partitionID, topic, isReplica, dataDir, n.cfg, engine, n.objectStore, n.keys)
+	if err != nil {
+		if !isStorageError(err) {
+			return err
+		}
+		//keep the partition offline, so it is not created again on another log dir
+		newPartition = &Partition{
+			id:         partitionID,
+			topicName:  topic,
+			dataDir:    dataDir,
+			offline:    1,
+			isRepplica: isReplica,
+		}
+		defer n.markLogDirOffline(dataDir, err)
+	}
 	n.topicPartition.Store(TopicPartitionInfo{
 		Topic:       topic,
 		PartitionID: partitionID,
 	}, newPartition)
 	n.partitionID2Topic.Store(partitionID, topic)
-	return nil
+	return err
 }
 
 func (n *Node) ProduceTopic(topic string, msgs []*message.Message) (err error) {
 	n.partitionID2Topic.Range(func(id, topicI interface{}) bool {
 		if topicI.(string) == topic {
-			err = n.ProduceTopicPartition(topic, id.(int), msgs)
+			_, err = n.ProduceTopicPartition(topic, id.(int), msgs)
 			return false
 		}
 		return true
@@ -52,12 +85,60 @@ func (n *Node) ProduceTopic(topic string, msgs []*message.Message) (err error) {
 	return
 }
 
-func (n *Node) ProduceTopicPartition(topic string, partitionID int, msgs []*message.Message) error {
-	partition, _ := n.topicPartition.Load(TopicPartitionInfo{
+//ProduceTopicPartition returns the base offset assigned to msgs
+func (n *Node) ProduceTopicPartition(topic string, partitionID int, msgs []*message.Message) (int64, error) {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	})
+	if !ok {
+		return 0, TopicNotExist
+	}
+	baseOffset, err := partition.(*Partition).Produce(msgs)
+	n.checkStorageError(partition.(*Partition), err)
+	return baseOffset, err
+}
+
+//ProduceIdempotent produces a batch of an idempotent producer, see Partition.ProduceIdempotent
+func (n *Node) ProduceIdempotent(topic string, partitionID int, producerID int64, sequence uint64, transactionID int64, msgs []*message.Message) (int64, error) {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
 		Topic:       topic,
 		PartitionID: partitionID,
 	})
-	return partition.(*Partition).Produce(msgs)
+	if !ok {
+		return 0, TopicNotExist
+	}
+	baseOffset, err := partition.(*Partition).ProduceIdempotent(producerID, sequence, transactionID, msgs)
+	n.checkStorageError(partition.(*Partition), err)
+	return baseOffset, err
+}
+
+//ProduceDelayed holds a batch until deliverAt, see Partition.ProduceDelayed
+func (n *Node) ProduceDelayed(topic string, partitionID int, producerID int64, sequence uint64, deliverAt int64, msgs []*message.Message) (int64, error) {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	})
+	if !ok {
+		return 0, TopicNotExist
+	}
+	baseOffset, err := partition.(*Partition).ProduceDelayed(producerID, sequence, deliverAt, msgs)
+	n.checkStorageError(partition.(*Partition), err)
+	return baseOffset, err
+}
+
+//WriteTxnMarker ends the transaction of producerID in the partition, see Partition.WriteTxnMarker
+func (n *Node) WriteTxnMarker(topic string, partitionID int, producerID, transactionID int64, commit bool) error {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	})
+	if !ok {
+		return TopicNotExist
+	}
+	err := partition.(*Partition).WriteTxnMarker(producerID, transactionID, commit)
+	n.checkStorageError(partition.(*Partition), err)
+	return err
 }
 
 func (n *Node) Consume(topic string, partitionID int, popOffset int64, amount int, writer http.ResponseWriter) error {
@@ -68,14 +149,63 @@ func (n *Node) Consume(topic string, partitionID int, popOffset int64, amount in
 	if !ok {
 		return TopicNotExist
 	}
-	return partition.(*Partition).Consume(popOffset, amount, writer)
+	err := partition.(*Partition).Consume(popOffset, amount, writer)
+	n.checkStorageError(partition.(*Partition), err)
+	return err
 }
 
-func (n *Node) DeleteTopicPartition(topic string, partitionID int) {
-	n.topicPartition.Delete(TopicPartitionInfo{
+//ConsumeCommitted serves a read_committed consumer, see Partition.ConsumeCommitted
+func (n *Node) ConsumeCommitted(topic string, partitionID int, popOffset int64, amount int, writer http.ResponseWriter) error {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
 		Topic:       topic,
 		PartitionID: partitionID,
 	})
+	if !ok {
+		return TopicNotExist
+	}
+	err := partition.(*Partition).ConsumeCommitted(popOffset, amount, writer)
+	n.checkStorageError(partition.(*Partition), err)
+	return err
+}
+
+func (n *Node) OffsetForTime(topic string, partitionID int, timestamp int64) (int64, error) {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	})
+	if !ok {
+		return 0, TopicNotExist
+	}
+	offset, err := partition.(*Partition).OffsetForTime(timestamp)
+	n.checkStorageError(partition.(*Partition), err)
+	return offset, err
+}
+
+//DeleteRecords moves the log start offset of the partition to beforeOffset and returns the new one
+func (n *Node) DeleteRecords(topic string, partitionID int, beforeOffset int64) (int64, error) {
+	partition, ok := n.topicPartition.Load(TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	})
+	if !ok {
+		return 0, TopicNotExist
+	}
+	logStartOffset, err := partition.(*Partition).DeleteRecords(beforeOffset)
+	n.checkStorageError(partition.(*Partition), err)
+	return logStartOffset, err
+}
+
+func (n *Node) DeleteTopicPartition(topic string, partitionID int) {
+	tp := TopicPartitionInfo{
+		Topic:       topic,
+		PartitionID: partitionID,
+	}
+	if partitionI, ok := n.topicPartition.Load(tp); ok {
+		if err := partitionI.(*Partition).Close(); err != nil {
+			Lg.Warnf("close partition(%s-%d) failed: %s", topic, partitionID, err.Error())
+		}
+	}
+	n.topicPartition.Delete(tp)
 	n.partitionID2Topic.Delete(partitionID)
 }
 
@@ -98,3 +228,70 @@ func (n *Node) ExistTopicPartition(topic string, partitionID int) bool {
 	})
 	return exist
 }
+
+//checkStorageError takes the log dir of the partition offline if err comes from the disk
+func (n *Node) checkStorageError(p *Partition, err error) {
+	if err != nil && isStorageError(err) {
+		n.markLogDirOffline(p.dataDir, err)
+	}
+}
+
+//markLogDirOffline takes every partition on dir offline, the other log dirs keep serving
+func (n *Node) markLogDirOffline(dir string, err error) {
+	if n.logDirs.MarkOffline(dir, err) {
+		Lg.Errorf("log dir(%s) failed, take its partitions offline : %v", dir, err)
+	}
+	n.topicPartition.Range(func(tpi, partitionI interface{}) bool {
+		partition := partitionI.(*Partition)
+		if partition.dataDir == dir {
+			partition.setOffline()
+		}
+		return true
+	})
+}
+
+//PickupTopicInfoFromDisk collects the partitions of all online log dirs, a log dir that can not be read is taken offline
+func (n *Node) PickupTopicInfoFromDisk() []meta.TopicMetadata {
+	topicInfos := make([]meta.TopicMetadata, 0)
+	for _, dir := range n.logDirs.dirs {
+		infos, err := queue.PickupTopicInfoFromDisk(dir)
+		if err != nil {
+			n.markLogDirOffline(dir, err)
+			continue
+		}
+		topicInfos = append(topicInfos, infos...)
+	}
+	return topicInfos
+}
+
+//Heartbeat reports the usage of the log dirs and the offline partitions to zero
+func (n *Node) Heartbeat() *meta.NodeHeartbeat {
+	usages := n.logDirs.Usage()
+	for i := range usages {
+		if usages[i].Error != "" && !usages[i].Offline {
+			n.markLogDirOffline(usages[i].Path, errors.New(usages[i].Error))
+			usages[i].Offline = true
+		}
+	}
+	heartbeat := &meta.NodeHeartbeat{
+		LogDirs:           usages,
+		OfflinePartitions: make([]meta.TopicMetadata, 0),
+	}
+	n.topicPartition.Range(func(tpi, partitionI interface{}) bool {
+		partition := partitionI.(*Partition)
+		for i := range heartbeat.LogDirs {
+			if heartbeat.LogDirs[i].Path == partition.dataDir {
+				heartbeat.LogDirs[i].Partitions++
+			}
+		}
+		if partition.Offline() {
+			heartbeat.OfflinePartitions = append(heartbeat.OfflinePartitions, meta.TopicMetadata{
+				Topic:       partition.topicName,
+				PartitionID: partition.id,
+				IsReplica:   partition.isRepplica,
+			})
+		}
+		return true
+	})
+	return heartbeat
+}
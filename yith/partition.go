@@ -1,16 +1,43 @@
 package yith
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 	"yithQ/message"
+	"yithQ/status"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
 	"yithQ/yith/queue"
 )
 
+var PartitionOffline error = errors.New(status.PartitionOffline)
+
 type Partition struct {
 	id        int
 	topicName string
 	q         *queue.Queue
+	//the log dir holding the partition, see LogDirs
+	dataDir string
+	//1 once its log dir failed
+	offline int32
+
+	//sequences of the idempotent producers
+	producers *producerStates
+	//open and aborted transactions, see transaction.go
+	txns *partitionTransactions
+
+	//batches held until their deliverAt, opened with openDelayLog on the first one, see delayed.go
+	delayedLock  sync.Mutex
+	delayed      *delayedMessages
+	openDelayLog func() (queue.DiskQueue, error)
 
 	//TODO: will use watermark to Increase performance
 	watermark uint64
@@ -18,25 +45,292 @@ type Partition struct {
 	isRepplica bool
 }
 
-func NewPartition(id int, topicName string, isReplica bool /* queueCfg *conf.QueueConf*/) (*Partition, error) {
-	//memoryQ := queue.NewMemoryQueue(queueCfg.MemoryQueueConf)
-	diskQ, err := queue.NewDiskQueue(topicName + "-" + strconv.Itoa(id))
+//NewPartition opens the log of the partition with engine, dataDir is "" for an engine that is not durable
+func NewPartition(id int, topicName string, isReplica bool, dataDir string, cfg *conf.Config, engine queue.StorageEngine, objectStore queue.ObjectStore, keys queue.KeyProvider) (*Partition, error) {
+	var memoryQ queue.MemoryQueue
+	//the tail cache would only copy a log that is in memory already
+	if cfg.QueueConf != nil && engine.Durable() {
+		memoryQ = queue.NewMemoryQueue(cfg.QueueConf.MemoryQueueConf)
+	}
+	//only the leader uploads, the replicas would overwrite the same objects
+	if isReplica {
+		objectStore = nil
+	}
+	diskQ, err := engine.Open(dataDir, topicName, id, cfg.TopicConfig(topicName), objectStore, keys)
+	if err != nil {
+		return nil, err
+	}
+	var dir string
+	if dataDir != "" {
+		dir = queue.PartitionDir(dataDir, topicName, id)
+	}
+	txns, err := loadTransactions(dir, diskQ.LastOffset())
+	if err == nil {
+		//the tail of the log may be lost on recovery
+		err = txns.truncate(diskQ.LastOffset() + 1)
+	}
+	var producers *producerStates
+	if err == nil {
+		producers, err = loadProducerStates(dir, diskQ.LastOffset())
+	}
 	if err != nil {
+		diskQ.Close()
 		return nil, err
 	}
-	queue := queue.NewQueue(nil, diskQ)
-	return &Partition{
+	delayConf := delayLogConfig(cfg.TopicConfig(topicName))
+	p := &Partition{
 		id:         id,
 		topicName:  topicName,
-		q:          queue,
+		q:          queue.NewQueue(memoryQ, diskQ),
+		dataDir:    dataDir,
+		producers:  producers,
+		txns:       txns,
 		isRepplica: isReplica,
-	}, nil
+		openDelayLog: func() (queue.DiskQueue, error) {
+			//under the topic and partition id of the partition, which its segments are encrypted for
+			return engine.Open(filepath.Join(dir, delayedDirName), topicName, id, delayConf, nil, keys)
+		},
+	}
+	//the batches not released before the restart
+	if _, err := os.Stat(filepath.Join(dir, delayedDirName)); dir != "" && err == nil {
+		if _, err := p.delayedMessages(); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+//Produce returns the base offset assigned to msgs
+func (p *Partition) Produce(msgs []*message.Message) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
+	return p.q.Fill(msgs)
+}
+
+//ProduceIdempotent produces the batch of sequence of an idempotent producer, a retried batch is dropped and the
+//base offset of its first write is returned, -1 if it is not kept. A missing batch before it is OutOfOrderSequence.
+//The batch is a part of transactionID if it is not 0, a batch of a transaction ended is TransactionFenced
+func (p *Partition) ProduceIdempotent(producerID int64, sequence uint64, transactionID int64, msgs []*message.Message) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
+	baseOffset, duplicate, err := p.producers.produce(producerID, sequence, func() (int64, error) {
+		if transactionID != 0 {
+			return p.txns.produce(producerID, transactionID, msgs, p.nextOffset, p.q.Fill)
+		}
+		return p.q.Fill(msgs)
+	})
+	if duplicate {
+		Lg.Debugf("topic(%s) partition(%d) drop the retried batch %d of producer %d", p.topicName, p.id, sequence, producerID)
+	}
+	return baseOffset, err
+}
+
+//nextOffset is not past the offset of the next batch written
+func (p *Partition) nextOffset() int64 {
+	return p.q.LastOffset() + 1
 }
 
-func (p *Partition) Produce(msgs []*message.Message) error {
+//ProduceDelayed holds msgs until deliverAt and produces them then, a batch of an idempotent producer is deduped
+//as by ProduceIdempotent. The offsets are assigned on release, so -1 is returned
+func (p *Partition) ProduceDelayed(producerID int64, sequence uint64, deliverAt int64, msgs []*message.Message) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
+	delayed, err := p.delayedMessages()
+	if err != nil {
+		return 0, err
+	}
+	write := func() (int64, error) {
+		return -1, delayed.add(deliverAt, msgs)
+	}
+	if producerID == 0 {
+		return write()
+	}
+	baseOffset, duplicate, err := p.producers.produce(producerID, sequence, write)
+	if duplicate {
+		Lg.Debugf("topic(%s) partition(%d) drop the retried delayed batch %d of producer %d", p.topicName, p.id, sequence, producerID)
+	}
+	return baseOffset, err
+}
+
+func (p *Partition) delayedMessages() (*delayedMessages, error) {
+	p.delayedLock.Lock()
+	defer p.delayedLock.Unlock()
+	if p.delayed != nil {
+		return p.delayed, nil
+	}
+	delayLog, err := p.openDelayLog()
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("topic(%s) partition(%d)", p.topicName, p.id)
+	delayed, err := openDelayedMessages(name, delayLog, p.releaseDelayed)
+	if err != nil {
+		delayLog.Close()
+		return nil, err
+	}
+	p.delayed = delayed
+	return delayed, nil
+}
+
+func (p *Partition) releaseDelayed(msgs []*message.Message) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
 	return p.q.Fill(msgs)
 }
 
+//ExpireProducers forgets the idempotent producers not producing for producerStateExpiry
+func (p *Partition) ExpireProducers() int {
+	if p.Offline() {
+		return 0
+	}
+	return p.producers.expire(time.Now().Add(-producerStateExpiry))
+}
+
+//WriteTxnMarker ends the transaction of producerID in the partition with a commit or abort marker
+func (p *Partition) WriteTxnMarker(producerID, transactionID int64, commit bool) error {
+	if p.Offline() {
+		return PartitionOffline
+	}
+	return p.txns.writeMarker(producerID, transactionID, commit, p.q.Fill)
+}
+
+//CleanTransactions forgets the aborted transactions before the log start offset and the ended ones of idle producers
+func (p *Partition) CleanTransactions() (int, error) {
+	if p.Offline() {
+		return 0, nil
+	}
+	return p.txns.clean(p.q.LogStartOffset(), time.Now().Add(-producerStateExpiry))
+}
+
+//ConsumeCommitted serves the records before the last stable offset without the aborted ones,
+//NextOffsetHeader tells where to consume from next
+func (p *Partition) ConsumeCommitted(popOffset int64, amount int, writer http.ResponseWriter) error {
+	if p.Offline() {
+		return PartitionOffline
+	}
+	var records []byte
+	nextOffset := popOffset
+	err := p.txns.read(popOffset, func(lastStableOffset int64, aborted []offsetRange) error {
+		buf := &bufferWriter{header: make(http.Header)}
+		if err := p.q.Pop(popOffset, amount, buf); err != nil {
+			return err
+		}
+		var err error
+		records, nextOffset, err = filterCommitted(buf.Bytes(), popOffset, lastStableOffset, aborted)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writer.Header().Set(message.NextOffsetHeader, strconv.FormatInt(nextOffset, 10))
+	writer.Header().Set("Content-Length", strconv.Itoa(len(records)))
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	_, err = writer.Write(records)
+	return err
+}
+
+//bufferWriter keeps the records popped for a read_committed consumer to filter them
+type bufferWriter struct {
+	bytes.Buffer
+	header http.Header
+}
+
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferWriter) WriteHeader(statusCode int) {}
+
 func (p *Partition) Consume(popOffset int64, amount int, writer http.ResponseWriter) error {
+	if p.Offline() {
+		return PartitionOffline
+	}
 	return p.q.Pop(popOffset, amount, writer)
 }
+
+func (p *Partition) DeleteExpiredSegments() (int, error) {
+	if p.Offline() {
+		return 0, nil
+	}
+	return p.q.DeleteExpiredSegments()
+}
+
+func (p *Partition) Offload() (int, error) {
+	if p.Offline() {
+		return 0, nil
+	}
+	return p.q.Offload()
+}
+
+func (p *Partition) Compact() (int, error) {
+	if p.Offline() {
+		return 0, nil
+	}
+	return p.q.Compact()
+}
+
+//DeleteRecords returns the new log start offset
+func (p *Partition) DeleteRecords(beforeOffset int64) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
+	return p.q.DeleteRecords(beforeOffset)
+}
+
+//TruncateTo removes the records from offset on, ep: the tail a replica wrote but the leader does not have
+func (p *Partition) TruncateTo(offset int64) error {
+	if p.Offline() {
+		return PartitionOffline
+	}
+	if err := p.q.TruncateTo(offset); err != nil {
+		return err
+	}
+	return p.txns.truncate(offset)
+}
+
+//Snapshot returns a point-in-time copy of the log for a backup, the caller closes it
+func (p *Partition) Snapshot() (*queue.PartitionSnapshot, error) {
+	if p.Offline() {
+		return nil, PartitionOffline
+	}
+	return p.q.Snapshot()
+}
+
+func (p *Partition) OffsetForTime(timestamp int64) (int64, error) {
+	if p.Offline() {
+		return 0, PartitionOffline
+	}
+	return p.q.OffsetForTime(timestamp)
+}
+
+func (p *Partition) Offline() bool {
+	return atomic.LoadInt32(&p.offline) == 1
+}
+
+func (p *Partition) setOffline() {
+	atomic.StoreInt32(&p.offline, 1)
+}
+
+func (p *Partition) Close() error {
+	//the partition failed to open on an offline log dir
+	if p.q == nil {
+		return nil
+	}
+	p.delayedLock.Lock()
+	defer p.delayedLock.Unlock()
+	if p.delayed != nil {
+		if err := p.delayed.close(); err != nil {
+			Lg.Errorf("topic(%s) partition(%d) close delay log error : %v", p.topicName, p.id, err)
+		}
+		p.delayed = nil
+	}
+	if err := p.producers.close(); err != nil {
+		Lg.Errorf("topic(%s) partition(%d) close producer state file error : %v", p.topicName, p.id, err)
+	}
+	return p.q.Close()
+}
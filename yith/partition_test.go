@@ -0,0 +1,424 @@
+package yith
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"yithQ/message"
+	"yithQ/util/logger"
+	"yithQ/yith/conf"
+	"yithQ/yith/queue"
+)
+
+func TestMain(m *testing.M) {
+	logger.NewLogger(os.Stdout, "debug")
+	os.Exit(m.Run())
+}
+
+func TestMemoryPartition(t *testing.T) {
+	cfg := &conf.Config{QueueConf: &conf.QueueConf{MemoryQueueConf: &conf.MemoryQueueConf{RingBufferCapacity: 16}}}
+	p, err := NewPartition(1, "ephemeral", false, "", cfg, queue.MemoryEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	defer p.Close()
+	for i, body := range []string{"a", "b", "c"} {
+		baseOffset, err := p.Produce([]*message.Message{{Body: []byte(body)}})
+		if err != nil || baseOffset != int64(i+1) {
+			t.Fatalf("produce base offset %d error %v", baseOffset, err)
+		}
+	}
+	w := httptest.NewRecorder()
+	if err := p.Consume(2, 2, w); err != nil {
+		t.Fatalf("consume error : %v", err)
+	}
+	msgs, err := message.DecodeRecords(w.Body.Bytes())
+	if err != nil || len(msgs) != 2 || msgs[0].Offset != 2 || string(msgs[1].Body) != "c" {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+}
+
+func TestNodeStorageEngine(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	cfg := &conf.Config{
+		DataDirs:      []string{dataDir},
+		TopicDefaults: &conf.TopicConf{StorageEngine: conf.StorageEngineMemory},
+		Topics:        map[string]*conf.TopicConf{"broken": {StorageEngine: "tape"}},
+	}
+	node := NewNode("127.0.0.1", cfg, nil, nil)
+	if err := node.AddTopicPartition("ephemeral", 0, false); err != nil {
+		t.Fatalf("add topic partition error : %v", err)
+	}
+	if _, err := node.ProduceTopicPartition("ephemeral", 0, []*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+		t.Fatalf("produce error : %v", err)
+	}
+	if logStartOffset, err := node.DeleteRecords("ephemeral", 0, 2); err != nil || logStartOffset != 2 {
+		t.Fatalf("delete records log start offset %d error %v", logStartOffset, err)
+	}
+	if err := node.Consume("ephemeral", 0, 1, 1, httptest.NewRecorder()); err != queue.ErrOffsetOutOfRange {
+		t.Fatalf("consume deleted offset error is %v", err)
+	}
+	//a memory partition takes no log dir
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("log dir of a memory topic exists : %v", err)
+	}
+	if err := node.AddTopicPartition("broken", 0, false); err == nil || node.ExistTopicPartition("broken", 0) {
+		t.Fatalf("add topic partition with an unknown storage engine error is %v", err)
+	}
+	node.DeleteTopicPartition("ephemeral", 0)
+}
+
+func TestNodeBackupRestore(t *testing.T) {
+	source := NewNode("127.0.0.1", &conf.Config{DataDirs: []string{t.TempDir()}}, nil, nil)
+	for partitionID := 0; partitionID < 2; partitionID++ {
+		if err := source.AddTopicPartition("orders", partitionID, false); err != nil {
+			t.Fatalf("add topic partition error : %v", err)
+		}
+		if _, err := source.ProduceTopicPartition("orders", partitionID, []*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+			t.Fatalf("produce error : %v", err)
+		}
+	}
+	if _, err := source.DeleteRecords("orders", 1, 2); err != nil {
+		t.Fatalf("delete records error : %v", err)
+	}
+	snapshot, err := source.SnapshotTopic("orders")
+	if err != nil {
+		t.Fatalf("snapshot topic error : %v", err)
+	}
+	var archive bytes.Buffer
+	if err := snapshot.WriteArchive(&archive); err != nil {
+		t.Fatalf("write archive error : %v", err)
+	}
+	snapshot.Close()
+
+	target := NewNode("127.0.0.1", &conf.Config{DataDirs: []string{t.TempDir()}}, nil, nil)
+	manifest, err := target.RestoreTopic(bytes.NewReader(archive.Bytes()))
+	if err != nil || len(manifest.Partitions) != 2 {
+		t.Fatalf("restore topic manifest %+v error %v", manifest, err)
+	}
+	if err := target.Consume("orders", 1, 1, 1, httptest.NewRecorder()); err != queue.ErrOffsetOutOfRange {
+		t.Fatalf("consume deleted offset of the restored partition error is %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := target.Consume("orders", 1, 2, 1, w); err != nil {
+		t.Fatalf("consume restored partition error : %v", err)
+	}
+	if msgs, err := message.DecodeRecords(w.Body.Bytes()); err != nil || len(msgs) != 1 || string(msgs[0].Body) != "b" {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+	if baseOffset, err := target.ProduceTopicPartition("orders", 0, []*message.Message{{Body: []byte("c")}}); err != nil || baseOffset != 3 {
+		t.Fatalf("produce to restored partition base offset %d error %v", baseOffset, err)
+	}
+	if _, err := target.RestoreTopic(bytes.NewReader(archive.Bytes())); !errors.Is(err, queue.ErrPartitionExists) {
+		t.Fatalf("restore over existing partitions error is %v", err)
+	}
+	source.DeleteTopicPartition("orders", 0)
+	source.DeleteTopicPartition("orders", 1)
+	target.DeleteTopicPartition("orders", 0)
+	target.DeleteTopicPartition("orders", 1)
+}
+
+func TestIdempotentProduce(t *testing.T) {
+	cfg := &conf.Config{QueueConf: &conf.QueueConf{MemoryQueueConf: &conf.MemoryQueueConf{RingBufferCapacity: 16}}}
+	p, err := NewPartition(1, "orders", false, "", cfg, queue.MemoryEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	defer p.Close()
+	produce := func(producerID int64, sequence uint64, body string) (int64, error) {
+		return p.ProduceIdempotent(producerID, sequence, 0, []*message.Message{{Body: []byte(body)}})
+	}
+	//the first batch of a producer is taken whatever its sequence
+	if baseOffset, err := produce(7, 5, "a"); err != nil || baseOffset != 1 {
+		t.Fatalf("produce base offset %d error %v", baseOffset, err)
+	}
+	if baseOffset, err := produce(7, 5, "a"); err != nil || baseOffset != 1 {
+		t.Fatalf("produce retried batch base offset %d error %v", baseOffset, err)
+	}
+	if baseOffset, err := produce(7, 6, "b"); err != nil || baseOffset != 2 {
+		t.Fatalf("produce next batch base offset %d error %v", baseOffset, err)
+	}
+	if baseOffset, err := produce(7, 5, "a"); err != nil || baseOffset != -1 {
+		t.Fatalf("produce older batch base offset %d error %v", baseOffset, err)
+	}
+	if _, err := produce(7, 8, "d"); !errors.Is(err, OutOfOrderSequence) {
+		t.Fatalf("produce after a gap error is %v", err)
+	}
+	if baseOffset, err := produce(8, 0, "c"); err != nil || baseOffset != 3 {
+		t.Fatalf("produce of another producer base offset %d error %v", baseOffset, err)
+	}
+	w := httptest.NewRecorder()
+	if err := p.Consume(1, 10, w); err != nil {
+		t.Fatalf("consume error : %v", err)
+	}
+	msgs, err := message.DecodeRecords(w.Body.Bytes())
+	if err != nil || len(msgs) != 3 || string(msgs[1].Body) != "b" || string(msgs[2].Body) != "c" {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+	if expired := p.producers.expire(time.Now().Add(time.Second)); expired != 2 {
+		t.Fatalf("expire %d producers, want 2", expired)
+	}
+}
+
+func TestIdempotentProduceReopen(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &conf.Config{DataDirs: []string{dataDir}}
+	p, err := NewPartition(1, "orders", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	if baseOffset, err := p.ProduceIdempotent(7, 0, 0, []*message.Message{{Body: []byte("a")}}); err != nil || baseOffset != 1 {
+		t.Fatalf("produce base offset %d error %v", baseOffset, err)
+	}
+	p.Close()
+
+	//a batch retried after a restart is still dropped
+	p, err = NewPartition(1, "orders", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen partition error : %v", err)
+	}
+	defer p.Close()
+	if baseOffset, err := p.ProduceIdempotent(7, 0, 0, []*message.Message{{Body: []byte("a")}}); err != nil || baseOffset != 1 {
+		t.Fatalf("produce retried batch base offset %d error %v", baseOffset, err)
+	}
+	if _, err := p.ProduceIdempotent(7, 2, 0, []*message.Message{{Body: []byte("c")}}); !errors.Is(err, OutOfOrderSequence) {
+		t.Fatalf("produce after a gap error is %v", err)
+	}
+	if baseOffset, err := p.ProduceIdempotent(7, 1, 0, []*message.Message{{Body: []byte("b")}}); err != nil || baseOffset != 2 {
+		t.Fatalf("produce next batch base offset %d error %v", baseOffset, err)
+	}
+}
+
+func TestTransactionalProduce(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &conf.Config{DataDirs: []string{dataDir}}
+	p, err := NewPartition(1, "orders", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	consumeCommitted := func(p *Partition, offset int64) ([]string, string) {
+		w := httptest.NewRecorder()
+		if err := p.ConsumeCommitted(offset, 10, w); err != nil {
+			t.Fatalf("consume committed error : %v", err)
+		}
+		msgs, err := message.DecodeRecords(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("decode msgs error : %v", err)
+		}
+		bodies := make([]string, 0)
+		for _, msg := range msgs {
+			if !msg.IsControl() {
+				bodies = append(bodies, string(msg.Body))
+			}
+		}
+		return bodies, w.Header().Get(message.NextOffsetHeader)
+	}
+	if _, err := p.ProduceIdempotent(1, 0, 10, []*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+		t.Fatalf("produce transactional error : %v", err)
+	}
+	if _, err := p.Produce([]*message.Message{{Body: []byte("c")}}); err != nil {
+		t.Fatalf("produce error : %v", err)
+	}
+	//the open transaction holds back the records after it
+	if bodies, next := consumeCommitted(p, 1); len(bodies) != 0 || next != "1" {
+		t.Fatalf("consume committed %v next %s before commit", bodies, next)
+	}
+	if _, err := p.ProduceIdempotent(2, 0, 20, []*message.Message{{Body: []byte("d")}}); err != nil {
+		t.Fatalf("produce transactional error : %v", err)
+	}
+	if err := p.WriteTxnMarker(1, 10, true); err != nil {
+		t.Fatalf("write commit marker error : %v", err)
+	}
+	if bodies, next := consumeCommitted(p, 1); len(bodies) != 3 || bodies[2] != "c" || next != "4" {
+		t.Fatalf("consume committed %v next %s after commit", bodies, next)
+	}
+	if err := p.WriteTxnMarker(2, 20, false); err != nil {
+		t.Fatalf("write abort marker error : %v", err)
+	}
+	if bodies, next := consumeCommitted(p, 4); len(bodies) != 0 || next != "7" {
+		t.Fatalf("consume committed %v next %s after abort", bodies, next)
+	}
+	if _, err := p.ProduceIdempotent(1, 1, 10, []*message.Message{{Body: []byte("e")}}); !errors.Is(err, TransactionFenced) {
+		t.Fatalf("produce to an ended transaction error is %v", err)
+	}
+	//the fenced batch leaves the partition to the others
+	if err := p.WriteTxnMarker(1, 10, true); err != nil {
+		t.Fatalf("write marker again error : %v", err)
+	}
+	if bodies, next := consumeCommitted(p, 4); len(bodies) != 0 || next != "7" {
+		t.Fatalf("consume committed %v next %s after a fenced batch", bodies, next)
+	}
+	p.Close()
+
+	//the aborted transaction stays hidden after a restart
+	p, err = NewPartition(1, "orders", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen partition error : %v", err)
+	}
+	defer p.Close()
+	if bodies, next := consumeCommitted(p, 1); len(bodies) != 3 || bodies[0] != "a" || next != "7" {
+		t.Fatalf("consume committed %v next %s after reopen", bodies, next)
+	}
+}
+
+func TestTransactionWriteUnlocked(t *testing.T) {
+	pt, err := loadTransactions("", 0)
+	if err != nil {
+		t.Fatalf("load transactions error : %v", err)
+	}
+	filling, fill := make(chan struct{}), make(chan struct{})
+	produced := make(chan error, 1)
+	go func() {
+		_, err := pt.produce(1, 10, []*message.Message{{Body: []byte("a")}}, func() int64 { return 5 }, func([]*message.Message) (int64, error) {
+			close(filling)
+			<-fill
+			return 6, nil
+		})
+		produced <- err
+	}()
+	<-filling
+	//read_committed consumers are served while the batch is written, up to the offset taken before it
+	var lastStableOffset int64
+	if err := pt.read(1, func(lso int64, aborted []offsetRange) error {
+		lastStableOffset = lso
+		return nil
+	}); err != nil || lastStableOffset != 5 {
+		t.Fatalf("read last stable offset %d error %v", lastStableOffset, err)
+	}
+	//the marker waits for the batch
+	marked := make(chan error, 1)
+	go func() {
+		marked <- pt.writeMarker(1, 10, false, func([]*message.Message) (int64, error) { return 7, nil })
+	}()
+	select {
+	case err := <-marked:
+		t.Fatalf("marker written while the batch is, error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(fill)
+	if err := <-produced; err != nil {
+		t.Fatalf("produce error : %v", err)
+	}
+	if err := <-marked; err != nil {
+		t.Fatalf("write marker error : %v", err)
+	}
+	if len(pt.state.Aborted) != 1 || pt.state.Aborted[0] != (offsetRange{First: 6, Last: 6}) {
+		t.Fatalf("aborted ranges %v", pt.state.Aborted)
+	}
+}
+
+func TestDelayedProduce(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &conf.Config{DataDirs: []string{dataDir}}
+	p, err := NewPartition(1, "webhooks", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	consume := func(p *Partition) []*message.Message {
+		w := httptest.NewRecorder()
+		if err := p.Consume(1, 10, w); err != nil {
+			t.Fatalf("consume error : %v", err)
+		}
+		msgs, err := message.DecodeRecords(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("decode msgs error : %v", err)
+		}
+		return msgs
+	}
+	deliverAt := time.Now().Add(300 * time.Millisecond)
+	if baseOffset, err := p.ProduceDelayed(0, 0, deliverAt.UnixNano(), []*message.Message{{Body: []byte("a")}}); err != nil || baseOffset != -1 {
+		t.Fatalf("produce delayed base offset %d error %v", baseOffset, err)
+	}
+	for i := 0; i < 2; i++ {
+		//the retry of an idempotent producer is dropped
+		if _, err := p.ProduceDelayed(9, 0, time.Now().Add(time.Hour).UnixNano(), []*message.Message{{Body: []byte("c")}}); err != nil {
+			t.Fatalf("produce delayed error : %v", err)
+		}
+	}
+	if _, err := p.Produce([]*message.Message{{Body: []byte("b")}}); err != nil {
+		t.Fatalf("produce error : %v", err)
+	}
+	if msgs := consume(p); len(msgs) != 1 || string(msgs[0].Body) != "b" {
+		t.Fatalf("consume %v before deliverAt", msgs)
+	}
+	p.Close()
+
+	//the delayed batches are held across a restart
+	p, err = NewPartition(1, "webhooks", false, dataDir, cfg, queue.SegmentEngine{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen partition error : %v", err)
+	}
+	defer p.Close()
+	var msgs []*message.Message
+	for timeout := time.Now().Add(3 * time.Second); time.Now().Before(timeout); time.Sleep(50 * time.Millisecond) {
+		if msgs = consume(p); len(msgs) != 1 {
+			break
+		}
+	}
+	if time.Now().Before(deliverAt) || len(msgs) != 2 || string(msgs[1].Body) != "a" || msgs[1].Offset != 2 {
+		t.Fatalf("consume %v after deliverAt", msgs)
+	}
+	p.delayed.lock.Lock()
+	defer p.delayed.lock.Unlock()
+	if len(p.delayed.pending) != 1 || p.delayed.log.LogStartOffset() != 2 {
+		t.Fatalf("%d batches pending, delay log starts at %d", len(p.delayed.pending), p.delayed.log.LogStartOffset())
+	}
+}
+
+func TestDelayedEncryption(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyPath, []byte("1 000102030405060708090a0b0c0d0e0f\n"), 0600); err != nil {
+		t.Fatalf("write key file error : %v", err)
+	}
+	keys, err := queue.NewKeyFile(keyPath)
+	if err != nil {
+		t.Fatalf("new key file error : %v", err)
+	}
+	enable := true
+	dataDir := t.TempDir()
+	cfg := &conf.Config{DataDirs: []string{dataDir}, TopicDefaults: &conf.TopicConf{EncryptionEnable: &enable}}
+	p, err := NewPartition(1, "webhooks", false, dataDir, cfg, queue.SegmentEngine{}, nil, keys)
+	if err != nil {
+		t.Fatalf("new partition error : %v", err)
+	}
+	if _, err := p.ProduceDelayed(0, 0, time.Now().Add(time.Hour).UnixNano(), []*message.Message{{Body: []byte("personal")}}); err != nil {
+		t.Fatalf("produce delayed error : %v", err)
+	}
+	p.Close()
+
+	//the delay log of partition 1 put in the place of the one of partition 2 is not read under its identity
+	source := filepath.Join(queue.PartitionDir(dataDir, "webhooks", 1), delayedDirName, "webhooks", "1")
+	target := filepath.Join(queue.PartitionDir(dataDir, "webhooks", 2), delayedDirName, "webhooks", "2")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatalf("mkdir error : %v", err)
+	}
+	fis, err := os.ReadDir(source)
+	if err != nil {
+		t.Fatalf("read delay log dir error : %v", err)
+	}
+	for _, fi := range fis {
+		data, err := os.ReadFile(filepath.Join(source, fi.Name()))
+		if err != nil {
+			t.Fatalf("read delay log file error : %v", err)
+		}
+		if fi.Name() == queue.PartitionMetaFile {
+			data = []byte(`{"topic":"webhooks","partition_id":2}`)
+		}
+		if bytes.Contains(data, []byte("personal")) {
+			t.Fatalf("delay log file %s holds records in the clear", fi.Name())
+		}
+		if err := os.WriteFile(filepath.Join(target, fi.Name()), data, 0644); err != nil {
+			t.Fatalf("write delay log file error : %v", err)
+		}
+	}
+	if p, err := NewPartition(2, "webhooks", false, dataDir, cfg, queue.SegmentEngine{}, nil, keys); !errors.Is(err, queue.ErrRecordDecrypt) {
+		if err == nil {
+			p.Close()
+		}
+		t.Fatalf("open partition with the delay log of another error is %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package yith
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yithQ/status"
+	. "yithQ/util/logger"
+)
+
+//producers not producing to a partition for producerStateExpiry are forgotten by it
+const producerStateExpiry = 7 * 24 * time.Hour
+
+//the producer state file of a durable partition, an entry is appended for every batch written:
+//
+//	producerID int64
+//	sequence   uint64
+//	baseOffset int64
+const (
+	producerStateFileName = "producer-state"
+	producerStateEntryLen = 24
+)
+
+var OutOfOrderSequence error = errors.New(status.OutOfOrderSequence)
+
+//producerStates dedups the batches of idempotent producers, each batch of a producer to a partition carries
+//the next sequence. A retried batch has a sequence already written and is dropped, a sequence after the next
+//means batches are missing and is refused. The batches of a producer are serialized by the lock of its state,
+//the ones of different producers are written concurrently. The states of a durable partition are rebuilt from
+//the producer state file on open, so the first batch of a producer after a restart is only taken whatever its
+//sequence if the producer was not known before
+type producerStates struct {
+	//lock guards states only, it is never held across a write
+	lock   sync.Mutex
+	states map[int64]*producerState
+	//"" if the partition is not durable
+	path string
+	//fileLock guards file and entries, the last entry of each producer written to file
+	fileLock sync.Mutex
+	file     *os.File
+	entries  map[int64]producerStateEntry
+}
+
+type producerState struct {
+	//held across the sequence check and the write of a batch of the producer
+	lock sync.Mutex
+	//no batch is written yet, ep: the state was created for a batch that failed
+	empty        bool
+	lastSequence uint64
+	//base offset of the batch of lastSequence, returned for its retries
+	lastBaseOffset int64
+	//unix nano, read by expire without lock
+	lastProduced int64
+}
+
+type producerStateEntry struct {
+	sequence   uint64
+	baseOffset int64
+}
+
+//loadProducerStates replays the producer state file of the partition dir, the batches beyond lastOffset,
+//lost with the tail of the log, are dropped. dir is "" for a partition that is not durable
+func loadProducerStates(dir string, lastOffset int64) (*producerStates, error) {
+	ps := &producerStates{
+		states:  make(map[int64]*producerState),
+		entries: make(map[int64]producerStateEntry),
+	}
+	if dir == "" {
+		return ps, nil
+	}
+	ps.path = filepath.Join(dir, producerStateFileName)
+	data, err := ioutil.ReadFile(ps.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	//a torn entry at the end is ignored
+	for ; len(data) >= producerStateEntryLen; data = data[producerStateEntryLen:] {
+		producerID := int64(binary.BigEndian.Uint64(data))
+		entry := producerStateEntry{
+			sequence:   binary.BigEndian.Uint64(data[8:]),
+			baseOffset: int64(binary.BigEndian.Uint64(data[16:])),
+		}
+		if entry.baseOffset > lastOffset {
+			continue
+		}
+		ps.entries[producerID] = entry
+	}
+	now := time.Now().UnixNano()
+	for producerID, entry := range ps.entries {
+		ps.states[producerID] = &producerState{lastSequence: entry.sequence, lastBaseOffset: entry.baseOffset, lastProduced: now}
+	}
+	if err := ps.rewrite(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+//produce calls write unless the batch of sequence is written already, duplicate is true for a dropped batch
+func (ps *producerStates) produce(producerID int64, sequence uint64, write func() (int64, error)) (baseOffset int64, duplicate bool, err error) {
+	ps.lock.Lock()
+	state, ok := ps.states[producerID]
+	if !ok {
+		state = &producerState{empty: true, lastProduced: time.Now().UnixNano()}
+		ps.states[producerID] = state
+	}
+	ps.lock.Unlock()
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	atomic.StoreInt64(&state.lastProduced, time.Now().UnixNano())
+	if !state.empty && sequence <= state.lastSequence {
+		if sequence == state.lastSequence {
+			return state.lastBaseOffset, true, nil
+		}
+		//an older batch, its offset is not kept
+		return -1, true, nil
+	}
+	if !state.empty && sequence != state.lastSequence+1 {
+		return 0, false, errors.Wrapf(OutOfOrderSequence, "producer %d sequence %d, expected %d", producerID, sequence, state.lastSequence+1)
+	}
+	baseOffset, err = write()
+	if err != nil {
+		return 0, false, err
+	}
+	state.empty, state.lastSequence, state.lastBaseOffset = false, sequence, baseOffset
+	//a batch written without its entry is retried by the producer, which the state in memory dedups
+	return baseOffset, false, ps.append(producerID, producerStateEntry{sequence: sequence, baseOffset: baseOffset})
+}
+
+//append writes the entry of a batch to the producer state file, the fsync is not under fileLock
+//so the producers writing concurrently share it
+func (ps *producerStates) append(producerID int64, entry producerStateEntry) error {
+	if ps.path == "" {
+		return nil
+	}
+	ps.fileLock.Lock()
+	file := ps.file
+	if file == nil {
+		ps.fileLock.Unlock()
+		return errors.Errorf("producer state file(%s) is closed", ps.path)
+	}
+	ps.entries[producerID] = entry
+	_, err := file.Write(encodeProducerStateEntry(producerID, entry))
+	ps.fileLock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	//rewrite replaced the file meanwhile, the new one holds the entry and is synced
+	if errors.Is(err, os.ErrClosed) {
+		ps.fileLock.Lock()
+		replaced := ps.file != nil && ps.file != file
+		ps.fileLock.Unlock()
+		if replaced {
+			return nil
+		}
+	}
+	return err
+}
+
+func encodeProducerStateEntry(producerID int64, entry producerStateEntry) []byte {
+	data := make([]byte, producerStateEntryLen)
+	binary.BigEndian.PutUint64(data, uint64(producerID))
+	binary.BigEndian.PutUint64(data[8:], entry.sequence)
+	binary.BigEndian.PutUint64(data[16:], uint64(entry.baseOffset))
+	return data
+}
+
+//rewrite replaces the producer state file with the last entry of each producer and opens it for appending
+func (ps *producerStates) rewrite() error {
+	ps.fileLock.Lock()
+	defer ps.fileLock.Unlock()
+	data := make([]byte, 0, len(ps.entries)*producerStateEntryLen)
+	for producerID, entry := range ps.entries {
+		data = append(data, encodeProducerStateEntry(producerID, entry)...)
+	}
+	f, err := os.OpenFile(ps.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(ps.path+".tmp", ps.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(ps.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if ps.file != nil {
+		ps.file.Close()
+	}
+	ps.file = file
+	return nil
+}
+
+//expire forgets the producers not producing since before and returns how many
+func (ps *producerStates) expire(before time.Time) int {
+	ps.lock.Lock()
+	expired := make([]int64, 0)
+	for producerID, state := range ps.states {
+		if atomic.LoadInt64(&state.lastProduced) < before.UnixNano() {
+			delete(ps.states, producerID)
+			expired = append(expired, producerID)
+		}
+	}
+	ps.lock.Unlock()
+	if len(expired) == 0 || ps.path == "" {
+		return len(expired)
+	}
+	ps.fileLock.Lock()
+	for _, producerID := range expired {
+		delete(ps.entries, producerID)
+	}
+	ps.fileLock.Unlock()
+	if err := ps.rewrite(); err != nil {
+		Lg.Errorf("rewrite producer state file(%s) error : %v", ps.path, err)
+	}
+	return len(expired)
+}
+
+func (ps *producerStates) close() error {
+	ps.fileLock.Lock()
+	defer ps.fileLock.Unlock()
+	if ps.file == nil {
+		return nil
+	}
+	err := ps.file.Close()
+	ps.file = nil
+	return err
+}
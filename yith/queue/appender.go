@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"github.com/pkg/errors"
+	"yithQ/message"
+)
+
+var ErrQueueClosed error = errors.New("queue closed")
+
+//every partition has one append loop owning writingFile, lastFileSeq and the segment rolls,
+//produce requests and replication hand their batches to it and wait for the assigned offsets,
+//TruncateTo runs in it as well
+type appendRequest struct {
+	msgs   []*message.Message
+	result chan appendResult
+}
+
+type appendResult struct {
+	baseOffset int64
+	lastOffset int64
+	err        error
+}
+
+//appendLoop runs until close, a batch is written whole before the next one is taken
+func (dq *diskQueue) appendLoop() {
+	defer close(dq.appendDone)
+	for {
+		select {
+		case req := <-dq.appendCh:
+			baseOffset := dq.getLastOffset() + 1
+			err := dq.fillToDisk(req.msgs)
+			//the batches are written one by one here, so the callback sees them in offset order
+			if err == nil && dq.onAppend != nil {
+				dq.onAppend(req.msgs)
+			}
+			req.result <- appendResult{
+				baseOffset: baseOffset,
+				lastOffset: dq.getLastOffset(),
+				err:        err,
+			}
+		case req := <-dq.truncateCh:
+			req.result <- dq.truncateTo(req.offset)
+		case <-dq.closing:
+			return
+		}
+	}
+}
+
+//append blocks until the append loop wrote msgs, ErrQueueClosed once the queue is closed
+func (dq *diskQueue) append(msgs []*message.Message) appendResult {
+	req := &appendRequest{
+		msgs:   msgs,
+		result: make(chan appendResult, 1),
+	}
+	//appendCh is unbuffered, a request is never left in it when the loop exits
+	select {
+	case dq.appendCh <- req:
+	case <-dq.closing:
+		return appendResult{err: ErrQueueClosed}
+	}
+	return <-req.result
+}
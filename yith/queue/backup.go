@@ -0,0 +1,296 @@
+package queue
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"yithQ/yith/conf"
+)
+
+//a backup is a tar.gz archive of the partitions of a topic, the manifest and config come first
+//so the archive is restored while it is streamed:
+//
+//	manifest.json                                  BackupManifest
+//	topic.yml                                      the topic config as in yith.yml
+//	<partition id>/segment_<seq>.data|.index|.timeindex
+//
+//the segment files are archived as stored, encrypted ones need their keys on the node restoring them
+const (
+	BackupManifestName  = "manifest.json"
+	BackupTopicConfName = "topic.yml"
+	BackupVersion       = 1
+)
+
+var ErrInvalidBackup error = errors.New("invalid backup")
+var ErrPartitionExists error = errors.New("partition exists")
+
+type BackupManifest struct {
+	Version    int               `json:"version"`
+	Topic      string            `json:"topic"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Partitions []BackupPartition `json:"partitions"`
+}
+
+type BackupPartition struct {
+	PartitionID    int             `json:"partition_id"`
+	LogStartOffset int64           `json:"log_start_offset"`
+	LastOffset     int64           `json:"last_offset"`
+	Segments       []BackupSegment `json:"segments"`
+}
+
+type BackupSegment struct {
+	Seq         int   `json:"seq"`
+	StartOffset int64 `json:"start_offset"`
+	EndOffset   int64 `json:"end_offset"`
+	Size        int64 `json:"size"`
+	//retention.ms counts from it after the restore too
+	ModTime time.Time `json:"mod_time"`
+}
+
+//BackupFile is a segment file of the archive, Name is its base name
+type BackupFile struct {
+	PartitionID int
+	Name        string
+	Size        int64
+	Reader      io.Reader
+}
+
+func NewBackupPartition(partitionID int, snapshot *PartitionSnapshot) BackupPartition {
+	bp := BackupPartition{
+		PartitionID:    partitionID,
+		LogStartOffset: snapshot.LogStartOffset,
+		LastOffset:     snapshot.LastOffset,
+		Segments:       make([]BackupSegment, 0, len(snapshot.Segments)),
+	}
+	for _, seg := range snapshot.Segments {
+		bp.Segments = append(bp.Segments, BackupSegment{
+			Seq:         seg.Seq,
+			StartOffset: seg.StartOffset,
+			EndOffset:   seg.EndOffset,
+			Size:        seg.Files[0].Size,
+			ModTime:     seg.ModTime,
+		})
+	}
+	return bp
+}
+
+func (m *BackupManifest) Partition(partitionID int) (BackupPartition, bool) {
+	for _, bp := range m.Partitions {
+		if bp.PartitionID == partitionID {
+			return bp, true
+		}
+	}
+	return BackupPartition{}, false
+}
+
+type BackupWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+//NewBackupWriter writes the manifest and topic config, the segment files of the partitions in the manifest follow
+func NewBackupWriter(w io.Writer, manifest *BackupManifest, topicConf *conf.TopicConf) (*BackupWriter, error) {
+	gz := gzip.NewWriter(w)
+	bw := &BackupWriter{gz: gz, tw: tar.NewWriter(gz)}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.writeEntry(BackupManifestName, data); err != nil {
+		return nil, err
+	}
+	if data, err = yaml.Marshal(topicConf); err != nil {
+		return nil, err
+	}
+	if err := bw.writeEntry(BackupTopicConfName, data); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (bw *BackupWriter) writeEntry(name string, data []byte) error {
+	if err := bw.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := bw.tw.Write(data)
+	return err
+}
+
+func (bw *BackupWriter) WriteSnapshot(partitionID int, snapshot *PartitionSnapshot) error {
+	for _, seg := range snapshot.Segments {
+		for _, f := range seg.Files {
+			err := bw.WriteFile(&BackupFile{
+				PartitionID: partitionID,
+				Name:        segmentFilePrefix + "_" + strconv.Itoa(seg.Seq) + f.Ext,
+				Size:        f.Size,
+				Reader:      f.Reader,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bw *BackupWriter) WriteFile(f *BackupFile) error {
+	header := &tar.Header{
+		Name:    path.Join(strconv.Itoa(f.PartitionID), f.Name),
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: time.Now(),
+	}
+	if err := bw.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(bw.tw, f.Reader, f.Size)
+	return err
+}
+
+func (bw *BackupWriter) Close() error {
+	if err := bw.tw.Close(); err != nil {
+		return err
+	}
+	return bw.gz.Close()
+}
+
+type BackupReader struct {
+	tr        *tar.Reader
+	Manifest  *BackupManifest
+	TopicConf *conf.TopicConf
+}
+
+//NewBackupReader reads the manifest and topic config of the archive
+func NewBackupReader(r io.Reader) (*BackupReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	br := &BackupReader{
+		tr:        tar.NewReader(gz),
+		Manifest:  &BackupManifest{},
+		TopicConf: &conf.TopicConf{},
+	}
+	data, err := br.readEntry(BackupManifestName)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, br.Manifest); err != nil {
+		return nil, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	if br.Manifest.Version != BackupVersion {
+		return nil, errors.Wrapf(ErrInvalidBackup, "version %d", br.Manifest.Version)
+	}
+	//the topic becomes a path of the restore, see ValidateTopicName
+	if err := ValidateTopicName(br.Manifest.Topic); err != nil {
+		return nil, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	if data, err = br.readEntry(BackupTopicConfName); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, br.TopicConf); err != nil {
+		return nil, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	return br, nil
+}
+
+func (br *BackupReader) readEntry(name string) ([]byte, error) {
+	header, err := br.tr.Next()
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidBackup, "read %s : %v", name, err)
+	}
+	if header.Name != name {
+		return nil, errors.Wrapf(ErrInvalidBackup, "%s where %s is expected", header.Name, name)
+	}
+	return ioutil.ReadAll(br.tr)
+}
+
+//Next returns the next segment file, io.EOF at the end of the archive
+func (br *BackupReader) Next() (*BackupFile, error) {
+	header, err := br.tr.Next()
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrap(ErrInvalidBackup, err.Error())
+	}
+	//never trust a path from the archive, only <partition id>/segment_<seq>.<ext> is accepted
+	dir, name := path.Split(header.Name)
+	partitionID, err := strconv.Atoi(strings.TrimSuffix(dir, "/"))
+	if err != nil || !validSegmentFile(name) {
+		return nil, errors.Wrapf(ErrInvalidBackup, "unexpected file %s", header.Name)
+	}
+	if _, ok := br.Manifest.Partition(partitionID); !ok {
+		return nil, errors.Wrapf(ErrInvalidBackup, "partition %d of %s is not in the manifest", partitionID, header.Name)
+	}
+	return &BackupFile{PartitionID: partitionID, Name: name, Size: header.Size, Reader: br.tr}, nil
+}
+
+func validSegmentFile(name string) bool {
+	if !strings.HasPrefix(name, segmentFilePrefix+"_") {
+		return false
+	}
+	for _, ext := range segmentExts {
+		if strings.HasSuffix(name, ext) {
+			_, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix+"_"), ext))
+			return err == nil
+		}
+	}
+	return false
+}
+
+//RestoreDir is where the files of a partition are staged until the whole archive is read
+func RestoreDir(dataDir, topic string, partitionID int) string {
+	return PartitionDir(dataDir, topic, partitionID) + ".restore"
+}
+
+//RestorePartition moves the files staged in RestoreDir into a new partition and keeps the offsets of the backup,
+//the partition is opened with NewDiskQueue afterwards
+func RestorePartition(dataDir, topic string, bp BackupPartition) error {
+	stagingDir := RestoreDir(dataDir, topic, bp.PartitionID)
+	if _, err := os.Stat(filepath.Join(PartitionDir(dataDir, topic, bp.PartitionID), PartitionMetaFile)); err == nil {
+		return errors.Wrapf(ErrPartitionExists, "%s-%d", topic, bp.PartitionID)
+	}
+	for _, seg := range bp.Segments {
+		name := segmentFilePrefix + "_" + strconv.Itoa(seg.Seq)
+		fi, err := os.Stat(filepath.Join(stagingDir, name+".data"))
+		if err != nil {
+			return errors.Wrapf(ErrInvalidBackup, "partition %d : %v", bp.PartitionID, err)
+		}
+		if fi.Size() != seg.Size {
+			return errors.Wrapf(ErrInvalidBackup, "%s of partition %d has %d bytes, the manifest says %d", name+".data", bp.PartitionID, fi.Size(), seg.Size)
+		}
+	}
+	dir, err := openPartitionDir(dataDir, topic, bp.PartitionID)
+	if err != nil {
+		return err
+	}
+	for _, seg := range bp.Segments {
+		name := segmentFilePrefix + "_" + strconv.Itoa(seg.Seq)
+		for _, ext := range segmentExts {
+			if err := os.Rename(filepath.Join(stagingDir, name+ext), filepath.Join(dir, name+ext)); err != nil {
+				return err
+			}
+		}
+		if !seg.ModTime.IsZero() {
+			if err := os.Chtimes(filepath.Join(dir, name+".data"), seg.ModTime, seg.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	//the records before the log start offset may still be in the first segment
+	if err := writeLogStartOffset(dir, bp.LogStartOffset); err != nil {
+		return err
+	}
+	return os.RemoveAll(stagingDir)
+}
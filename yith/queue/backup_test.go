@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	diskQ, err := NewDiskQueue(dir, "backup", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	for i := 0; i < 2; i++ {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i == 0 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+	if _, err := dq.DeleteRecords(2); err != nil {
+		t.Fatalf("delete records error : %v", err)
+	}
+	snapshot, err := dq.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot error : %v", err)
+	}
+	//neither appends nor retention after the snapshot change the backup
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("after")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if _, err := dq.DeleteRecords(4); err != nil {
+		t.Fatalf("delete records error : %v", err)
+	}
+	manifest := &BackupManifest{
+		Version:    BackupVersion,
+		Topic:      "backup",
+		Partitions: []BackupPartition{NewBackupPartition(1, snapshot)},
+	}
+	var archive bytes.Buffer
+	bw, err := NewBackupWriter(&archive, manifest, &conf.TopicConf{RetentionMs: 1000})
+	if err != nil {
+		t.Fatalf("new backup writer error : %v", err)
+	}
+	if err := bw.WriteSnapshot(1, snapshot); err != nil {
+		t.Fatalf("write snapshot error : %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("close backup writer error : %v", err)
+	}
+	snapshot.Close()
+	dq.Close()
+
+	br, err := NewBackupReader(&archive)
+	if err != nil {
+		t.Fatalf("new backup reader error : %v", err)
+	}
+	if br.TopicConf.RetentionMs != 1000 || len(br.Manifest.Partitions) != 1 || br.Manifest.Partitions[0].LastOffset != 4 {
+		t.Fatalf("backup topic conf %+v manifest %+v", br.TopicConf, br.Manifest)
+	}
+	restoreDir := t.TempDir()
+	stagingDir := RestoreDir(restoreDir, "backup", 1)
+	os.MkdirAll(stagingDir, 0755)
+	for {
+		bf, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read backup error : %v", err)
+		}
+		f, _ := os.Create(filepath.Join(stagingDir, bf.Name))
+		io.Copy(f, bf.Reader)
+		f.Close()
+	}
+	if err := RestorePartition(restoreDir, "backup", br.Manifest.Partitions[0]); err != nil {
+		t.Fatalf("restore partition error : %v", err)
+	}
+	if err := RestorePartition(restoreDir, "backup", br.Manifest.Partitions[0]); err == nil {
+		t.Fatalf("restore over an existing partition succeeded")
+	}
+
+	restored, err := NewDiskQueue(restoreDir, "backup", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("open restored partition error : %v", err)
+	}
+	defer restored.Close()
+	if restored.LogStartOffset() != 2 {
+		t.Fatalf("restored log start offset is %d, want 2", restored.LogStartOffset())
+	}
+	data, err := readRecords(restored.PopFromDisk(2, 10))
+	if err != nil {
+		t.Fatalf("pop restored error : %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 1 || msgs[0].Offset != 2 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+	if baseOffset, _, err := restored.FillToDisk([]*message.Message{{Body: []byte("c")}}); err != nil || baseOffset != 5 {
+		t.Fatalf("fill restored base offset %d error %v", baseOffset, err)
+	}
+}
+
+func TestBackupInvalidTopic(t *testing.T) {
+	var archive bytes.Buffer
+	bw, err := NewBackupWriter(&archive, &BackupManifest{Version: BackupVersion, Topic: "../escape"}, &conf.TopicConf{})
+	if err != nil {
+		t.Fatalf("new backup writer error : %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("close backup writer error : %v", err)
+	}
+	if _, err := NewBackupReader(&archive); errors.Cause(err) != ErrInvalidBackup {
+		t.Fatalf("read backup of an invalid topic error is %v", err)
+	}
+}
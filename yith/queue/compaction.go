@@ -0,0 +1,396 @@
+package queue
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"yithQ/message"
+	. "yithQ/util/logger"
+)
+
+const cleanedSuffix = ".cleaned"
+
+//Compact rewrites the sealed segments so that only the newest record of each key survives,
+//records without key are always kept and offsets never change.
+//A tombstone is removed once its segment is older than delete.retention.ms.
+//The .cleaned segments are built without filesLock, it is only taken to swap them in,
+//a segment deleted or truncated in the meantime keeps its records
+func (dq *diskQueue) Compact() (int, error) {
+	if !dq.cfg.CompactEnabled() {
+		return 0, nil
+	}
+	dq.compactLock.Lock()
+	defer dq.compactLock.Unlock()
+
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	if len(storeFiles) <= 1 {
+		return 0, nil
+	}
+
+	//the newest offset of every key, the writing segment included
+	latest := make(map[string]int64)
+	for _, df := range storeFiles {
+		if df.isLegacy() {
+			continue
+		}
+		err := forEachRecord(df.dataFile, atomic.LoadInt64(&df.size), func(msg *message.Message, record []byte) error {
+			msg, _, err := df.openRecord(msg, record)
+			if err != nil {
+				return err
+			}
+			msgs := []*message.Message{msg}
+			if msg.IsCompressed() {
+				if msgs, err = msg.InnerMessages(); err != nil {
+					return err
+				}
+			}
+			for _, msg := range msgs {
+				if msg.Key != nil {
+					latest[string(msg.Key)] = msg.Offset
+				}
+			}
+			return nil
+		})
+		//deleted by retention while it was read
+		if err != nil && dq.hasFile(df) {
+			return 0, err
+		}
+	}
+
+	cleanedSegments := make([]*cleanedSegment, 0)
+	for _, df := range storeFiles[:len(storeFiles)-1] {
+		if df.isLegacy() {
+			continue
+		}
+		cleaned, err := dq.compactFile(df, latest)
+		if err != nil && !dq.hasFile(df) {
+			continue
+		}
+		if err != nil {
+			for _, cleaned := range cleanedSegments {
+				cleaned.remove()
+			}
+			return 0, err
+		}
+		if cleaned != nil {
+			cleanedSegments = append(cleanedSegments, cleaned)
+		}
+	}
+	if len(cleanedSegments) == 0 {
+		return 0, nil
+	}
+	return dq.swapCleaned(cleanedSegments)
+}
+
+//cleanedSegment is a sealed segment rewritten to .cleaned files, not swapped in yet
+type cleanedSegment struct {
+	df *DiskFile
+	//the size of df it was built from
+	size    int64
+	modTime time.Time
+	removed int
+	//no record survives, the segment is deleted
+	empty bool
+}
+
+//swapCleaned swaps the cleaned segments in for the ones still as they were built from, and returns the records removed
+func (dq *diskQueue) swapCleaned(cleanedSegments []*cleanedSegment) (int, error) {
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	compactedFiles := make([]*DiskFile, len(storeFiles))
+	copy(compactedFiles, storeFiles)
+	obsoleteFiles := make([]*DiskFile, 0)
+	emptyFiles := make([]*DiskFile, 0)
+	removed := 0
+	var swapErr error
+	for _, cleaned := range cleanedSegments {
+		i := indexOfFile(compactedFiles, cleaned.df)
+		//deleted by retention or truncated meanwhile, the writing segment is never compacted
+		if swapErr != nil || i < 0 || i == len(compactedFiles)-1 || atomic.LoadInt64(&cleaned.df.size) != cleaned.size {
+			cleaned.remove()
+			continue
+		}
+		removed += cleaned.removed
+		if cleaned.empty {
+			emptyFiles = append(emptyFiles, cleaned.df)
+			compactedFiles[i] = nil
+			continue
+		}
+		df, err := dq.swapSegment(cleaned)
+		if err != nil {
+			removed -= cleaned.removed
+			swapErr = err
+			continue
+		}
+		Lg.Infof("compact segment(%s) remove %d records", df.dataFile.Name(), cleaned.removed)
+		compactedFiles[i] = df
+		obsoleteFiles = append(obsoleteFiles, cleaned.df)
+	}
+	kept := compactedFiles[:0]
+	for _, df := range compactedFiles {
+		if df != nil {
+			kept = append(kept, df)
+		}
+	}
+	dq.storeFiles.Store(kept)
+
+	for _, df := range obsoleteFiles {
+		df.close()
+	}
+	for _, df := range emptyFiles {
+		if err := df.delete(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, swapErr
+}
+
+func (dq *diskQueue) hasFile(df *DiskFile) bool {
+	return indexOfFile(dq.storeFiles.Load().([]*DiskFile), df) >= 0
+}
+
+func indexOfFile(files []*DiskFile, df *DiskFile) int {
+	for i, f := range files {
+		if f == df {
+			return i
+		}
+	}
+	return -1
+}
+
+//compactFile writes the records of df left to .cleaned files, it returns nil if nothing is removed
+func (dq *diskQueue) compactFile(df *DiskFile, latest map[string]int64) (*cleanedSegment, error) {
+	modTime, err := df.modTime()
+	if err != nil {
+		return nil, err
+	}
+	tombstoneExpired := time.Since(modTime) > time.Duration(dq.cfg.DeleteRetentionMs)*time.Millisecond
+	size := atomic.LoadInt64(&df.size)
+
+	dataPath, indexPath, timeIndexPath := df.dataFile.Name(), df.indexFile.Name(), df.timeIndexFile.Name()
+	cleanedData, err := os.OpenFile(dataPath+cleanedSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanedData.Close()
+	writer := bufio.NewWriterSize(cleanedData, 1<<20)
+	//an encrypted segment keeps its key, the records left are copied as stored
+	if _, err := writer.Write(df.header()); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]byte, 0)
+	timeIndexes := &timeIndexBuilder{}
+	position := int64(SegmentHeaderLen)
+	removed := 0
+	obsolete := func(msg *message.Message) bool {
+		return msg.Key != nil && (latest[string(msg.Key)] != msg.Offset || (msg.IsTombstone() && tombstoneExpired))
+	}
+	write := func(msg *message.Message, record []byte) error {
+		if _, err := writer.Write(record); err != nil {
+			return err
+		}
+		indexes = append(indexes, encodeIndex(msg.Offset, position)...)
+		timeIndexes.add(msg.Timestamp, msg.BaseOffset())
+		position += int64(len(record))
+		return nil
+	}
+	err = forEachRecord(df.dataFile, size, func(stored *message.Message, record []byte) error {
+		msg, _, err := df.openRecord(stored, record)
+		if err != nil {
+			return err
+		}
+		if msg.IsCompressed() {
+			inners, err := msg.InnerMessages()
+			if err != nil {
+				return err
+			}
+			kept := make([]*message.Message, 0, len(inners))
+			for _, inner := range inners {
+				if obsolete(inner) {
+					removed++
+					continue
+				}
+				kept = append(kept, inner)
+			}
+			if len(kept) == 0 {
+				return nil
+			}
+			//the records left are recompressed, one batch per run of contiguous offsets
+			if len(kept) < len(inners) {
+				batches, err := message.CompressRuns(msg.Codec(), kept)
+				if err != nil {
+					return err
+				}
+				for _, batch := range batches {
+					batch.Timestamp = msg.Timestamp
+					sealed, err := df.sealRecord(batch)
+					if err != nil {
+						return err
+					}
+					if err := write(batch, message.EncodeRecord(sealed)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		} else if obsolete(msg) {
+			removed++
+			return nil
+		}
+		return write(msg, record)
+	})
+	cleaned := &cleanedSegment{df: df, size: size, modTime: modTime, removed: removed, empty: len(indexes) == 0}
+	if err != nil || removed == 0 || cleaned.empty {
+		cleaned.remove()
+		if err != nil || removed == 0 {
+			return nil, err
+		}
+		return cleaned, nil
+	}
+
+	if err := writer.Flush(); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := cleanedData.Sync(); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := writeFileSync(indexPath+cleanedSuffix, indexes); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := writeFileSync(timeIndexPath+cleanedSuffix, timeIndexes.entries); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	return cleaned, nil
+}
+
+//swapSegment renames the .cleaned files over the segment and opens it again, the caller holds filesLock.
+//Readers streaming the segment keep the old file, see checkSameFile
+func (dq *diskQueue) swapSegment(cleaned *cleanedSegment) (*DiskFile, error) {
+	df := cleaned.df
+	dataPath, indexPath, timeIndexPath := df.dataFile.Name(), df.indexFile.Name(), df.timeIndexFile.Name()
+	//the data is swapped first, see recoverCompaction
+	if err := os.Rename(dataPath+cleanedSuffix, dataPath); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := os.Rename(indexPath+cleanedSuffix, indexPath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(timeIndexPath+cleanedSuffix, timeIndexPath); err != nil {
+		return nil, err
+	}
+	//keep the age of the segment for retention and the tombstone grace period
+	if err := os.Chtimes(dataPath, cleaned.modTime, cleaned.modTime); err != nil {
+		return nil, err
+	}
+	return newDiskFile(dq.fileNamePrefix, df.seq, true, dq.encryption)
+}
+
+//remove deletes the .cleaned files not swapped in
+func (c *cleanedSegment) remove() {
+	for _, f := range []*os.File{c.df.dataFile, c.df.indexFile, c.df.timeIndexFile} {
+		os.Remove(f.Name() + cleanedSuffix)
+	}
+}
+
+//recoverCompaction finishes or rolls back a compaction interrupted by a crash.
+//A .data.cleaned left means the swap never started, otherwise the indexes left are swapped in
+func recoverCompaction(dir, prefix string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, prefix+"_") || !strings.HasSuffix(name, ".data"+cleanedSuffix) {
+			continue
+		}
+		segment := filepath.Join(dir, strings.TrimSuffix(name, ".data"+cleanedSuffix))
+		Lg.Warnf("compaction of segment(%s) was interrupted before swap, roll it back", segment)
+		for _, ext := range []string{".data", ".index", ".timeindex"} {
+			if err := os.Remove(segment + ext + cleanedSuffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, prefix+"_") || !strings.HasSuffix(name, cleanedSuffix) || strings.HasSuffix(name, ".data"+cleanedSuffix) {
+			continue
+		}
+		cleaned := filepath.Join(dir, name)
+		if _, err := os.Stat(cleaned); os.IsNotExist(err) {
+			continue
+		}
+		Lg.Warnf("compaction of segment(%s) was interrupted during swap, finish it", cleaned)
+		if err := os.Rename(cleaned, strings.TrimSuffix(cleaned, cleanedSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func copyFileSync(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+//forEachRecord decodes the records of a data file up to size
+func forEachRecord(dataFile *os.File, size int64, fn func(msg *message.Message, record []byte) error) error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(dataFile, SegmentHeaderLen, size-SegmentHeaderLen), 1<<20)
+	head := make([]byte, message.RecordLogOverhead)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		_, recordSize, err := message.RecordHead(head)
+		if err != nil {
+			return err
+		}
+		record := make([]byte, recordSize)
+		copy(record, head)
+		if _, err := io.ReadFull(reader, record[message.RecordLogOverhead:]); err != nil {
+			return err
+		}
+		msg, _, err := message.DecodeRecord(record)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg, record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"os"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+//prepareBatch validates the compressed batches of a produce request from their headers,
+//and recompresses the request if compression.type of the topic is not the codec of the producer,
+//only then the batches are decompressed
+func prepareBatch(msgs []*message.Message, compressionType string) ([]*message.Message, error) {
+	for _, msg := range msgs {
+		if !msg.IsCompressed() {
+			continue
+		}
+		if err := msg.CountFromHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if compressionType == "" || compressionType == conf.CompressionTypeProducer {
+		return msgs, nil
+	}
+	codec, err := message.ParseCodec(compressionType)
+	if err != nil {
+		return nil, err
+	}
+	matched := true
+	for _, msg := range msgs {
+		if msg.Codec() != codec {
+			matched = false
+			break
+		}
+	}
+	if matched {
+		return msgs, nil
+	}
+
+	flat := make([]*message.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.IsCompressed() {
+			count := msg.Count
+			inners, err := msg.InnerMessages()
+			if err != nil {
+				return nil, err
+			}
+			if len(inners) != count {
+				return nil, message.ErrInvalidBatch
+			}
+			flat = append(flat, inners...)
+		} else {
+			flat = append(flat, msg)
+		}
+	}
+	if codec == message.CodecNone {
+		for _, msg := range flat {
+			msg.Count = 0
+		}
+		return flat, nil
+	}
+	for i, msg := range flat {
+		msg.Offset = int64(i)
+	}
+	batch, err := message.CompressMessages(codec, flat)
+	if err != nil {
+		return nil, err
+	}
+	return []*message.Message{batch}, nil
+}
+
+//recordBaseOffset is the first offset of a record, a compressed batch is decompressed to find it,
+//an encrypted one holds its offset count in the clear
+func recordBaseOffset(msg *message.Message) (int64, error) {
+	if isEnvelope(msg) && msg.Count == 0 {
+		count, err := envelopeOffsetCount(msg)
+		if err != nil {
+			return 0, err
+		}
+		msg.Count = int(count)
+	}
+	if msg.IsCompressed() && msg.Count == 0 {
+		if _, err := msg.InnerMessages(); err != nil {
+			return 0, err
+		}
+	}
+	return msg.BaseOffset(), nil
+}
+
+//offsetCount is the number of offsets msgs take
+func offsetCount(msgs []*message.Message) int64 {
+	var count int64
+	for _, msg := range msgs {
+		count += msg.OffsetCount()
+	}
+	return count
+}
+
+//readBaseOffset reads the record at position of a data file and returns its first offset
+func readBaseOffset(dataFile *os.File, position int64) (int64, error) {
+	head := make([]byte, message.RecordLogOverhead)
+	if _, err := dataFile.ReadAt(head, position); err != nil {
+		return 0, err
+	}
+	_, recordSize, err := message.RecordHead(head)
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, recordSize)
+	if _, err := dataFile.ReadAt(record, position); err != nil {
+		return 0, err
+	}
+	msg, _, err := message.DecodeRecord(record)
+	if err != nil {
+		return 0, err
+	}
+	return recordBaseOffset(msg)
+}
@@ -2,13 +2,15 @@ package queue
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 	"yithQ/message"
 )
 
 func TestWrite(t *testing.T) {
-	df, err := newDiskFile("topic-partition", 1, false)
+	df, err := newDiskFile("topic-partition", 1, false, nil)
 	if err != nil {
 		t.Fatalf("new disk file error : %v", err)
 	}
@@ -24,7 +26,7 @@ func TestWrite(t *testing.T) {
 	}
 	msgs := make([]*message.Message, 0)
 	msgs = append(msgs, msg1, msg2)
-	_, err = df.write(1, []*message.Message{msg1, msg2})
+	_, err = df.write(1, []*message.Message{msg1, msg2}, DiskFileSizeLimit)
 	if err != nil {
 		t.Fatalf("disk file write %v error %v", msgs, err)
 	}
@@ -34,23 +36,59 @@ func TestWrite(t *testing.T) {
 }
 
 func TestRead(t *testing.T) {
-	df, err := newDiskFile("topic-partition", 1, false)
+	df, err := newDiskFile("topic-partition", 1, false, nil)
 	if err != nil {
 		t.Fatalf("new disk file error : %v", err)
 	}
 	t.Logf("endOffset is %d", df.getEndOffset())
-	byt, err := df.read(1, 2)
+	byt, err := readRecords(df.read(1, 2))
 	if err != nil {
 		t.Fatalf("read msgs from disk file error : %v", err)
 	}
 	t.Logf("length is %d  ,  read bytes is %s", len(byt), string(byt))
-	var msgs []*message.Message
-
-	err = json.Unmarshal([]byte("["+string(byt)+"]"), &msgs)
+	msgs, err := message.DecodeRecords(byt)
 	if err != nil {
-		t.Fatalf("json unmarshal msgs from disk file error : %v", err)
+		t.Fatalf("decode msgs from disk file error : %v", err)
 	}
 	for _, msg := range msgs {
 		t.Logf("read msgs from disk file is %v , body is %s", msg, string(msg.Body))
 	}
 }
+
+func TestReadLegacySegment(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "legacy-1")
+	var legacy []byte
+	for _, body := range []string{"abcde", "fghijk"} {
+		byt, err := json.Marshal(&message.Message{Body: []byte(body), Timestamp: time.Now().UnixNano()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy = append(legacy, append(byt, ',')...)
+	}
+	index := append(encodeIndex(1, 0), encodeIndex(2, int64(len(legacy)/2))...)
+	if err := os.WriteFile(name+"_1.data", legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+"_1.index", index, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	df, err := newDiskFile(name, 1, true, nil)
+	if err != nil {
+		t.Fatalf("new disk file error : %v", err)
+	}
+	if !df.isLegacy() {
+		t.Fatalf("segment without header should be legacy, version is %d", df.version)
+	}
+	byt, err := readRecords(df.read(1, 2))
+	if err != nil {
+		t.Fatalf("read legacy segment error : %v", err)
+	}
+	msgs, err := message.DecodeRecords(byt)
+	if err != nil {
+		t.Fatalf("decode legacy records error : %v", err)
+	}
+	if len(msgs) != 2 || string(msgs[1].Body) != "fghijk" || msgs[1].Offset != 2 {
+		t.Fatalf("read legacy msgs %v", msgs)
+	}
+}
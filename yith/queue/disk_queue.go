@@ -1,68 +1,116 @@
 package queue
 
 import (
-	"encoding/json"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
-	"syscall"
-	"unsafe"
+	"time"
 	"yithQ/message"
-	"yithQ/meta"
+	"yithQ/status"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
 )
 
 type DiskQueue interface {
-	FillToDisk(msg []*message.Message) error
-	PopFromDisk(popOffset int64, amount int) ([]byte, error)
+	//FillToDisk returns the base offset assigned to msgs and the records as stored,
+	//offsets assigned and recompressed by compression.type
+	FillToDisk(msg []*message.Message) (int64, []*message.Message, error)
+	//PopFromDisk returns the records from popOffset on, the caller closes them
+	PopFromDisk(popOffset int64, amount int) (Records, error)
+	//DeleteExpiredSegments deletes the sealed segments out of retention and returns how many were deleted
+	DeleteExpiredSegments() (int, error)
+	//Compact keeps the newest record of each key in the sealed segments and returns how many records were removed
+	Compact() (int, error)
+	//Offload uploads the sealed segments to remote storage and returns how many were uploaded
+	Offload() (int, error)
+	OffsetForTime(timestamp int64) (int64, error)
+	//DeleteRecords hides the records before beforeOffset and returns the new log start offset, see truncate.go
+	DeleteRecords(beforeOffset int64) (int64, error)
+	//TruncateTo removes the records from offset on
+	TruncateTo(offset int64) error
+	//Snapshot returns a point-in-time copy of the log for a backup, the caller closes it
+	Snapshot() (*PartitionSnapshot, error)
+	LogStartOffset() int64
+	//LastOffset is the offset of the last record written, 0 if none was
+	LastOffset() int64
+	//OnAppend sets fn to be called with the records written, offsets assigned, in offset order,
+	//it is set before the first FillToDisk
+	OnAppend(fn func(msgs []*message.Message))
+	Close() error
 }
 
 type diskQueue struct {
 	fileNamePrefix string
-	writingFile    *DiskFile
-	readingFile    *DiskFile
+	cfg            *conf.TopicConf
+	//writingFile and lastFileSeq are owned by the append loop, see appender.go
+	writingFile *DiskFile
+	//filesLock serializes the changes of storeFiles
+	filesLock sync.Mutex
+	//one compaction at a time, it builds the cleaned segments without filesLock
+	compactLock    sync.Mutex
 	storeFiles     atomic.Value //type is  []*DiskFile
 	lastOffset     int64
+	logStartOffset int64
 	lastFileSeq    int
+	appendCh       chan *appendRequest
+	truncateCh     chan *truncateRequest
+	closing        chan struct{}
+	appendDone     chan struct{}
+	flusher        *flusher
+	//nil if the topic is not tiered, see tiered.go
+	remote *remoteLog
+	//nil without a key provider, see encryption.go
+	encryption *encryption
+	//called by the append loop, see OnAppend
+	onAppend func(msgs []*message.Message)
 }
 
-func NewDiskQueue(topicPartitionInfo string) (DiskQueue, error) {
-	fis, err := ioutil.ReadDir("./")
+//NewDiskQueue opens the partition in <dataDir>/<topic>/<partitionID>/, creating it if it does not exist,
+//sealed segments are uploaded to store if remote.storage.enable is set, new segments are encrypted with keys
+//if encryption.enable is set
+func NewDiskQueue(dataDir, topic string, partitionID int, cfg *conf.TopicConf, store ObjectStore, keys KeyProvider) (DiskQueue, error) {
+	enc, err := newEncryption(keys, cfg, topic, partitionID)
 	if err != nil {
 		return nil, err
 	}
-	seqArr := make([]int, 0)
-	for _, fi := range fis {
-		if fi.IsDir() {
-			continue
-		}
-		if strings.Contains(fi.Name(), topicPartitionInfo) && strings.Contains(fi.Name(), ".data") {
-			fileNameArr := strings.Split(strings.TrimSuffix(fi.Name(), ".data"), "_")
-			seq, err := strconv.Atoi(fileNameArr[len(fileNameArr)-1])
-			if err != nil {
-				return nil, err
-			}
-			seqArr = append(seqArr, seq)
-		}
+	dir, err := openPartitionDir(dataDir, topic, partitionID)
+	if err != nil {
+		return nil, err
 	}
-	sort.Ints(seqArr)
+	if err := recoverCompaction(dir, segmentFilePrefix); err != nil {
+		return nil, err
+	}
+	seqArr, err := segmentSeqs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fileNamePrefix := filepath.Join(dir, segmentFilePrefix)
 	storeFiles := make([]*DiskFile, 0)
 	for _, seqNum := range seqArr {
-		diskFile, err := newDiskFile(topicPartitionInfo, seqNum, true)
+		diskFile, err := newDiskFile(fileNamePrefix, seqNum, true, enc)
 		if err != nil {
 			return nil, err
 		}
 		storeFiles = append(storeFiles, diskFile)
 	}
+	if len(storeFiles) != 0 {
+		if err := storeFiles[len(storeFiles)-1].recover(); err != nil {
+			return nil, err
+		}
+	}
 	var lastOffset int64
-	if len(storeFiles) == 0 {
-		lastOffset = 0
-	} else {
-		lastOffset = storeFiles[len(storeFiles)-1].endOffset
+	for i := len(storeFiles) - 1; i >= 0; i-- {
+		if storeFiles[i].getEndOffset() != 0 {
+			lastOffset = storeFiles[i].getEndOffset()
+			break
+		}
 	}
 	var lastSeq int
 	if len(seqArr) == 0 {
@@ -70,79 +118,324 @@ func NewDiskQueue(topicPartitionInfo string) (DiskQueue, error) {
 	} else {
 		lastSeq = seqArr[len(seqArr)-1]
 	}
-	/*writingFile, err := newDiskFile(topicPartitionInfo, lastSeq+1, false)
+	/*writingFile, err := newDiskFile(fileNamePrefix, lastSeq+1, false)
 	if err != nil {
 		return nil, err
 	}
 	storeFiles = append(storeFiles, writingFile)*/
+	//compaction rewrites sealed segments, so compacted topics are never tiered
+	var remote *remoteLog
+	if store != nil && cfg.RemoteStorageEnabled() && !cfg.CompactEnabled() {
+		remote, err = openRemoteLog(store, dir, topic, partitionID, enc)
+		if err != nil {
+			return nil, err
+		}
+		//the local copies may all be deleted, seq and offsets go on after the remote segments
+		if segments := remote.getSegments(); len(segments) != 0 {
+			last := segments[len(segments)-1]
+			if last.Seq > lastSeq {
+				lastSeq = last.Seq
+			}
+			if last.EndOffset > lastOffset {
+				lastOffset = last.EndOffset
+			}
+		}
+	}
+	logStartOffset := lastOffset + 1
+	if len(storeFiles) != 0 && storeFiles[0].getStartOffset() != 0 {
+		logStartOffset = storeFiles[0].getStartOffset()
+	}
+	if remote != nil && len(remote.getSegments()) != 0 {
+		logStartOffset = remote.getSegments()[0].StartOffset
+	}
+	//records deleted by DeleteRecords may still be in the first segment
+	checkpoint, err := readLogStartOffset(dir)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint > logStartOffset {
+		logStartOffset = checkpoint
+	}
+	if logStartOffset-1 > lastOffset {
+		lastOffset = logStartOffset - 1
+	}
 	dq := &diskQueue{
-		fileNamePrefix: topicPartitionInfo,
+		fileNamePrefix: fileNamePrefix,
+		cfg:            cfg,
 		//writingFile:    writingFile,
-		storeFiles:  atomic.Value{},
-		lastOffset:  lastOffset,
-		lastFileSeq: lastSeq,
+		storeFiles:     atomic.Value{},
+		lastOffset:     lastOffset,
+		logStartOffset: logStartOffset,
+		lastFileSeq:    lastSeq,
+		remote:         remote,
+		encryption:     enc,
+		appendCh:       make(chan *appendRequest),
+		truncateCh:     make(chan *truncateRequest),
+		closing:        make(chan struct{}),
+		appendDone:     make(chan struct{}),
 	}
 	dq.storeFiles.Store(storeFiles)
+	dq.flusher = newFlusher(dq)
+	go dq.appendLoop()
 	return dq, nil
 }
 
-func (dq *diskQueue) FillToDisk(msgs []*message.Message) error {
-	if len(dq.storeFiles.Load().([]*DiskFile)) == 0 {
-		writingFile, err := newDiskFile(dq.fileNamePrefix, dq.lastFileSeq+1, false)
-		if err != nil {
-			return err
+//segmentSeqs returns the seq of every segment in the partition dir in order
+func segmentSeqs(dir string) ([]int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seqArr := make([]int, 0)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), segmentFilePrefix+"_") && strings.HasSuffix(fi.Name(), ".data") {
+			seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fi.Name(), segmentFilePrefix+"_"), ".data"))
+			if err != nil {
+				return nil, err
+			}
+			seqArr = append(seqArr, seq)
 		}
-		dq.lastFileSeq++
-		dq.writingFile = writingFile
-		dfs := dq.storeFiles.Load().([]*DiskFile)
-		dfs = append(dfs, writingFile)
-		dq.storeFiles.Store(dfs)
 	}
+	sort.Ints(seqArr)
+	return seqArr, nil
+}
+
+//FillToDisk returns once msgs are as durable as flush.policy requires, the fsync is shared outside of the append loop
+func (dq *diskQueue) FillToDisk(msgs []*message.Message) (int64, []*message.Message, error) {
+	msgs, err := prepareBatch(msgs, dq.cfg.CompressionType)
+	if err != nil {
+		return 0, nil, err
+	}
+	result := dq.append(msgs)
+	if result.err != nil {
+		return 0, nil, result.err
+	}
+	return result.baseOffset, msgs, dq.flusher.written(result.lastOffset, len(msgs))
+}
+
+func (dq *diskQueue) OnAppend(fn func(msgs []*message.Message)) {
+	dq.onAppend = fn
+}
+
+func (dq *diskQueue) fillToDisk(msgs []*message.Message) error {
 	if dq.writingFile == nil {
 		storeFiles := dq.storeFiles.Load().([]*DiskFile)
-		dq.writingFile = storeFiles[len(storeFiles)-1]
+		//never append records to a legacy json segment
+		if len(storeFiles) != 0 && !storeFiles[len(storeFiles)-1].isLegacy() {
+			dq.writingFile = storeFiles[len(storeFiles)-1]
+		} else if err := dq.rollWritingFile(); err != nil {
+			return err
+		}
+	}
+	//segment.ms is checked on append, a partition without appends keeps its writing segment
+	if dq.writingFile.rollDue(time.Now().UnixNano(), dq.cfg.SegmentMs) {
+		if err := dq.rollWritingFile(); err != nil {
+			return err
+		}
 	}
 
-	overflowIndex, err := dq.writingFile.write(dq.getLastOffset()+1, msgs)
+	overflowIndex, err := dq.writingFile.write(dq.getLastOffset()+1, msgs, segmentBytes(dq.cfg))
 	if err != nil {
 		return err
 	}
 	if overflowIndex >= 0 {
-		newSeq := dq.writingFile.seq + 1
-		dq.writingFile, err = newDiskFile(dq.fileNamePrefix, newSeq, false)
-		if err != nil {
+		dq.UpLastOffset(offsetCount(msgs[:overflowIndex]))
+		if err := dq.rollWritingFile(); err != nil {
 			return err
 		}
-		storeFiles := dq.storeFiles.Load().([]*DiskFile)
-		dq.storeFiles.Store(append(storeFiles, dq.writingFile))
-		return dq.FillToDisk(msgs[overflowIndex:])
+		return dq.fillToDisk(msgs[overflowIndex:])
 	}
 
-	dq.UpLastOffset(int64(len(msgs)))
+	dq.UpLastOffset(offsetCount(msgs))
 
 	return nil
 }
 
-func (dq *diskQueue) PopFromDisk(msgOffset int64, amount int) ([]byte, error) {
-	if len(dq.storeFiles.Load().([]*DiskFile)) == 0 || dq.getLastOffset() == 0 {
+func (dq *diskQueue) rollWritingFile() error {
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+	//the flusher only syncs the writing segment, so a sealed one is synced here
+	if dq.writingFile != nil {
+		if dq.cfg.SegmentPreallocateEnabled() {
+			dq.writingFile.releasePreallocated(segmentBytes(dq.cfg))
+		}
+		if err := dq.writingFile.fileSync(); err != nil {
+			return err
+		}
+	}
+	writingFile, err := newDiskFile(dq.fileNamePrefix, dq.lastFileSeq+1, false, dq.encryption)
+	if err != nil {
+		return err
+	}
+	if dq.cfg.SegmentPreallocateEnabled() {
+		writingFile.preallocate(segmentBytes(dq.cfg))
+	}
+	dq.lastFileSeq++
+	dq.writingFile = writingFile
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	dq.storeFiles.Store(append(storeFiles, writingFile))
+	return nil
+}
+
+func (dq *diskQueue) PopFromDisk(msgOffset int64, amount int) (Records, error) {
+	if dq.getLastOffset() == 0 {
 		return nil, ErrNoneMsg
 	}
-	if dq.readingFile == nil {
-		dq.readingFile = findReadingFileByOffset(dq.storeFiles.Load().([]*DiskFile), msgOffset)
+	records, err := dq.popFromSegments(msgOffset, amount)
+	//the segment was deleted by retention or replaced by compaction after the snapshot was loaded
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrNotExist) || err == errSegmentReplaced {
+		records, err = dq.popFromSegments(msgOffset, amount)
 	}
-	if dq.readingFile.getStartOffset() <= msgOffset && dq.readingFile.getEndOffset() >= msgOffset {
-		dq.readingFile = findReadingFileByOffset(dq.storeFiles.Load().([]*DiskFile), msgOffset)
+	return records, err
+}
+
+func (dq *diskQueue) popFromSegments(msgOffset int64, amount int) (Records, error) {
+	//retention moves the log start offset before it drops segments from storeFiles,
+	//so the snapshot is loaded first, otherwise msgOffset could be served from a later segment
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	if msgOffset < dq.LogStartOffset() {
+		return nil, ErrOffsetOutOfRange
+	}
+	if dq.remote != nil && msgOffset < dq.startOffsetOf(storeFiles) {
+		return dq.remote.read(msgOffset, amount)
 	}
+	return readSegments(storeFiles, msgOffset, amount)
+}
 
-	data, err := dq.readingFile.read(msgOffset, amount)
-	if err != nil {
-		if err == io.EOF && msgOffset <= dq.getLastOffset() {
-			dq.readingFile = nil
-			return dq.PopFromDisk(msgOffset, amount)
+//readSegments reads from a snapshot of storeFiles and keeps no state, so any number of consumers read at the same time
+func readSegments(files []*DiskFile, msgOffset int64, amount int) (Records, error) {
+	for i := findSegmentByOffset(files, msgOffset); i < len(files); i++ {
+		records, err := files[i].read(msgOffset, amount)
+		//the records from msgOffset to the end of the segment were compacted away
+		if err == io.EOF {
+			continue
 		}
-		return nil, err
+		return records, err
+	}
+	return nil, ErrNoneMsg
+}
+
+//DeleteExpiredSegments deletes the oldest sealed segments that are older than retention.ms,
+//or whose removal keeps the partition at least retention.bytes large
+func (dq *diskQueue) DeleteExpiredSegments() (int, error) {
+	if !dq.cfg.DeleteEnabled() {
+		return 0, nil
+	}
+	if dq.remote != nil {
+		return dq.deleteTieredSegments()
+	}
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	if len(storeFiles) <= 1 {
+		return 0, nil
+	}
+	var totalSize int64
+	for _, df := range storeFiles {
+		totalSize += atomic.LoadInt64(&df.size)
+	}
+
+	now := time.Now()
+	deleted := 0
+	//the last segment is the writing one and never deleted
+	for _, df := range storeFiles[:len(storeFiles)-1] {
+		size := atomic.LoadInt64(&df.size)
+		modTime, err := df.modTime()
+		if err != nil {
+			return 0, err
+		}
+		if !outOfRetention(now, modTime, size, totalSize, dq.cfg.RetentionMs, dq.cfg.RetentionBytes) {
+			break
+		}
+		totalSize -= size
+		deleted++
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	remainFiles := make([]*DiskFile, len(storeFiles)-deleted)
+	copy(remainFiles, storeFiles[deleted:])
+	//before storeFiles, see popFromSegments
+	dq.advanceLogStartOffset(storeFiles[deleted-1].getEndOffset() + 1)
+	dq.storeFiles.Store(remainFiles)
+
+	for _, df := range storeFiles[:deleted] {
+		if err := df.delete(); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+//outOfRetention is true if the segment is older than retentionMs, or the log stays at least retentionBytes large without it
+func outOfRetention(now time.Time, modTime time.Time, size int64, totalSize int64, retentionMs int64, retentionBytes int64) bool {
+	expired := retentionMs > 0 && now.Sub(modTime) > time.Duration(retentionMs)*time.Millisecond
+	oversize := retentionBytes > 0 && totalSize-size >= retentionBytes
+	return expired || oversize
+}
+
+//syncWritingFile fsyncs the newest segment
+func (dq *diskQueue) syncWritingFile() error {
+	for {
+		storeFiles := dq.storeFiles.Load().([]*DiskFile)
+		if len(storeFiles) == 0 {
+			return nil
+		}
+		df := storeFiles[len(storeFiles)-1]
+		err := df.fileSync()
+		//a truncation replaced the writing segment meanwhile, the new one is synced instead
+		if errors.Is(err, os.ErrClosed) && dq.lastFile() != df {
+			continue
+		}
+		return err
+	}
+}
+
+func (dq *diskQueue) lastFile() *DiskFile {
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	if len(storeFiles) == 0 {
+		return nil
 	}
-	return data, nil
+	return storeFiles[len(storeFiles)-1]
+}
+
+func (dq *diskQueue) Close() error {
+	close(dq.closing)
+	<-dq.appendDone
+	err := dq.flusher.close()
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+	for _, df := range dq.storeFiles.Load().([]*DiskFile) {
+		df.close()
+	}
+	if dq.remote != nil {
+		dq.remote.close()
+	}
+	return err
+}
+
+func (dq *diskQueue) LogStartOffset() int64 {
+	return atomic.LoadInt64(&dq.logStartOffset)
+}
+
+//advanceLogStartOffset moves the log start offset to offset unless it is there or beyond already,
+//the records purged by DeleteRecords are never served again
+func (dq *diskQueue) advanceLogStartOffset(offset int64) {
+	for {
+		current := atomic.LoadInt64(&dq.logStartOffset)
+		if offset <= current || atomic.CompareAndSwapInt64(&dq.logStartOffset, current, offset) {
+			return
+		}
+	}
+}
+
+func (dq *diskQueue) LastOffset() int64 {
+	return dq.getLastOffset()
 }
 
 func (dq *diskQueue) getLastOffset() int64 {
@@ -153,37 +446,55 @@ func (dq *diskQueue) UpLastOffset(delta int64) int64 {
 	return atomic.AddInt64(&dq.lastOffset, delta)
 }
 
-func findReadingFileByOffset(files []*DiskFile, msgOffset int64) *DiskFile {
-	midStoreFile := files[len(files)/2]
-	if midStoreFile.getStartOffset() <= msgOffset && midStoreFile.getEndOffset() >= msgOffset {
-		return midStoreFile
-	} else if midStoreFile.getStartOffset() > msgOffset {
-		return findReadingFileByOffset(files[:len(files)/2], msgOffset)
+//findSegmentByOffset returns the index of the first file whose endOffset >= msgOffset, len(files) if msgOffset is beyond all files
+func findSegmentByOffset(files []*DiskFile, msgOffset int64) int {
+	//a writing file just rolled is empty, its endOffset 0 would break the search
+	n := len(files)
+	if n != 0 && files[n-1].getEndOffset() == 0 {
+		n--
+	}
+	i := sort.Search(n, func(i int) bool {
+		return files[i].getEndOffset() >= msgOffset
+	})
+	if i == n {
+		return len(files)
 	}
-	return findReadingFileByOffset(files[len(files)/2:], msgOffset)
+	return i
 }
 
+//DiskFileSizeLimit is the largest segment.bytes
 const DiskFileSizeLimit = 1024 * 1024 * 1024
 const EachIndexLen = 39
 
-var pagesize int64 = int64(syscall.Getpagesize())
+//the .index reserved for a preallocated segment, its entries depend on the record sizes so it is only a hint
+const indexPreallocateBytes = 10 * 1024 * 1024
 
 var ErrMsgTooLarge error = errors.New("message too large")
 var ErrNoneMsg error = errors.New("none message")
+var ErrOffsetOutOfRange error = errors.New(status.OffsetOutOfRange)
 
 type DiskFile struct {
-	startOffset int64
-	endOffset   int64
-	indexFile   *os.File
-	dataFile    *os.File
-	size        int64
+	startOffset   int64
+	endOffset     int64
+	indexFile     *os.File
+	timeIndexFile *os.File
+	dataFile      *os.File
+	size          int64
+	maxTimestamp  int64
 	//Diskfile的编号，diskfile命名规则：topicPartition+seq
-	seq    int
-	isFull bool
+	seq     int
+	isFull  bool
+	version uint16
+	//nil if the segment is not encrypted
+	cipher *segmentCipher
+	//segment.ms counts from the later of the first record timestamp and the creation of the segment,
+	//so records produced with old timestamps do not roll a segment each
+	rollTimestamp int64
 }
 
-func newDiskFile(name string, seq int, isFull bool) (*DiskFile, error) {
-	dataf, err := os.OpenFile(name+"_"+strconv.Itoa(seq)+".data", os.O_RDWR|os.O_CREATE, 0644)
+//newDiskFile opens the segment seq, a new one is encrypted if enc is enabled
+func newDiskFile(name string, seq int, isFull bool, enc *encryption) (*DiskFile, error) {
+	dataf, err := os.OpenFile(name+"_"+strconv.Itoa(seq)+".data", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -196,110 +507,329 @@ func newDiskFile(name string, seq int, isFull bool) (*DiskFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	var version uint16
+	var segmentCipher *segmentCipher
+	var rollTimestamp int64
+	if dataFileSize < SegmentHeaderLen {
+		rollTimestamp = time.Now().UnixNano()
+		if dataFileSize != 0 {
+			Lg.Warnf("segment(%s) has a torn header of %d bytes, rewrite it", dataf.Name(), dataFileSize)
+			if err := dataf.Truncate(0); err != nil {
+				return nil, err
+			}
+		}
+		if segmentCipher, err = enc.newSegmentCipher(seq); err != nil {
+			return nil, err
+		}
+		header := encodeSegmentHeader(SegmentVersionV1)
+		version = SegmentVersionV1
+		if segmentCipher != nil {
+			header = segmentCipher.header()
+			version = SegmentVersionV2
+		}
+		if _, err := dataf.Write(header); err != nil {
+			return nil, err
+		}
+		dataFileSize = SegmentHeaderLen
+	} else {
+		header, err := readSegmentHeader(dataf, dataFileSize)
+		if err != nil {
+			return nil, err
+		}
+		version = header.version
+		if header.encrypted() {
+			if segmentCipher, err = enc.openSegmentCipher(header, seq); err != nil {
+				return nil, errors.Wrap(err, dataf.Name())
+			}
+		}
+	}
+	timeIndexf, firstTimestamp, maxTimestamp, err := openTimeIndex(name, seq)
+	if err != nil {
+		return nil, err
+	}
 	var startOffset, endOffset int64
 	fi, _ := indexf.Stat()
 	if fi.Size() >= EachIndexLen {
-		dataRef, err := syscall.Mmap(int(indexf.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
-		if err != nil {
+		index := make([]byte, EachIndexLen)
+		if _, err := indexf.ReadAt(index, 0); err != nil {
 			return nil, err
 		}
-		startOffset, _ = decodeIndex(dataRef[:EachIndexLen])
-		endOffset, _ = decodeIndex(dataRef[len(dataRef)-EachIndexLen:])
+		var startPosition int64
+		startOffset, startPosition = decodeIndex(index)
+		if _, err := indexf.ReadAt(index, fi.Size()-EachIndexLen); err != nil {
+			return nil, err
+		}
+		endOffset, _ = decodeIndex(index)
+		//a compressed batch is indexed by its last offset
+		if version != legacySegmentVersion {
+			if baseOffset, err := readBaseOffset(dataf, startPosition); err == nil {
+				startOffset = baseOffset
+			}
+		}
 	}
 	return &DiskFile{
-		startOffset: startOffset,
-		endOffset:   endOffset,
-		size:        dataFileSize,
-		indexFile:   indexf,
-		dataFile:    dataf,
-		seq:         seq,
-		isFull:      isFull,
+		startOffset:   startOffset,
+		endOffset:     endOffset,
+		size:          dataFileSize,
+		indexFile:     indexf,
+		timeIndexFile: timeIndexf,
+		dataFile:      dataf,
+		maxTimestamp:  maxTimestamp,
+		seq:           seq,
+		isFull:        isFull,
+		version:       version,
+		cipher:        segmentCipher,
+		rollTimestamp: maxInt64(rollTimestamp, firstTimestamp),
 	}, nil
 }
 
 //write batch
-//batchStartOffset=lastOffset+1
-func (df *DiskFile) write(batchStartOffset int64, msgs []*message.Message) (int, error) {
+//batchStartOffset=lastOffset+1, a compressed batch takes its offset count and is indexed by its last offset.
+//The index of the first record beyond segmentBytes is returned, -1 if all are written
+func (df *DiskFile) write(batchStartOffset int64, msgs []*message.Message, segmentBytes int64) (int, error) {
 
 	dataFileSize := atomic.LoadInt64(&df.size)
 
-	var cursor int64 = 0
+	records := make([]byte, 0)
+	indexes := make([]byte, 0, len(msgs)*EachIndexLen)
+	timeIndexes := &timeIndexBuilder{maxTimestamp: df.getMaxTimestamp()}
+	overflowIndex := -1
+	now := time.Now().UnixNano()
+	nextOffset := batchStartOffset
 	for i, msg := range msgs {
-		byt, err := json.Marshal(msg)
+		msg.Offset = nextOffset + msg.OffsetCount() - 1
+		if msg.Timestamp == 0 {
+			msg.Timestamp = now
+		}
+		stored, err := df.sealRecord(msg)
 		if err != nil {
 			return -1, err
 		}
+		recordSize := int64(stored.RecordSize())
 
-		if len(byt) > DiskFileSizeLimit {
+		if recordSize > DiskFileSizeLimit {
 			return -1, ErrMsgTooLarge
 		}
 
-		if int64(len(byt))+atomic.LoadInt64(&df.size)+int64(cursor) > DiskFileSizeLimit {
+		//a record larger than segment.bytes goes to an empty segment of its own
+		if dataFileSize+int64(len(records)) > SegmentHeaderLen && recordSize+dataFileSize+int64(len(records)) > segmentBytes {
 			df.isFull = true
-			return i, nil
+			overflowIndex = i
+			break
 		}
 
-		byt = []byte(string(byt) + ",")
-		//copy(dataRef[cursor+pageOffset:], byt)
-		if _, err := df.dataFile.Write(byt); err != nil {
-			return -1, err
-		}
-
-		if _, err := df.indexFile.Write(encodeIndex(batchStartOffset+int64(i), dataFileSize+cursor)); err != nil {
-			return -1, err
-		}
-		cursor += int64(len(byt))
-		atomic.AddInt64(&df.size, int64(len(byt)))
+		indexes = append(indexes, encodeIndex(msg.Offset, dataFileSize+int64(len(records)))...)
+		timeIndexes.add(msg.Timestamp, msg.BaseOffset())
+		records = message.AppendRecord(records, stored)
+		nextOffset = msg.Offset + 1
+	}
+	if len(records) == 0 {
+		return overflowIndex, nil
 	}
 
-	if err := df.fileSync(); err != nil {
+	if _, err := df.dataFile.Write(records); err != nil {
 		return -1, err
 	}
+	if _, err := df.indexFile.Write(indexes); err != nil {
+		return -1, err
+	}
+	if _, err := df.timeIndexFile.Write(timeIndexes.entries); err != nil {
+		return -1, err
+	}
+	atomic.AddInt64(&df.size, int64(len(records)))
+	atomic.StoreInt64(&df.maxTimestamp, timeIndexes.maxTimestamp)
 
-	if dataFileSize == 0 {
+	if dataFileSize == SegmentHeaderLen {
 		atomic.StoreInt64(&df.startOffset, batchStartOffset)
+		df.rollTimestamp = maxInt64(df.rollTimestamp, msgs[0].Timestamp)
 	}
-	//atomic.StoreInt64(&df.size, dataFileSize+cursor)
 
-	atomic.StoreInt64(&df.endOffset, batchStartOffset+int64(len(msgs))-1)
+	atomic.StoreInt64(&df.endOffset, nextOffset-1)
 
-	return -1, nil
+	return overflowIndex, nil
 }
 
-func (df *DiskFile) read(msgOffset int64, count int) ([]byte, error) {
-	var startOffset, endOffset int64
-	var err error
-
-	startPositionInIndexFile := (msgOffset - df.getStartOffset()) * EachIndexLen
-
-	startOffset, err = df.getDatafilePosition(startPositionInIndexFile)
+//read returns the records from msgOffset on, a section of the data file streamed to the consumer
+func (df *DiskFile) read(msgOffset int64, count int) (Records, error) {
+	firstOffset, startPosition, endPosition, err := df.readPosition(msgOffset, count)
 	if err != nil {
 		return nil, err
 	}
-
-	var endPositionInIndexFile int64
-	if msgOffset+int64(count)-1 < df.getEndOffset() {
-		endPositionInIndexFile = (msgOffset - df.getStartOffset() + int64(count)) * EachIndexLen
-		endOffset, err = df.getDatafilePosition(endPositionInIndexFile)
+	if df.isLegacy() {
+		//legacy json records are re-encoded, so they are read into memory
+		data := make([]byte, endPosition-startPosition)
+		if _, err := df.dataFile.ReadAt(data, startPosition); err != nil {
+			return nil, err
+		}
+		//strip the trailing ','
+		records, err := convertLegacyRecords(data[:len(data)-1], firstOffset)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		endOffset = atomic.LoadInt64(&df.size)
+		return bufferRecords(records), nil
 	}
+	if df.cipher != nil {
+		//encrypted records are opened in memory, they can not be sent with sendfile
+		data := make([]byte, endPosition-startPosition)
+		if _, err := df.dataFile.ReadAt(data, startPosition); err != nil {
+			return nil, err
+		}
+		records, err := df.cipher.openRecords(data)
+		if err != nil {
+			return nil, err
+		}
+		return bufferRecords(records), nil
+	}
+	return newFileRecords(df.dataFile, startPosition, endPosition-startPosition)
+}
+
+//sealRecord returns msg as stored, msg itself if the segment is not encrypted
+func (df *DiskFile) sealRecord(msg *message.Message) (*message.Message, error) {
+	if df.cipher == nil {
+		return msg, nil
+	}
+	return df.cipher.seal(msg)
+}
+
+//openRecord returns a record as produced and its record encoding, msg itself if the segment is not encrypted
+func (df *DiskFile) openRecord(msg *message.Message, record []byte) (*message.Message, []byte, error) {
+	if df.cipher == nil {
+		return msg, record, nil
+	}
+	return df.cipher.open(msg)
+}
+
+//header is the segment header of the data file
+func (df *DiskFile) header() []byte {
+	if df.cipher != nil {
+		return df.cipher.header()
+	}
+	return encodeSegmentHeader(df.version)
+}
 
-	dataRef, err := syscall.Mmap(int(df.dataFile.Fd()), startOffset, int(endOffset-startOffset-1), syscall.PROT_READ, syscall.MAP_PRIVATE)
+//readPosition returns the first offset at or after msgOffset and the data file range of count offsets from it
+func (df *DiskFile) readPosition(msgOffset int64, count int) (firstOffset int64, startPosition int64, endPosition int64, err error) {
+	entries, err := df.indexEntries()
 	if err != nil {
-		return nil, err
+		return
+	}
+	//offsets of a compacted segment are not contiguous, so search the index instead of computing the entry
+	startEntry, err := df.searchIndex(msgOffset, entries)
+	if err != nil {
+		return
+	}
+	if startEntry == entries {
+		err = io.EOF
+		return
+	}
+	firstOffset, startPosition, err = df.readIndex(startEntry)
+	if err != nil {
+		return
 	}
 
-	err = madvise(dataRef, syscall.MADV_SEQUENTIAL)
+	endPosition = atomic.LoadInt64(&df.size)
+	endEntry, err := df.searchIndex(msgOffset+int64(count), entries)
 	if err != nil {
-		return nil, err
+		return
 	}
+	//a compressed batch is indexed by its last offset, it is served whole even if it goes beyond count
+	if endEntry == startEntry {
+		endEntry++
+	}
+	if endEntry < entries {
+		_, endPosition, err = df.readIndex(endEntry)
+	}
+	return
+}
 
-	return dataRef, nil
+func (df *DiskFile) modTime() (time.Time, error) {
+	fi, err := df.dataFile.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
 
+func (df *DiskFile) close() {
+	df.dataFile.Close()
+	df.indexFile.Close()
+	df.timeIndexFile.Close()
+}
+
+//delete closes and removes the .data, .index and .timeindex files of the segment
+func (df *DiskFile) delete() error {
+	df.close()
+	if err := os.Remove(df.dataFile.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(df.indexFile.Name()); err != nil {
+		return err
+	}
+	return os.Remove(df.timeIndexFile.Name())
+}
+
+func (df *DiskFile) isLegacy() bool {
+	return df.version == legacySegmentVersion
+}
+
+//rollDue is true once the records of the segment are segmentMs old, never if segmentMs <= 0
+func (df *DiskFile) rollDue(now int64, segmentMs int64) bool {
+	if segmentMs <= 0 || atomic.LoadInt64(&df.size) <= SegmentHeaderLen {
+		return false
+	}
+	return now-df.rollTimestamp >= segmentMs*int64(time.Millisecond)
+}
+
+//preallocate reserves segmentBytes for the data file and a part of it for the index,
+//it is only a hint against fragmentation, so a file system without fallocate is logged and ignored
+func (df *DiskFile) preallocate(segmentBytes int64) {
+	if err := fallocate(df.dataFile, 0, segmentBytes); err != nil {
+		Lg.Warnf("preallocate segment(%s) error : %v", df.dataFile.Name(), err)
+		return
+	}
+	if err := fallocate(df.indexFile, 0, minInt64(segmentBytes, indexPreallocateBytes)); err != nil {
+		Lg.Warnf("preallocate index(%s) error : %v", df.indexFile.Name(), err)
+	}
+}
+
+//releasePreallocated frees the blocks reserved beyond the records of a sealed segment
+func (df *DiskFile) releasePreallocated(segmentBytes int64) {
+	if size := atomic.LoadInt64(&df.size); size < segmentBytes {
+		if err := releaseBlocks(df.dataFile, size, segmentBytes-size); err != nil {
+			Lg.Warnf("release preallocated blocks of segment(%s) error : %v", df.dataFile.Name(), err)
+		}
+	}
+	fi, err := df.indexFile.Stat()
+	if err != nil {
+		return
+	}
+	if indexBytes := minInt64(segmentBytes, indexPreallocateBytes); fi.Size() < indexBytes {
+		if err := releaseBlocks(df.indexFile, fi.Size(), indexBytes-fi.Size()); err != nil {
+			Lg.Warnf("release preallocated blocks of index(%s) error : %v", df.indexFile.Name(), err)
+		}
+	}
+}
+
+//segmentBytes is segment.bytes, DiskFileSizeLimit if it is not set or larger
+func segmentBytes(cfg *conf.TopicConf) int64 {
+	if cfg.SegmentBytes <= 0 || cfg.SegmentBytes > DiskFileSizeLimit {
+		return DiskFileSizeLimit
+	}
+	return cfg.SegmentBytes
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 func (df *DiskFile) fileSync() error {
@@ -309,17 +839,42 @@ func (df *DiskFile) fileSync() error {
 	if err := df.indexFile.Sync(); err != nil {
 		return err
 	}
+	if err := df.timeIndexFile.Sync(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (df *DiskFile) getDatafilePosition(positionInIndexFile int64) (offset int64, err error) {
+func (df *DiskFile) indexEntries() (int64, error) {
+	fi, err := df.indexFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size() / EachIndexLen, nil
+}
+
+//searchIndex returns the first index entry whose offset >= msgOffset, entries if there is none
+func (df *DiskFile) searchIndex(msgOffset int64, entries int64) (int64, error) {
+	var searchErr error
+	i := sort.Search(int(entries), func(i int) bool {
+		offset, _, err := df.readIndex(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return offset >= msgOffset
+	})
+	return int64(i), searchErr
+}
+
+func (df *DiskFile) readIndex(entry int64) (msgOffset int64, position int64, err error) {
 	index := make([]byte, EachIndexLen)
-	_, err = df.indexFile.ReadAt(index, positionInIndexFile)
+	_, err = df.indexFile.ReadAt(index, entry*EachIndexLen)
 	if err != nil {
 		return
 	}
 
-	_, offset = decodeIndex(index)
+	msgOffset, position = decodeIndex(index)
 	return
 }
 
@@ -355,61 +910,3 @@ func dataFileSize(f *os.File) (int64, error) {
 	}
 	return fi.Size(), nil
 }
-
-func PickupTopicInfoFromDisk() ([]meta.TopicMetadata, error) {
-	fis, err := ioutil.ReadDir("./")
-	if err != nil {
-		return nil, err
-	}
-
-	topicInfoMap := make(map[string]int64)
-	for _, fi := range fis {
-		if fi.IsDir() {
-			continue
-		}
-		if strings.Contains(fi.Name(), ".data") {
-			file, err := os.Open(fi.Name())
-			if err != nil {
-				return nil, err
-			}
-			fileNameArr := strings.Split(strings.TrimSuffix(fi.Name(), ".data"), "_")
-			var topicPartition string
-			for _, finame := range fileNameArr[:len(fileNameArr)-1] {
-				topicPartition += finame
-			}
-			dataFileSize, err := dataFileSize(file)
-			if err != nil {
-				return nil, err
-			}
-			topicInfoMap[topicPartition] += dataFileSize
-		}
-	}
-
-	topicInfos := make([]meta.TopicMetadata, 0)
-
-	for topicPartition, size := range topicInfoMap {
-		tp := strings.Split(topicPartition, "-")
-		partitionID, err := strconv.Atoi(tp[len(tp)-1])
-		if err != nil {
-			return nil, err
-		}
-		var topic string
-		for _, t := range tp[:len(tp)-1] {
-			topic += t
-		}
-		topicInfos = append(topicInfos, meta.TopicMetadata{
-			Topic:       topic,
-			PartitionID: partitionID,
-			Size:        size,
-		})
-	}
-	return topicInfos, nil
-}
-
-func madvise(b []byte, advice int) (err error) {
-	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(advice))
-	if e1 != 0 {
-		err = e1
-	}
-	return
-}
@@ -2,13 +2,28 @@ package queue
 
 import (
 	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"yithQ/message"
+	"yithQ/meta"
+	"yithQ/util/logger"
+	"yithQ/yith/conf"
 )
 
+func TestMain(m *testing.M) {
+	logger.NewLogger(os.Stdout, "debug")
+	os.Exit(m.Run())
+}
+
 func TestFillToDisk(t *testing.T) {
-	diskQ, err := NewDiskQueue("topic-partition")
+	diskQ, err := NewDiskQueue(".", "topic", 0, &conf.TopicConf{}, nil, nil)
 	if err != nil {
 		t.Fatalf("new disk queue error : %v", err)
 	}
@@ -22,7 +37,7 @@ func TestFillToDisk(t *testing.T) {
 		Body:      []byte("fghijk"),
 		Timestamp: time.Now().UnixNano(),
 	}
-	err = diskQ.FillToDisk([]*message.Message{msg1, msg2})
+	_, _, err = diskQ.FillToDisk([]*message.Message{msg1, msg2})
 	if err != nil {
 		t.Fatalf("fill to disk error : %v", err)
 	}
@@ -30,20 +45,1187 @@ func TestFillToDisk(t *testing.T) {
 }
 
 func TestPopFromDisk(t *testing.T) {
-	diskQ, err := NewDiskQueue("topic-partition")
+	diskQ, err := NewDiskQueue(".", "topic", 0, &conf.TopicConf{}, nil, nil)
 	if err != nil {
 		t.Fatalf("new disk queue error : %v", err)
 	}
-	data, err := diskQ.PopFromDisk(1)
+	data, err := readRecords(diskQ.PopFromDisk(1, 2))
 	if err != nil {
 		t.Fatalf("pop from disk error %v", err)
 	}
-	var msgs []*message.Message
-	err = json.Unmarshal([]byte("["+string(data)+"]"), &msgs)
+	msgs, err := message.DecodeRecords(data)
 	if err != nil {
-		t.Fatalf("json unmarshal %s error %v", string(data), err)
+		t.Fatalf("decode %v error %v", data, err)
 	}
 	for _, msg := range msgs {
 		t.Logf("msg (%d) is %s", msg.ID, string(msg.Body))
 	}
 }
+
+func TestRecoverTornWrite(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "recover", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	msgs := []*message.Message{
+		{Body: []byte("abcde"), Timestamp: time.Now().UnixNano()},
+		{Body: []byte("fghijk"), Timestamp: time.Now().UnixNano()},
+		{Body: []byte("lmnopq"), Timestamp: time.Now().UnixNano()},
+	}
+	if _, _, err := diskQ.FillToDisk(msgs); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	fi, _ := os.Stat("recover/1/segment_1.data")
+	validSize := fi.Size()
+
+	//crash in the middle of the next write: half a record in .data, its entry already in .index
+	torn := message.EncodeRecord(&message.Message{Offset: 4, Body: []byte("torn")})
+	dataf, _ := os.OpenFile("recover/1/segment_1.data", os.O_WRONLY|os.O_APPEND, 0644)
+	dataf.Write(torn[:len(torn)/2])
+	dataf.Close()
+	indexf, _ := os.OpenFile("recover/1/segment_1.index", os.O_WRONLY|os.O_APPEND, 0644)
+	indexf.Write(encodeIndex(4, validSize))
+	indexf.Close()
+
+	diskQ, err = NewDiskQueue(".", "recover", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	if lastOffset := diskQ.(*diskQueue).getLastOffset(); lastOffset != 3 {
+		t.Fatalf("last offset after recovery is %d, want 3", lastOffset)
+	}
+	if fi, _ := os.Stat("recover/1/segment_1.data"); fi.Size() != validSize {
+		t.Fatalf("data file size after recovery is %d, want %d", fi.Size(), validSize)
+	}
+	if fi, _ := os.Stat("recover/1/segment_1.index"); fi.Size() != 3*EachIndexLen {
+		t.Fatalf("index file size after recovery is %d, want %d", fi.Size(), 3*EachIndexLen)
+	}
+	data, err := readRecords(diskQ.PopFromDisk(1, 10))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	recovered, err := message.DecodeRecords(data)
+	if err != nil || len(recovered) != 3 {
+		t.Fatalf("decode recovered msgs %v error %v", recovered, err)
+	}
+}
+
+func TestDeleteExpiredSegments(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "retention", 1, &conf.TopicConf{RetentionBytes: 1}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	for i := 0; i < 3; i++ {
+		msgs := []*message.Message{
+			{Body: []byte("abcde"), Timestamp: time.Now().UnixNano()},
+			{Body: []byte("fghijk"), Timestamp: time.Now().UnixNano()},
+		}
+		if _, _, err := dq.FillToDisk(msgs); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i < 2 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+
+	deleted, err := dq.DeleteExpiredSegments()
+	if err != nil {
+		t.Fatalf("delete expired segments error : %v", err)
+	}
+	if deleted != 2 {
+		t.Fatalf("deleted %d segments, want 2", deleted)
+	}
+	if dq.LogStartOffset() != 5 {
+		t.Fatalf("log start offset is %d, want 5", dq.LogStartOffset())
+	}
+	if _, err := os.Stat("retention/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("expired segment still exists : %v", err)
+	}
+	if _, err := readRecords(dq.PopFromDisk(1, 2)); err != ErrOffsetOutOfRange {
+		t.Fatalf("pop deleted offset error is %v", err)
+	}
+	data, err := readRecords(dq.PopFromDisk(5, 2))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 || msgs[0].Offset != 5 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+}
+
+func TestSegmentRoll(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	recordSize := int64((&message.Message{Body: []byte("abcde")}).RecordSize())
+	preallocate := true
+	cfg := &conf.TopicConf{SegmentBytes: SegmentHeaderLen + 2*recordSize, SegmentPreallocate: &preallocate}
+	diskQ, err := NewDiskQueue(".", "roll", 1, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	msgs := make([]*message.Message, 0)
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, &message.Message{Body: []byte("abcde")})
+	}
+	if _, _, err := dq.FillToDisk(msgs); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	//a record larger than segment.bytes takes an empty segment
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: make([]byte, 3*recordSize)}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	wantEnds := []int64{2, 4, 5, 6}
+	if len(storeFiles) != len(wantEnds) {
+		t.Fatalf("%d segments, want %d", len(storeFiles), len(wantEnds))
+	}
+	for i, df := range storeFiles {
+		if df.getEndOffset() != wantEnds[i] {
+			t.Fatalf("segment %d ends at %d, want %d", i, df.getEndOffset(), wantEnds[i])
+		}
+	}
+	//preallocated blocks do not change the size of the files
+	if fi, err := os.Stat("roll/1/segment_1.data"); err != nil || fi.Size() != SegmentHeaderLen+2*recordSize {
+		t.Fatalf("stat preallocated segment %v error %v", fi, err)
+	}
+	if fi, err := os.Stat("roll/1/segment_1.index"); err != nil || fi.Size() != 2*EachIndexLen {
+		t.Fatalf("stat preallocated index %v error %v", fi, err)
+	}
+	if msgs, err := popMsgs(dq, 3, 2); err != nil || len(msgs) != 2 || msgs[0].Offset != 3 {
+		t.Fatalf("pop msgs %v error %v", msgs, err)
+	}
+	dq.Close()
+
+	//segment.ms rolls a segment of a low-volume topic, so retention deletes it
+	diskQ, err = NewDiskQueue(".", "roll", 2, &conf.TopicConf{SegmentMs: 1, RetentionBytes: 1}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq = diskQ.(*diskQueue)
+	//an old timestamp does not make the segment old
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("a"), Timestamp: 1}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if dq.writingFile.rollDue(time.Now().UnixNano(), dq.cfg.SegmentMs) {
+		t.Fatalf("segment with an old record timestamp is due to roll at once")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("b")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if n := len(dq.storeFiles.Load().([]*DiskFile)); n != 2 {
+		t.Fatalf("%d segments after segment.ms, want 2", n)
+	}
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 1 {
+		t.Fatalf("delete expired segments %d error %v", deleted, err)
+	}
+	dq.Close()
+}
+
+func TestCompact(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "compact", 1, &conf.TopicConf{CleanupPolicy: conf.CleanupPolicyCompact, DeleteRetentionMs: 3600 * 1000}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	batches := [][]*message.Message{
+		{
+			{Key: []byte("k1"), Body: []byte("v1")},
+			{Key: []byte("k2"), Body: []byte("v1")},
+			{Key: []byte("k1"), Body: []byte("v2")},
+		},
+		{
+			{Key: []byte("k2"), Body: []byte{}},
+			{Key: []byte("k3"), Body: []byte("v1")},
+			{Body: []byte("no key")},
+		},
+		{
+			{Key: []byte("k1"), Body: []byte("v3")},
+		},
+	}
+	for i, msgs := range batches {
+		if _, _, err := dq.FillToDisk(msgs); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i < len(batches)-1 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+
+	removed, err := dq.Compact()
+	if err != nil {
+		t.Fatalf("compact error : %v", err)
+	}
+	if removed != 3 {
+		t.Fatalf("compact removed %d records, want 3", removed)
+	}
+	if _, err := os.Stat("compact/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("fully compacted segment still exists : %v", err)
+	}
+
+	data, err := readRecords(dq.PopFromDisk(1, 10))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	msgs, err := message.DecodeRecords(data)
+	if err != nil {
+		t.Fatalf("decode msgs error %v", err)
+	}
+	//the tombstone of k2 is in its grace period
+	wantOffsets := []int64{4, 5, 6}
+	if len(msgs) != len(wantOffsets) {
+		t.Fatalf("pop %d msgs after compaction, want %d", len(msgs), len(wantOffsets))
+	}
+	for i, msg := range msgs {
+		if msg.Offset != wantOffsets[i] {
+			t.Fatalf("msg %d offset is %d, want %d", i, msg.Offset, wantOffsets[i])
+		}
+	}
+	if !msgs[0].IsTombstone() {
+		t.Fatalf("msg at offset 4 should be the tombstone of k2, is %v", msgs[0])
+	}
+
+	data, err = readRecords(dq.PopFromDisk(7, 10))
+	if err != nil {
+		t.Fatalf("pop from writing file error %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 1 || string(msgs[0].Body) != "v3" {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+
+	dq.cfg.DeleteRetentionMs = -1
+	if removed, err := dq.Compact(); err != nil || removed != 1 {
+		t.Fatalf("compact expired tombstone removed %d error %v", removed, err)
+	}
+}
+
+//a segment deleted while its cleaned copy is built is not swapped in
+func TestCompactDeletedSegment(t *testing.T) {
+	diskQ, err := NewDiskQueue(t.TempDir(), "compact", 1, &conf.TopicConf{CleanupPolicy: conf.CleanupPolicyCompact}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	for _, body := range []string{"v1", "v2"} {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Key: []byte("k1"), Body: []byte(body)}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if err := dq.rollWritingFile(); err != nil {
+			t.Fatalf("roll writing file error : %v", err)
+		}
+	}
+	first := dq.storeFiles.Load().([]*DiskFile)[0]
+	cleaned, err := dq.compactFile(first, map[string]int64{"k1": 2})
+	if err != nil || cleaned == nil || !cleaned.empty {
+		t.Fatalf("compact file %+v error %v", cleaned, err)
+	}
+	if _, err := dq.DeleteRecords(2); err != nil || dq.hasFile(first) {
+		t.Fatalf("delete records error %v, first segment kept %v", err, dq.hasFile(first))
+	}
+	if removed, err := dq.swapCleaned([]*cleanedSegment{cleaned}); err != nil || removed != 0 {
+		t.Fatalf("swap cleaned removed %d error %v", removed, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dq.fileNamePrefix), "*"+cleanedSuffix)); len(matches) != 0 {
+		t.Fatalf("cleaned files left %v", matches)
+	}
+}
+
+func TestOffsetForTime(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "time", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	if _, _, err := dq.FillToDisk([]*message.Message{
+		{Body: []byte("a"), Timestamp: 100},
+		{Body: []byte("b"), Timestamp: 200},
+		{Body: []byte("c"), Timestamp: 200},
+		{Body: []byte("d"), Timestamp: 150},
+		{Body: []byte("e"), Timestamp: 300},
+	}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if err := dq.rollWritingFile(); err != nil {
+		t.Fatalf("roll writing file error : %v", err)
+	}
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("f"), Timestamp: 400}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+
+	check := func(dq DiskQueue) {
+		cases := map[int64]int64{50: 1, 150: 2, 200: 2, 250: 5, 350: 6, 500: 7}
+		for timestamp, want := range cases {
+			offset, err := dq.OffsetForTime(timestamp)
+			if err != nil {
+				t.Fatalf("offset for time(%d) error : %v", timestamp, err)
+			}
+			if offset != want {
+				t.Fatalf("offset for time(%d) is %d, want %d", timestamp, offset, want)
+			}
+		}
+	}
+	check(dq)
+
+	//the time index of the last segment is rebuilt on reopen
+	os.Truncate("time/1/segment_2.timeindex", 0)
+	diskQ, err = NewDiskQueue(".", "time", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	check(diskQ)
+}
+
+func TestFlushPolicy(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	//concurrent batches are all synced before they return
+	diskQ, err := NewDiskQueue(".", "flush", 1, &conf.TopicConf{FlushPolicy: conf.FlushPolicyBatch}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+				t.Errorf("fill to disk error : %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dq.getLastOffset() != 16 || dq.flusher.flushedOffset != 16 {
+		t.Fatalf("last offset %d, flushed offset %d, want 16", dq.getLastOffset(), dq.flusher.flushedOffset)
+	}
+	dq.Close()
+
+	diskQ, err = NewDiskQueue(".", "flush", 2, &conf.TopicConf{FlushPolicy: conf.FlushPolicyMessages, FlushMessages: 3}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq = diskQ.(*diskQueue)
+	defer dq.Close()
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if dq.flusher.flushedOffset != 0 {
+		t.Fatalf("flushed offset %d before flush.messages is reached", dq.flusher.flushedOffset)
+	}
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("c")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if dq.flusher.flushedOffset != 3 {
+		t.Fatalf("flushed offset %d, want 3", dq.flusher.flushedOffset)
+	}
+}
+
+func TestPickupTopicInfoFromDisk(t *testing.T) {
+	dataDirs := []string{t.TempDir(), t.TempDir()}
+	partitions := []meta.TopicMetadata{
+		{Topic: "order-events_v2", PartitionID: 0},
+		{Topic: "order-events_v2", PartitionID: 1},
+		{Topic: "a_b-c", PartitionID: 12},
+	}
+	for i, tp := range partitions {
+		diskQ, err := NewDiskQueue(dataDirs[i%2], tp.Topic, tp.PartitionID, &conf.TopicConf{FlushPolicy: conf.FlushPolicyOS}, nil, nil)
+		if err != nil {
+			t.Fatalf("new disk queue error : %v", err)
+		}
+		if _, _, err := diskQ.FillToDisk([]*message.Message{{Body: []byte("abcde")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		diskQ.Close()
+	}
+	if dataDir := FindDataDir(dataDirs, "a_b-c", 12); dataDir != dataDirs[0] {
+		t.Fatalf("find data dir %s, want %s", dataDir, dataDirs[0])
+	}
+	if dataDir := FindDataDir(dataDirs, "order-events_v2", 1); dataDir != dataDirs[1] {
+		t.Fatalf("find data dir %s, want %s", dataDir, dataDirs[1])
+	}
+	if dataDir := FindDataDir(dataDirs, "order-events_v2", 2); dataDir != "" {
+		t.Fatalf("find data dir of a new partition %s", dataDir)
+	}
+
+	topicInfos := make([]meta.TopicMetadata, 0)
+	for _, dataDir := range dataDirs {
+		infos, err := PickupTopicInfoFromDisk(dataDir)
+		if err != nil {
+			t.Fatalf("pick up topic info error : %v", err)
+		}
+		topicInfos = append(topicInfos, infos...)
+	}
+	if len(topicInfos) != len(partitions) {
+		t.Fatalf("pick up %d partitions, want %d", len(topicInfos), len(partitions))
+	}
+	for _, tp := range partitions {
+		found := false
+		for _, info := range topicInfos {
+			if info.Topic == tp.Topic && info.PartitionID == tp.PartitionID && info.Size > SegmentHeaderLen {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("partition %s-%d not picked up : %v", tp.Topic, tp.PartitionID, topicInfos)
+		}
+	}
+
+	if _, err := NewDiskQueue(dataDirs[0], "../escape", 0, &conf.TopicConf{}, nil, nil); errors.Cause(err) != ErrInvalidTopicName {
+		t.Fatalf("open invalid topic error is %v", err)
+	}
+}
+
+func TestCompressedBatch(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	cfg := &conf.TopicConf{CompressionType: conf.CompressionTypeProducer, CleanupPolicy: conf.CleanupPolicyCompact, DeleteRetentionMs: 3600 * 1000}
+	diskQ, err := NewDiskQueue(".", "compressed", 1, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	batch, err := message.CompressMessages(message.CodecSnappy, []*message.Message{
+		{Offset: 0, Key: []byte("k1"), Body: []byte("v1"), Timestamp: 100},
+		{Offset: 1, Key: []byte("k2"), Body: []byte("v1"), Timestamp: 200},
+		{Offset: 2, Key: []byte("k1"), Body: []byte("v2"), Timestamp: 300},
+	})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("plain"), Timestamp: 50}, batch}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if dq.getLastOffset() != 4 {
+		t.Fatalf("last offset is %d, want 4", dq.getLastOffset())
+	}
+	//the batch is served whole from an offset inside it
+	data, err := readRecords(dq.PopFromDisk(3, 1))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	msgs, err := message.DecodeRecords(data)
+	if err != nil || len(msgs) != 3 || msgs[0].Offset != 2 || msgs[2].Offset != 4 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+	if offset, err := dq.OffsetForTime(80); err != nil || offset != 2 {
+		t.Fatalf("offset for time is %d error %v, want 2", offset, err)
+	}
+
+	//recompressed with the codec of the topic
+	dq.cfg.CompressionType = "gzip"
+	if _, _, err := dq.FillToDisk([]*message.Message{{Key: []byte("k2"), Body: []byte("v2")}, {Body: []byte("no key")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	data, err = readRecords(dq.PopFromDisk(5, 2))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	if record, _, err := message.DecodeRecord(data); err != nil || record.Codec() != message.CodecGzip || record.Offset != 6 {
+		t.Fatalf("decode recompressed record %v error %v", record, err)
+	}
+
+	//k1 and k2 of the first batch are replaced, so the batch is rewritten with the newest k1 only
+	if err := dq.rollWritingFile(); err != nil {
+		t.Fatalf("roll writing file error : %v", err)
+	}
+	if removed, err := dq.Compact(); err != nil || removed != 2 {
+		t.Fatalf("compact removed %d error %v, want 2", removed, err)
+	}
+	data, err = readRecords(dq.PopFromDisk(1, 10))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	msgs, err = message.DecodeRecords(data)
+	if err != nil {
+		t.Fatalf("decode msgs error %v", err)
+	}
+	wantOffsets := []int64{1, 4, 5, 6}
+	if len(msgs) != len(wantOffsets) {
+		t.Fatalf("pop %d msgs after compaction, want %d", len(msgs), len(wantOffsets))
+	}
+	for i, msg := range msgs {
+		if msg.Offset != wantOffsets[i] {
+			t.Fatalf("msg %d offset is %d, want %d", i, msg.Offset, wantOffsets[i])
+		}
+	}
+	dq.Close()
+
+	diskQ, err = NewDiskQueue(".", "compressed", 1, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	if lastOffset := diskQ.(*diskQueue).getLastOffset(); lastOffset != 6 {
+		t.Fatalf("last offset after reopen is %d, want 6", lastOffset)
+	}
+}
+
+func TestPrepareBatch(t *testing.T) {
+	//with compression.type=producer the batch is not decompressed, its offset count comes from the header
+	batch := &message.Message{Offset: 2, Attributes: int8(message.CodecGzip), Body: []byte("not gzip")}
+	msgs, err := prepareBatch([]*message.Message{batch}, conf.CompressionTypeProducer)
+	if err != nil || len(msgs) != 1 || msgs[0].Count != 3 {
+		t.Fatalf("prepare batch %v error %v", msgs, err)
+	}
+	if _, err := prepareBatch([]*message.Message{{Offset: 1 << 40, Attributes: int8(message.CodecGzip)}}, conf.CompressionTypeProducer); errors.Cause(err) != message.ErrInvalidBatch {
+		t.Fatalf("prepare batch with invalid header error is %v", err)
+	}
+	//recompressing decompresses it, the records must match the header
+	batch, err = message.CompressMessages(message.CodecGzip, []*message.Message{{Offset: 0, Body: []byte("v1")}, {Offset: 1, Body: []byte("v2")}})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	batch.Offset = 2
+	if _, err := prepareBatch([]*message.Message{batch}, "snappy"); errors.Cause(err) != message.ErrInvalidBatch {
+		t.Fatalf("recompress batch with invalid header error is %v", err)
+	}
+	batch.Offset = 1
+	msgs, err = prepareBatch([]*message.Message{batch}, "snappy")
+	if err != nil || len(msgs) != 1 || msgs[0].Codec() != message.CodecSnappy || msgs[0].Count != 2 {
+		t.Fatalf("recompress batch %v error %v", msgs, err)
+	}
+}
+
+func TestTieredStorage(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	enable := true
+	store := NewLocalObjectStore("remote")
+	diskQ, err := NewDiskQueue(".", "tiered", 1, &conf.TopicConf{RemoteStorageEnable: &enable, LocalRetentionBytes: 1}, store, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	for i := 0; i < 3; i++ {
+		msgs := []*message.Message{
+			{Body: []byte("abcde"), Timestamp: time.Now().UnixNano()},
+			{Body: []byte("fghijk"), Timestamp: time.Now().UnixNano()},
+		}
+		if _, _, err := dq.FillToDisk(msgs); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i < 2 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+	//segments not uploaded yet are kept locally
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 0 {
+		t.Fatalf("deleted %d segments before upload, error %v", deleted, err)
+	}
+	if uploaded, err := dq.Offload(); err != nil || uploaded != 2 {
+		t.Fatalf("uploaded %d segments, error %v", uploaded, err)
+	}
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 2 {
+		t.Fatalf("deleted %d local segments, error %v", deleted, err)
+	}
+	if _, err := os.Stat("tiered/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("uploaded segment is still local : %v", err)
+	}
+	if _, err := os.Stat("remote/tiered/1/segment_1.data"); err != nil {
+		t.Fatalf("uploaded segment is not in the object store : %v", err)
+	}
+	if dq.LogStartOffset() != 1 {
+		t.Fatalf("log start offset is %d, want 1", dq.LogStartOffset())
+	}
+	for _, offset := range []int64{1, 3, 5} {
+		data, err := readRecords(dq.PopFromDisk(offset, 2))
+		if err != nil {
+			t.Fatalf("pop offset %d error : %v", offset, err)
+		}
+		if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 || msgs[0].Offset != offset {
+			t.Fatalf("decode msgs %v at offset %d error %v", msgs, offset, err)
+		}
+	}
+	if msgOffset, err := dq.OffsetForTime(0); err != nil || msgOffset != 1 {
+		t.Fatalf("offset for time is %d, error %v", msgOffset, err)
+	}
+	dq.Close()
+
+	//the manifest is loaded on restart, retention.bytes then deletes the remote segments
+	diskQ, err = NewDiskQueue(".", "tiered", 1, &conf.TopicConf{RemoteStorageEnable: &enable, RetentionBytes: 1}, store, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	dq = diskQ.(*diskQueue)
+	defer dq.Close()
+	if dq.LogStartOffset() != 1 || dq.getLastOffset() != 6 {
+		t.Fatalf("reopen log start offset %d last offset %d", dq.LogStartOffset(), dq.getLastOffset())
+	}
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 2 {
+		t.Fatalf("deleted %d remote segments, error %v", deleted, err)
+	}
+	if _, err := os.Stat("remote/tiered/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("expired remote segment still exists : %v", err)
+	}
+	if dq.LogStartOffset() != 5 {
+		t.Fatalf("log start offset is %d, want 5", dq.LogStartOffset())
+	}
+	if _, err := readRecords(dq.PopFromDisk(1, 2)); err != ErrOffsetOutOfRange {
+		t.Fatalf("pop deleted offset error is %v", err)
+	}
+}
+
+func TestTieredDeleteRecords(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	enable := true
+	diskQ, err := NewDiskQueue(".", "tiered", 1, &conf.TopicConf{RemoteStorageEnable: &enable, LocalRetentionBytes: 1}, NewLocalObjectStore("remote"), nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	for i := 0; i < 3; i++ {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("abcde")}, {Body: []byte("fghijk")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i < 2 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+	if uploaded, err := dq.Offload(); err != nil || uploaded != 2 {
+		t.Fatalf("uploaded %d segments, error %v", uploaded, err)
+	}
+	if logStartOffset, err := dq.DeleteRecords(4); err != nil || logStartOffset != 4 {
+		t.Fatalf("delete records log start offset %d error %v", logStartOffset, err)
+	}
+	//local retention keeps the remote segment of offset 3, the records purged before 4 stay unreadable
+	if _, err := dq.DeleteExpiredSegments(); err != nil {
+		t.Fatalf("delete expired segments error : %v", err)
+	}
+	if dq.LogStartOffset() != 4 {
+		t.Fatalf("log start offset is %d, want 4", dq.LogStartOffset())
+	}
+	if _, err := readRecords(dq.PopFromDisk(3, 1)); err != ErrOffsetOutOfRange {
+		t.Fatalf("pop purged offset error is %v", err)
+	}
+}
+
+//gatedObjectStore counts the gets and holds the ones of .data files until gate is closed
+type gatedObjectStore struct {
+	ObjectStore
+	lock sync.Mutex
+	gets map[string]int
+	gate chan struct{}
+}
+
+func (s *gatedObjectStore) Get(key string) (io.ReadCloser, error) {
+	s.lock.Lock()
+	s.gets[key]++
+	gate := s.gate
+	s.lock.Unlock()
+	if gate != nil && strings.HasSuffix(key, ".data") {
+		<-gate
+	}
+	return s.ObjectStore.Get(key)
+}
+
+func TestTieredFetch(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	enable := true
+	store := &gatedObjectStore{ObjectStore: NewLocalObjectStore("remote"), gets: make(map[string]int)}
+	diskQ, err := NewDiskQueue(".", "tiered", 1, &conf.TopicConf{RemoteStorageEnable: &enable, LocalRetentionBytes: 1}, store, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	for i := 0; i < 2; i++ {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("abcde")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if err := dq.rollWritingFile(); err != nil {
+			t.Fatalf("roll writing file error : %v", err)
+		}
+	}
+	if uploaded, err := dq.Offload(); err != nil || uploaded != 2 {
+		t.Fatalf("uploaded %d segments, error %v", uploaded, err)
+	}
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 2 {
+		t.Fatalf("deleted %d local segments, error %v", deleted, err)
+	}
+
+	store.gate = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := readRecords(dq.PopFromDisk(1, 1))
+			if err != nil {
+				t.Errorf("pop remote offset error : %v", err)
+				return
+			}
+			if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 1 || msgs[0].Offset != 1 {
+				t.Errorf("decode msgs %v error %v", msgs, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	//the download does not hold the lock of the remote log, the other segments are still served
+	done := make(chan struct{})
+	go func() {
+		dq.remote.getSegments()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the remote log is locked while a segment is downloaded")
+	}
+	close(store.gate)
+	wg.Wait()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if gets := store.gets["tiered/1/segment_1.data"]; gets != 1 {
+		t.Fatalf("segment downloaded %d times, want 1", gets)
+	}
+}
+
+func TestTieredSnapshot(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	enable := true
+	cfg := &conf.TopicConf{RemoteStorageEnable: &enable, LocalRetentionBytes: 1}
+	store := &gatedObjectStore{ObjectStore: NewLocalObjectStore("remote"), gets: make(map[string]int)}
+	diskQ, err := NewDiskQueue(".", "tiered", 1, cfg, store, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	for i := 0; i < 2; i++ {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("abcde")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if err := dq.rollWritingFile(); err != nil {
+			t.Fatalf("roll writing file error : %v", err)
+		}
+	}
+	if uploaded, err := dq.Offload(); err != nil || uploaded != 2 {
+		t.Fatalf("uploaded %d segments, error %v", uploaded, err)
+	}
+	if deleted, err := dq.DeleteExpiredSegments(); err != nil || deleted != 2 {
+		t.Fatalf("deleted %d local segments, error %v", deleted, err)
+	}
+
+	//retention deletes the remote segments while the snapshot downloads them
+	store.gate = make(chan struct{})
+	snapshotDone := make(chan error, 1)
+	var snapshot *PartitionSnapshot
+	go func() {
+		var err error
+		snapshot, err = dq.Snapshot()
+		snapshotDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cfg.RetentionBytes = 1
+	deleteDone := make(chan error, 1)
+	go func() {
+		_, err := dq.DeleteExpiredSegments()
+		deleteDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(store.gate)
+	if err := <-snapshotDone; err != nil {
+		t.Fatalf("snapshot error : %v", err)
+	}
+	defer snapshot.Close()
+	if err := <-deleteDone; err != nil {
+		t.Fatalf("delete expired segments error : %v", err)
+	}
+	if len(snapshot.Segments) != 3 || snapshot.Segments[0].StartOffset != 1 || snapshot.LastOffset != 2 {
+		t.Fatalf("snapshot segments %v last offset %d", snapshot.Segments, snapshot.LastOffset)
+	}
+	if _, err := os.Stat("remote/tiered/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("expired remote segment still exists : %v", err)
+	}
+}
+
+//run with -race, consumers read any offsets while the partition is written and cleaned
+func TestConcurrentPop(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "concurrent", 1, &conf.TopicConf{RetentionBytes: 1, FlushPolicy: conf.FlushPolicyOS}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	fill := func(offset int64) {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte(strconv.FormatInt(offset, 10))}}); err != nil {
+			t.Errorf("fill to disk error : %v", err)
+		}
+	}
+	for offset := int64(1); offset <= 100; offset++ {
+		fill(offset)
+		if offset%25 == 0 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for offset := int64(101); offset <= 200; offset++ {
+			//the append loop is idle between the fills of this goroutine
+			if offset%25 == 0 {
+				if err := dq.rollWritingFile(); err != nil {
+					t.Errorf("roll writing file error : %v", err)
+				}
+			}
+			fill(offset)
+			if offset == 150 {
+				if _, err := dq.DeleteExpiredSegments(); err != nil {
+					t.Errorf("delete expired segments error : %v", err)
+				}
+			}
+		}
+		close(stop)
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				offset := int64((n*7+i*13)%int(dq.getLastOffset())) + 1
+				data, err := readRecords(dq.PopFromDisk(offset, 3))
+				if err == ErrOffsetOutOfRange {
+					continue
+				}
+				if err != nil {
+					t.Errorf("pop offset %d error : %v", offset, err)
+					return
+				}
+				msgs, err := message.DecodeRecords(data)
+				if err != nil || len(msgs) == 0 || msgs[0].Offset != offset || string(msgs[0].Body) != strconv.FormatInt(offset, 10) {
+					t.Errorf("decode msgs %v at offset %d error %v", msgs, offset, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+//run with -race, producers append to the same partition at the same time
+func TestConcurrentFill(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "append", 1, &conf.TopicConf{FlushPolicy: conf.FlushPolicyBatch}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	baseOffsets := make(map[int64]string)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				body := strconv.Itoa(i) + "-" + strconv.Itoa(n)
+				baseOffset, _, err := diskQ.FillToDisk([]*message.Message{{Body: []byte(body)}, {Body: []byte(body)}})
+				if err != nil {
+					t.Errorf("fill to disk error : %v", err)
+					return
+				}
+				lock.Lock()
+				baseOffsets[baseOffset] = body
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//every batch got its own contiguous offsets
+	data, err := readRecords(diskQ.PopFromDisk(1, 800))
+	if err != nil {
+		t.Fatalf("pop from disk error : %v", err)
+	}
+	msgs, err := message.DecodeRecords(data)
+	if err != nil || len(msgs) != 800 {
+		t.Fatalf("decode %d msgs error %v", len(msgs), err)
+	}
+	for i := 0; i < len(msgs); i += 2 {
+		body, ok := baseOffsets[msgs[i].Offset]
+		if !ok || string(msgs[i].Body) != body || string(msgs[i+1].Body) != body || msgs[i+1].Offset != msgs[i].Offset+1 {
+			t.Fatalf("batch at offset %d is %s %s, want %s", msgs[i].Offset, msgs[i].Body, msgs[i+1].Body, body)
+		}
+	}
+	if err := diskQ.Close(); err != nil {
+		t.Fatalf("close error : %v", err)
+	}
+	if _, _, err := diskQ.FillToDisk([]*message.Message{{Body: []byte("closed")}}); err != ErrQueueClosed {
+		t.Fatalf("fill closed queue error is %v", err)
+	}
+}
+
+func TestDeleteRecords(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "purge", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	for i := 0; i < 3; i++ {
+		if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("abcde")}, {Body: []byte("fghijk")}}); err != nil {
+			t.Fatalf("fill to disk error : %v", err)
+		}
+		if i < 2 {
+			if err := dq.rollWritingFile(); err != nil {
+				t.Fatalf("roll writing file error : %v", err)
+			}
+		}
+	}
+	if _, err := dq.DeleteRecords(8); err != ErrOffsetOutOfRange {
+		t.Fatalf("delete records beyond the log end error is %v", err)
+	}
+	//segment 1 holds 1-2 and is deleted, segment 2 holds 3-4 and is only hidden up to 4
+	logStartOffset, err := dq.DeleteRecords(4)
+	if err != nil || logStartOffset != 4 {
+		t.Fatalf("delete records log start offset %d error %v", logStartOffset, err)
+	}
+	if _, err := os.Stat("purge/1/segment_1.data"); !os.IsNotExist(err) {
+		t.Fatalf("deleted segment still exists : %v", err)
+	}
+	if _, err := readRecords(dq.PopFromDisk(3, 1)); err != ErrOffsetOutOfRange {
+		t.Fatalf("pop hidden offset error is %v", err)
+	}
+	if _, err := readRecords(dq.PopFromDisk(4, 1)); err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	//retention can not move it back to the start of segment 2
+	dq.advanceLogStartOffset(3)
+	if dq.LogStartOffset() != 4 {
+		t.Fatalf("log start offset moved back to %d", dq.LogStartOffset())
+	}
+	if err := dq.Close(); err != nil {
+		t.Fatalf("close error : %v", err)
+	}
+
+	//the log start offset survives a restart, deleting up to the log end keeps the writing segment
+	diskQ, err = NewDiskQueue(".", "purge", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	defer diskQ.Close()
+	if diskQ.LogStartOffset() != 4 {
+		t.Fatalf("log start offset is %d after restart, want 4", diskQ.LogStartOffset())
+	}
+	if logStartOffset, err := diskQ.DeleteRecords(7); err != nil || logStartOffset != 7 {
+		t.Fatalf("delete all records log start offset %d error %v", logStartOffset, err)
+	}
+	if _, err := os.Stat("purge/1/segment_2.data"); !os.IsNotExist(err) {
+		t.Fatalf("deleted segment still exists : %v", err)
+	}
+	if baseOffset, _, err := diskQ.FillToDisk([]*message.Message{{Body: []byte("lmnopq")}}); err != nil || baseOffset != 7 {
+		t.Fatalf("fill after delete records base offset %d error %v", baseOffset, err)
+	}
+}
+
+func TestTruncateTo(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "truncate", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("a")}, {Body: []byte("b")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	if err := dq.rollWritingFile(); err != nil {
+		t.Fatalf("roll writing file error : %v", err)
+	}
+	batch, err := message.CompressMessages(message.CodecGzip, []*message.Message{
+		{Offset: 0, Body: []byte("d")},
+		{Offset: 1, Body: []byte("e")},
+		{Offset: 2, Body: []byte("f")},
+	})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	//segment 2 holds 3, the batch 4-6 and 7
+	if _, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("c")}, batch, {Body: []byte("g")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+
+	//the batch holding offset 5 is removed whole
+	if err := dq.TruncateTo(5); err != nil {
+		t.Fatalf("truncate error : %v", err)
+	}
+	if dq.getLastOffset() != 3 {
+		t.Fatalf("last offset is %d after truncate, want 3", dq.getLastOffset())
+	}
+	if baseOffset, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("h")}}); err != nil || baseOffset != 4 {
+		t.Fatalf("fill after truncate base offset %d error %v", baseOffset, err)
+	}
+	data, err := readRecords(dq.PopFromDisk(3, 10))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 || string(msgs[1].Body) != "h" || msgs[1].Offset != 4 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+
+	//truncating into a sealed segment deletes the ones after it,
+	//a reader streaming it still gets the size it was given
+	records, err := dq.PopFromDisk(1, 10)
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	if err := dq.TruncateTo(2); err != nil {
+		t.Fatalf("truncate error : %v", err)
+	}
+	data, err = readRecords(records, nil)
+	if err != nil || int64(len(data)) != records.Size() {
+		t.Fatalf("read %d bytes of %d from truncated segment, error %v", len(data), records.Size(), err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+	if _, err := readRecords(dq.PopFromDisk(2, 1)); err != ErrNoneMsg {
+		t.Fatalf("pop truncated offset error is %v", err)
+	}
+	if _, err := os.Stat("truncate/1/segment_2.data"); !os.IsNotExist(err) {
+		t.Fatalf("truncated segment still exists : %v", err)
+	}
+	if baseOffset, _, err := dq.FillToDisk([]*message.Message{{Body: []byte("i")}}); err != nil || baseOffset != 2 {
+		t.Fatalf("fill after truncate base offset %d error %v", baseOffset, err)
+	}
+	if err := dq.Close(); err != nil {
+		t.Fatalf("close error : %v", err)
+	}
+
+	diskQ, err = NewDiskQueue(".", "truncate", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	defer diskQ.Close()
+	data, err = readRecords(diskQ.PopFromDisk(1, 10))
+	if err != nil {
+		t.Fatalf("pop from disk error %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 || string(msgs[1].Body) != "i" || msgs[1].Offset != 2 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+}
+
+func TestMigrateLegacySegments(t *testing.T) {
+	legacyDir, dataDirs := t.TempDir(), []string{t.TempDir(), t.TempDir()}
+	var legacy []byte
+	for _, body := range []string{"abcde", "fghijk"} {
+		byt, err := json.Marshal(&message.Message{Body: []byte(body), Timestamp: time.Now().UnixNano()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy = append(legacy, append(byt, ',')...)
+	}
+	index := append(encodeIndex(1, 0), encodeIndex(2, int64(len(legacy)/2))...)
+	for _, name := range []string{"order-events_v2-3_1", "yith-0_1"} {
+		if err := os.WriteFile(filepath.Join(legacyDir, name+".data"), legacy, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(legacyDir, name+".index"), index, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the partition already in the second data dir stays there
+	diskQ, err := NewDiskQueue(dataDirs[1], "yith", 0, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	diskQ.Close()
+	if err := os.WriteFile(filepath.Join(legacyDir, "yith.yml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := MigrateLegacySegments(legacyDir, dataDirs)
+	if err != nil || len(migrated) != 2 {
+		t.Fatalf("migrate legacy segments %v error %v", migrated, err)
+	}
+	if fis, _ := os.ReadDir(legacyDir); len(fis) != 1 {
+		t.Fatalf("%d files left in the legacy dir", len(fis))
+	}
+	for _, tp := range []struct {
+		dataDir string
+		topic   string
+		id      int
+	}{{dataDirs[0], "order-events_v2", 3}, {dataDirs[1], "yith", 0}} {
+		diskQ, err := NewDiskQueue(tp.dataDir, tp.topic, tp.id, &conf.TopicConf{}, nil, nil)
+		if err != nil {
+			t.Fatalf("open migrated partition error : %v", err)
+		}
+		data, err := readRecords(diskQ.PopFromDisk(1, 2))
+		diskQ.Close()
+		if err != nil {
+			t.Fatalf("pop migrated partition error : %v", err)
+		}
+		if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 2 || string(msgs[1].Body) != "fghijk" {
+			t.Fatalf("decode migrated msgs %v error %v", msgs, err)
+		}
+	}
+	if migrated, err := MigrateLegacySegments(legacyDir, dataDirs); err != nil || len(migrated) != 0 {
+		t.Fatalf("migrate again %v error %v", migrated, err)
+	}
+}
@@ -0,0 +1,359 @@
+package queue
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yithQ/message"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
+)
+
+//encryption at rest: a segment of a topic with encryption.enable is encrypted with the current key of the
+//KeyProvider when it is created and its header holds the key id, so a rotated key applies to the new segments
+//while the old ones are opened with the key they were written with.
+//The records of a segment are sealed with a segment key, HKDF-SHA256 of the key with topic, partition id and seq,
+//so the random nonces of one key are spread over the segments instead of the whole lifetime of the key.
+//Every record is stored as an envelope record keeping offset and timestamp in the clear, so the index,
+//time index, recovery and truncation work without the keys. The body of the envelope:
+//
+//	offsetCount int32     of a compressed batch, so its base offset is known without decrypting it
+//	nonce       [12]byte
+//	sealed      AES-GCM of the record encoding of the record, topic, partition id, offset and offsetCount are the additional data
+const (
+	//never seen by a consumer, the records are opened before they are served
+	encryptedAttribute int8 = 0x40
+	envelopeNonceLen        = 12
+	envelopeHeaderLen       = 4 + envelopeNonceLen
+)
+
+var ErrUnknownKeyProvider error = errors.New("unknown key provider type")
+var ErrNoKeyProvider error = errors.New("encryption is not configured")
+var ErrKeyNotFound error = errors.New("encryption key not found")
+var ErrInvalidKey error = errors.New("invalid encryption key")
+var ErrRecordDecrypt error = errors.New("record decryption failed")
+
+//KeyProvider holds the keys of the encrypted segments, a key must be kept as long as a segment encrypted with it
+type KeyProvider interface {
+	//CurrentKey returns the key new segments are encrypted with and its id
+	CurrentKey() (uint32, []byte, error)
+	//Key returns an error matching ErrKeyNotFound if there is no key of id
+	Key(id uint32) ([]byte, error)
+}
+
+//NewKeyProvider returns nil if encryption is not configured
+func NewKeyProvider(cfg *conf.EncryptionConf) (KeyProvider, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Type {
+	case conf.EncryptionKeyFile:
+		if cfg.KeyFile == "" {
+			return nil, errors.New("key_file of encryption is not set")
+		}
+		return NewKeyFile(cfg.KeyFile)
+	}
+	return nil, errors.Wrap(ErrUnknownKeyProvider, cfg.Type)
+}
+
+//KeyFile reads the keys from a local file, one key a line, '#' starts a comment:
+//
+//	<key id> <hex of a 16, 24 or 32 bytes AES key>
+//
+//The key of the highest id is the current one, a key is rotated by adding a line with a higher id.
+//The file is read again once it is changed
+type KeyFile struct {
+	path    string
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewKeyFile(path string) (*KeyFile, error) {
+	kf := &KeyFile{path: path}
+	if err := kf.reload(); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+func (kf *KeyFile) CurrentKey() (uint32, []byte, error) {
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+	kf.refresh()
+	if len(kf.keys) == 0 {
+		return 0, nil, errors.Wrapf(ErrKeyNotFound, "no key in %s", kf.path)
+	}
+	return kf.current, kf.keys[kf.current], nil
+}
+
+func (kf *KeyFile) Key(id uint32) ([]byte, error) {
+	kf.lock.Lock()
+	defer kf.lock.Unlock()
+	if key, ok := kf.keys[id]; ok {
+		return key, nil
+	}
+	kf.refresh()
+	if key, ok := kf.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.Wrapf(ErrKeyNotFound, "key %d in %s", id, kf.path)
+}
+
+//refresh keeps the keys read before if the file can not be read now, the caller holds lock
+func (kf *KeyFile) refresh() {
+	if err := kf.reload(); err != nil {
+		Lg.Warnf("reload key file(%s) error : %v, keep the keys read before", kf.path, err)
+	}
+}
+
+func (kf *KeyFile) reload() error {
+	fi, err := os.Stat(kf.path)
+	if err != nil {
+		return err
+	}
+	if kf.keys != nil && fi.ModTime().Equal(kf.modTime) && fi.Size() == kf.size {
+		return nil
+	}
+	f, err := os.Open(kf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys, current, err := parseKeyFile(f)
+	if err != nil {
+		return errors.Wrap(err, kf.path)
+	}
+	kf.keys, kf.current = keys, current
+	kf.modTime, kf.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+func parseKeyFile(r io.Reader) (map[uint32][]byte, uint32, error) {
+	keys := make(map[uint32][]byte)
+	var current uint32
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, 0, errors.Wrapf(ErrInvalidKey, "line %d", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, 0, errors.Wrapf(ErrInvalidKey, "line %d : %v", line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, 0, errors.Wrapf(ErrInvalidKey, "line %d : %v", line, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, 0, errors.Wrapf(ErrInvalidKey, "line %d : %v", line, err)
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return nil, 0, errors.Wrapf(ErrInvalidKey, "line %d : key %d is repeated", line, id)
+		}
+		keys[uint32(id)] = key
+		if uint32(id) > current || len(keys) == 1 {
+			current = uint32(id)
+		}
+	}
+	return keys, current, scanner.Err()
+}
+
+//encryption is how a partition encrypts its segments, nil if no key provider is configured.
+//Encrypted segments are opened with keys whether enabled or not, so they stay readable once encryption.enable is off
+type encryption struct {
+	keys KeyProvider
+	//new segments are encrypted
+	enabled bool
+	//the partition the segments belong to, part of the segment keys and of the additional data
+	partition []byte
+}
+
+func newEncryption(keys KeyProvider, cfg *conf.TopicConf, topic string, partitionID int) (*encryption, error) {
+	if keys == nil {
+		if cfg.EncryptionEnabled() {
+			return nil, ErrNoKeyProvider
+		}
+		return nil, nil
+	}
+	return &encryption{keys: keys, enabled: cfg.EncryptionEnabled(), partition: encodePartition(topic, partitionID)}, nil
+}
+
+//encodePartition is the length of topic, topic and partitionID
+func encodePartition(topic string, partitionID int) []byte {
+	data := make([]byte, 2, 2+len(topic)+4)
+	binary.BigEndian.PutUint16(data, uint16(len(topic)))
+	data = append(data, topic...)
+	return append(data, byte(partitionID>>24), byte(partitionID>>16), byte(partitionID>>8), byte(partitionID))
+}
+
+//newSegmentCipher returns the cipher of new segment seq, nil if it is not encrypted
+func (e *encryption) newSegmentCipher(seq int) (*segmentCipher, error) {
+	if e == nil || !e.enabled {
+		return nil, nil
+	}
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentCipher(id, key, e.partition, seq)
+}
+
+//openSegmentCipher returns the cipher of segment seq whose header is encrypted
+func (e *encryption) openSegmentCipher(header segmentHeader, seq int) (*segmentCipher, error) {
+	if e == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := e.keys.Key(header.keyID)
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentCipher(header.keyID, key, e.partition, seq)
+}
+
+//segmentCipher seals and opens the records of an encrypted segment
+type segmentCipher struct {
+	keyID     uint32
+	aead      cipher.AEAD
+	partition []byte
+}
+
+func newSegmentCipher(keyID uint32, key []byte, partition []byte, seq int) (*segmentCipher, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, errors.Wrapf(ErrInvalidKey, "key %d : %v", keyID, err)
+	}
+	block, err := aes.NewCipher(deriveSegmentKey(key, partition, seq))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentCipher{keyID: keyID, aead: aead, partition: partition}, nil
+}
+
+//deriveSegmentKey is HKDF-SHA256 (RFC 5869) of key without salt, the info is partition and seq,
+//the segment key has the length of key
+func deriveSegmentKey(key []byte, partition []byte, seq int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("yith segment key"))
+	expand.Write(partition)
+	seqData := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqData, uint64(seq))
+	expand.Write(seqData)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:len(key)]
+}
+
+func (c *segmentCipher) header() []byte {
+	return encodeEncryptedSegmentHeader(c.keyID)
+}
+
+//seal returns the envelope of msg, its offset must be assigned
+func (c *segmentCipher) seal(msg *message.Message) (*message.Message, error) {
+	plain := message.EncodeRecord(msg)
+	body := make([]byte, envelopeHeaderLen, envelopeHeaderLen+len(plain)+c.aead.Overhead())
+	binary.BigEndian.PutUint32(body, uint32(msg.OffsetCount()))
+	if _, err := rand.Read(body[4:envelopeHeaderLen]); err != nil {
+		return nil, err
+	}
+	body = c.aead.Seal(body, body[4:envelopeHeaderLen], plain, c.additionalData(msg.Offset, body))
+	return &message.Message{
+		Offset:     msg.Offset,
+		Attributes: encryptedAttribute,
+		Timestamp:  msg.Timestamp,
+		Body:       body,
+		Count:      msg.Count,
+	}, nil
+}
+
+//open returns the record sealed in an envelope and its record encoding
+func (c *segmentCipher) open(envelope *message.Message) (*message.Message, []byte, error) {
+	if !isEnvelope(envelope) || len(envelope.Body) < envelopeHeaderLen {
+		return nil, nil, errors.Wrapf(message.ErrRecordCorrupted, "offset %d is not an encrypted record", envelope.Offset)
+	}
+	body := envelope.Body
+	plain, err := c.aead.Open(nil, body[4:envelopeHeaderLen], body[envelopeHeaderLen:], c.additionalData(envelope.Offset, body))
+	if err != nil {
+		return nil, nil, errors.Wrapf(ErrRecordDecrypt, "offset %d with key %d", envelope.Offset, c.keyID)
+	}
+	msg, _, err := message.DecodeRecord(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Offset != envelope.Offset {
+		return nil, nil, errors.Wrapf(message.ErrRecordCorrupted, "offset %d holds the record of %d", envelope.Offset, msg.Offset)
+	}
+	if _, err := recordBaseOffset(msg); err != nil {
+		return nil, nil, err
+	}
+	return msg, plain, nil
+}
+
+//openRecords opens the envelopes of data and returns the records as produced
+func (c *segmentCipher) openRecords(data []byte) ([]byte, error) {
+	records := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		envelope, n, err := message.DecodeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		_, plain, err := c.open(envelope)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, plain...)
+		data = data[n:]
+	}
+	return records, nil
+}
+
+//additionalData binds a sealed record to its partition, offset and offset count
+func (c *segmentCipher) additionalData(offset int64, body []byte) []byte {
+	data := make([]byte, len(c.partition)+12)
+	copy(data, c.partition)
+	binary.BigEndian.PutUint64(data[len(c.partition):], uint64(offset))
+	copy(data[len(c.partition)+8:], body[:4])
+	return data
+}
+
+func isEnvelope(msg *message.Message) bool {
+	return msg.Attributes&encryptedAttribute != 0
+}
+
+//envelopeOffsetCount reads the offset count of the sealed record in the clear
+func envelopeOffsetCount(envelope *message.Message) (int64, error) {
+	if len(envelope.Body) < envelopeHeaderLen {
+		return 0, errors.Wrapf(message.ErrRecordCorrupted, "offset %d is not an encrypted record", envelope.Offset)
+	}
+	count := int64(binary.BigEndian.Uint32(envelope.Body))
+	if count < 1 || count > envelope.Offset {
+		return 0, errors.Wrapf(message.ErrRecordCorrupted, "offset %d has an offset count of %d", envelope.Offset, count)
+	}
+	return count, nil
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+func TestEncryptedSegments(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	if err := ioutil.WriteFile("keys", []byte("# test keys\n1 000102030405060708090a0b0c0d0e0f\n"), 0600); err != nil {
+		t.Fatalf("write key file error : %v", err)
+	}
+	keys, err := NewKeyFile("keys")
+	if err != nil {
+		t.Fatalf("new key file error : %v", err)
+	}
+	enable := true
+	cfg := &conf.TopicConf{EncryptionEnable: &enable, CleanupPolicy: conf.CleanupPolicyCompact, DeleteRetentionMs: 3600 * 1000}
+	if _, err := NewDiskQueue(".", "secret", 1, cfg, nil, nil); err != ErrNoKeyProvider {
+		t.Fatalf("new encrypted disk queue without keys error is %v", err)
+	}
+	diskQ, err := NewDiskQueue(".", "secret", 1, cfg, nil, keys)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	batch, err := message.CompressMessages(message.CodecGzip, []*message.Message{
+		{Offset: 0, Key: []byte("k1"), Body: []byte("personal-1"), Timestamp: 100},
+		{Offset: 1, Key: []byte("k2"), Body: []byte("personal-2"), Timestamp: 200},
+	})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	if _, _, err := dq.FillToDisk([]*message.Message{{Key: []byte("k1"), Body: []byte("personal-0"), Timestamp: 50}, batch}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	data, err := ioutil.ReadFile("secret/1/segment_1.data")
+	if err != nil {
+		t.Fatalf("read segment error : %v", err)
+	}
+	if bytes.Contains(data, []byte("personal-0")) || bytes.Contains(data, []byte("k1")) {
+		t.Fatalf("segment holds records in the clear")
+	}
+	//the batch is found by the index from an offset inside it
+	if msgs, err := popMsgs(dq, 2, 1); err != nil || len(msgs) != 2 || string(msgs[0].Body) != "personal-1" || msgs[1].Offset != 3 {
+		t.Fatalf("pop msgs %v error %v", msgs, err)
+	}
+	if offset, err := dq.OffsetForTime(80); err != nil || offset != 2 {
+		t.Fatalf("offset for time is %d error %v, want 2", offset, err)
+	}
+
+	//a rotated key applies to the next segment
+	if err := ioutil.WriteFile("keys", []byte("1 000102030405060708090a0b0c0d0e0f\n2 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f\n"), 0600); err != nil {
+		t.Fatalf("rotate key error : %v", err)
+	}
+	if err := dq.rollWritingFile(); err != nil {
+		t.Fatalf("roll writing file error : %v", err)
+	}
+	if dq.writingFile.cipher == nil || dq.writingFile.cipher.keyID != 2 {
+		t.Fatalf("new segment is not encrypted with the rotated key")
+	}
+	if _, _, err := dq.FillToDisk([]*message.Message{{Key: []byte("k2"), Body: []byte("personal-3")}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	//the batch is rewritten with k1 only and sealed with the key of its segment
+	if removed, err := dq.Compact(); err != nil || removed != 2 {
+		t.Fatalf("compact removed %d error %v, want 2", removed, err)
+	}
+	dq.Close()
+
+	//encryption.enable off, the encrypted segments are still opened
+	diskQ, err = NewDiskQueue(".", "secret", 1, &conf.TopicConf{}, nil, keys)
+	if err != nil {
+		t.Fatalf("reopen disk queue error : %v", err)
+	}
+	msgs, err := popMsgs(diskQ.(*diskQueue), 2, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Offset != 2 || string(msgs[0].Body) != "personal-1" {
+		t.Fatalf("pop msgs after compaction %v error %v", msgs, err)
+	}
+	if msgs, err = popMsgs(diskQ.(*diskQueue), 4, 10); err != nil || len(msgs) != 1 || string(msgs[0].Body) != "personal-3" {
+		t.Fatalf("pop msgs of the rotated key %v error %v", msgs, err)
+	}
+	diskQ.Close()
+	if _, err := NewDiskQueue(".", "secret", 1, &conf.TopicConf{}, nil, nil); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("open encrypted segments without keys error is %v", err)
+	}
+
+	//offline inspection opens the records with the keys only
+	var encrypted, opened int
+	err = ForEachSegmentRecord("secret/1/segment_2.data", nil, func(rec *SegmentRecord) error {
+		if rec.Encrypted && rec.BaseOffset == 4 {
+			encrypted++
+		}
+		return nil
+	})
+	if err != nil || encrypted != 1 {
+		t.Fatalf("walk encrypted records %d error %v", encrypted, err)
+	}
+	err = ForEachSegmentRecord("secret/1/segment_2.data", keys, func(rec *SegmentRecord) error {
+		if !rec.Encrypted && string(rec.Msg.Body) == "personal-3" {
+			opened++
+		}
+		return nil
+	})
+	if err != nil || opened != 1 {
+		t.Fatalf("walk opened records %d error %v", opened, err)
+	}
+	if report, err := VerifySegment("secret/1/segment_1.data"); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("verify encrypted segment %+v error %v", report, err)
+	}
+}
+
+func TestSegmentKeys(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	sealer, err := newSegmentCipher(1, key, encodePartition("secret", 1), 1)
+	if err != nil {
+		t.Fatalf("new segment cipher error : %v", err)
+	}
+	envelope, err := sealer.seal(&message.Message{Offset: 7, Body: []byte("personal")})
+	if err != nil {
+		t.Fatalf("seal error : %v", err)
+	}
+	if msg, _, err := sealer.open(envelope); err != nil || string(msg.Body) != "personal" {
+		t.Fatalf("open msg %v error %v", msg, err)
+	}
+	//a record copied to another segment, partition or topic is not opened with the same key
+	for _, other := range []struct {
+		topic       string
+		partitionID int
+		seq         int
+	}{{"secret", 1, 2}, {"secret", 2, 1}, {"secret2", 1, 1}} {
+		opener, err := newSegmentCipher(1, key, encodePartition(other.topic, other.partitionID), other.seq)
+		if err != nil {
+			t.Fatalf("new segment cipher error : %v", err)
+		}
+		if _, _, err := opener.open(envelope); errors.Cause(err) != ErrRecordDecrypt {
+			t.Fatalf("open record of %s-%d seq %d error is %v", other.topic, other.partitionID, other.seq, err)
+		}
+	}
+}
+
+func popMsgs(dq *diskQueue, msgOffset int64, amount int) ([]*message.Message, error) {
+	data, err := readRecords(dq.PopFromDisk(msgOffset, amount))
+	if err != nil {
+		return nil, err
+	}
+	return message.DecodeRecords(data)
+}
+
+func TestParseKeyFile(t *testing.T) {
+	keys, current, err := parseKeyFile(bytes.NewBufferString("3 000102030405060708090a0b0c0d0e0f #old\n\n7 000102030405060708090a0b0c0d0e0f1011121314151617\n"))
+	if err != nil || len(keys) != 2 || current != 7 {
+		t.Fatalf("parse keys %v current %d error %v", keys, current, err)
+	}
+	for _, invalid := range []string{"1 0001", "1 zz", "x 000102030405060708090a0b0c0d0e0f", "1 000102030405060708090a0b0c0d0e0f extra",
+		"1 000102030405060708090a0b0c0d0e0f\n1 000102030405060708090a0b0c0d0e0f"} {
+		if _, _, err := parseKeyFile(bytes.NewBufferString(invalid)); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("parse %q error is %v", invalid, err)
+		}
+	}
+}
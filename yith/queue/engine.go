@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"github.com/pkg/errors"
+	"yithQ/yith/conf"
+)
+
+var ErrUnknownStorageEngine error = errors.New("unknown storage engine")
+
+//StorageEngine opens the log of a partition, the topic selects it by storage.engine
+type StorageEngine interface {
+	Open(dataDir, topic string, partitionID int, cfg *conf.TopicConf, store ObjectStore, keys KeyProvider) (DiskQueue, error)
+	//Durable is false for an engine keeping nothing on disk, its partitions take no log dir and are lost on restart
+	Durable() bool
+}
+
+//NewStorageEngine returns the segment log if name is not set
+func NewStorageEngine(name string) (StorageEngine, error) {
+	switch name {
+	case "", conf.StorageEngineSegment:
+		return SegmentEngine{}, nil
+	case conf.StorageEngineMemory:
+		return MemoryEngine{}, nil
+	}
+	return nil, errors.Wrap(ErrUnknownStorageEngine, name)
+}
+
+//SegmentEngine stores partitions as segment files in the log dirs, see NewDiskQueue
+type SegmentEngine struct{}
+
+func (SegmentEngine) Open(dataDir, topic string, partitionID int, cfg *conf.TopicConf, store ObjectStore, keys KeyProvider) (DiskQueue, error) {
+	return NewDiskQueue(dataDir, topic, partitionID, cfg, store, keys)
+}
+
+func (SegmentEngine) Durable() bool {
+	return true
+}
+
+//MemoryEngine keeps partitions in memory only, for ephemeral topics and tests, see NewMemoryLog.
+//Nothing is at rest, so encryption.enable does not apply
+type MemoryEngine struct{}
+
+func (MemoryEngine) Open(dataDir, topic string, partitionID int, cfg *conf.TopicConf, store ObjectStore, keys KeyProvider) (DiskQueue, error) {
+	return NewMemoryLog(cfg), nil
+}
+
+func (MemoryEngine) Durable() bool {
+	return false
+}
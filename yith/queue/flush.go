@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"sync"
+	"time"
+	. "yithQ/util/logger"
+	"yithQ/yith/conf"
+)
+
+//flusher fsyncs the writing segment according to flush.policy.
+//Group commit: a writer waiting for its offset either runs the fsync itself or waits for the one running,
+//every fsync covers all records written before it started, so concurrent produce requests share it
+type flusher struct {
+	dq   *diskQueue
+	lock sync.Mutex
+	cond *sync.Cond
+	//all offsets <= flushedOffset are on disk
+	flushedOffset int64
+	flushing      bool
+	//messages written since the last fsync, for the messages policy
+	unflushed int64
+	//bumped by truncated, an fsync started before a truncation does not cover the offsets written again
+	truncations int64
+	done        chan struct{}
+}
+
+func newFlusher(dq *diskQueue) *flusher {
+	f := &flusher{
+		dq:            dq,
+		flushedOffset: dq.getLastOffset(),
+		done:          make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.lock)
+	if dq.cfg.FlushPolicy == conf.FlushPolicyTime {
+		go f.run(time.Duration(dq.cfg.FlushMs) * time.Millisecond)
+	}
+	return f
+}
+
+//written is called after msgCount records up to lastOffset are written,
+//it returns once they are as durable as flush.policy requires
+func (f *flusher) written(lastOffset int64, msgCount int) error {
+	switch f.dq.cfg.FlushPolicy {
+	case conf.FlushPolicyOS, conf.FlushPolicyTime:
+		return nil
+	case conf.FlushPolicyMessages:
+		f.lock.Lock()
+		f.unflushed += int64(msgCount)
+		reached := f.unflushed >= f.dq.cfg.FlushMessages
+		f.lock.Unlock()
+		if !reached {
+			return nil
+		}
+	}
+	return f.waitFlushed(lastOffset)
+}
+
+//waitFlushed blocks until all offsets <= offset are synced
+func (f *flusher) waitFlushed(offset int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for f.flushedOffset < offset {
+		if f.flushing {
+			f.cond.Wait()
+			continue
+		}
+		f.flushing = true
+		target := f.dq.getLastOffset()
+		truncations := f.truncations
+		f.unflushed = 0
+		f.lock.Unlock()
+		err := f.dq.syncWritingFile()
+		f.lock.Lock()
+		f.flushing = false
+		if err == nil && target > f.flushedOffset && truncations == f.truncations {
+			f.flushedOffset = target
+		}
+		f.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//truncated is called after the log is truncated to lastOffset, the offsets after it are written again
+func (f *flusher) truncated(lastOffset int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.truncations++
+	if f.flushedOffset > lastOffset {
+		f.flushedOffset = lastOffset
+	}
+}
+
+func (f *flusher) run(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.waitFlushed(f.dq.getLastOffset()); err != nil {
+				Lg.Errorf("flush partition(%s) failed: %s", f.dq.fileNamePrefix, err.Error())
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+//close stops the background flush and syncs what is left
+func (f *flusher) close() error {
+	close(f.done)
+	return f.waitFlushed(f.dq.getLastOffset())
+}
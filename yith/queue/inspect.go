@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"yithQ/message"
+)
+
+//offline inspection of the segment files for cmd/yith-log, the files are only read unless an index is rebuilt,
+//so they must not be used on the partitions of a running broker
+
+var ErrTornRecord error = errors.New("torn record")
+var ErrOffsetNotIncreasing error = errors.New("offset not increasing")
+var ErrLegacySegment error = errors.New("legacy json segment")
+
+//CorruptionError tells where the valid records of a data file end and why
+type CorruptionError struct {
+	Position int64
+	Reason   error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("position %d : %v", e.Position, e.Reason)
+}
+
+//SegmentRecord is a record as stored, a compressed batch is not expanded
+type SegmentRecord struct {
+	Position   int64
+	Size       int
+	BaseOffset int64
+	Msg        *message.Message
+	//Msg is still encrypted, the keys of the segment were not given
+	Encrypted bool
+}
+
+//OffsetGap is the offsets From..To missing between two records, normal in a compacted partition
+type OffsetGap struct {
+	From int64
+	To   int64
+}
+
+type SegmentReport struct {
+	DataPath    string
+	Size        int64
+	ValidSize   int64
+	Records     int
+	StartOffset int64
+	EndOffset   int64
+	Gaps        []OffsetGap
+	//Problems are corrupted records and index entries not matching the data, empty for a sound segment
+	Problems []string
+}
+
+//SegmentFiles returns the data files of a partition dir in order
+func SegmentFiles(dir string) ([]string, error) {
+	seqArr, err := segmentSeqs(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(seqArr))
+	for _, seq := range seqArr {
+		paths = append(paths, filepath.Join(dir, segmentFilePrefix+"_"+strconv.Itoa(seq)+".data"))
+	}
+	return paths, nil
+}
+
+//ForEachSegmentRecord calls fn for every valid record of a data file, the records of an encrypted segment
+//are opened with keys if it is not nil, the segment must then be in its partition dir.
+//A *CorruptionError tells where the valid records end if they do not reach the end of the file
+func ForEachSegmentRecord(dataPath string, keys KeyProvider, fn func(rec *SegmentRecord) error) error {
+	dataFile, size, err := openSegmentData(dataPath)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	var segmentCipher *segmentCipher
+	if header, err := readSegmentHeader(dataFile, size); err != nil {
+		return err
+	} else if header.encrypted() && keys != nil {
+		if segmentCipher, err = openSegmentFileCipher(dataPath, header, keys); err != nil {
+			return err
+		}
+	}
+	_, err = walkSegment(dataFile, size, func(rec *SegmentRecord) error {
+		if !isEnvelope(rec.Msg) {
+			return fn(rec)
+		}
+		if segmentCipher == nil {
+			rec.Encrypted = true
+			return fn(rec)
+		}
+		msg, _, err := segmentCipher.open(rec.Msg)
+		if err != nil {
+			return err
+		}
+		rec.Msg = msg
+		return fn(rec)
+	})
+	return err
+}
+
+//openSegmentFileCipher opens the cipher of a data file, its segment key is derived from the partition of its dir and its seq
+func openSegmentFileCipher(dataPath string, header segmentHeader, keys KeyProvider) (*segmentCipher, error) {
+	pm, err := readPartitionMeta(filepath.Dir(dataPath))
+	if err != nil {
+		return nil, err
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dataPath), segmentFilePrefix+"_"), ".data"))
+	if err != nil {
+		return nil, errors.Wrap(err, dataPath)
+	}
+	enc := &encryption{keys: keys, partition: encodePartition(pm.Topic, pm.PartitionID)}
+	return enc.openSegmentCipher(header, seq)
+}
+
+//VerifySegment checks the records of a data file and that its .index and .timeindex match them
+func VerifySegment(dataPath string) (*SegmentReport, error) {
+	dataFile, size, err := openSegmentData(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+	report := &SegmentReport{DataPath: dataPath, Size: size}
+	indexes := make([]byte, 0)
+	timeIndexes := &timeIndexBuilder{}
+	lastOffset := int64(-1)
+	validSize, err := walkSegment(dataFile, size, func(rec *SegmentRecord) error {
+		if lastOffset == -1 {
+			report.StartOffset = rec.BaseOffset
+		} else if rec.BaseOffset > lastOffset+1 {
+			report.Gaps = append(report.Gaps, OffsetGap{From: lastOffset + 1, To: rec.BaseOffset - 1})
+		}
+		lastOffset = rec.Msg.Offset
+		report.EndOffset = rec.Msg.Offset
+		report.Records++
+		indexes = append(indexes, encodeIndex(rec.Msg.Offset, rec.Position)...)
+		timeIndexes.add(rec.Msg.Timestamp, rec.BaseOffset)
+		return nil
+	})
+	if corruption, ok := err.(*CorruptionError); ok {
+		report.Problems = append(report.Problems, fmt.Sprintf("records end at position %d of %d, %v", corruption.Position, size, corruption.Reason))
+	} else if err != nil {
+		return nil, err
+	}
+	report.ValidSize = validSize
+
+	name := strings.TrimSuffix(dataPath, ".data")
+	if problem, err := compareIndex(name+".index", indexes); err != nil {
+		return nil, err
+	} else if problem != "" {
+		report.Problems = append(report.Problems, "index "+problem)
+	}
+	if problem, err := compareIndex(name+".timeindex", timeIndexes.entries); err != nil {
+		return nil, err
+	} else if problem != "" {
+		report.Problems = append(report.Problems, "time index "+problem)
+	}
+	return report, nil
+}
+
+//RebuildSegmentIndex rewrites the .index and .timeindex of a data file from its valid records,
+//the data file itself is not changed, ValidSize < Size of the report tells it has a corrupted tail
+func RebuildSegmentIndex(dataPath string) (*SegmentReport, error) {
+	dataFile, size, err := openSegmentData(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+	indexes, timeIndexes, validSize, err := scanSegment(dataFile, size)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(dataPath, ".data")
+	for path, data := range map[string][]byte{name + ".index": indexes, name + ".timeindex": timeIndexes.entries} {
+		if err := writeFileSync(path+".tmp", data); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return nil, err
+		}
+	}
+	report := &SegmentReport{DataPath: dataPath, Size: size, ValidSize: validSize, Records: len(indexes) / EachIndexLen}
+	if len(indexes) != 0 {
+		report.EndOffset, _ = decodeIndex(indexes[len(indexes)-EachIndexLen:])
+	}
+	return report, nil
+}
+
+func openSegmentData(dataPath string) (*os.File, int64, error) {
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := dataFileSize(dataFile)
+	if err != nil {
+		dataFile.Close()
+		return nil, 0, err
+	}
+	header, err := readSegmentHeader(dataFile, size)
+	if err == nil && header.version == legacySegmentVersion {
+		err = errors.Wrap(ErrLegacySegment, dataPath)
+	}
+	if err != nil {
+		dataFile.Close()
+		return nil, 0, err
+	}
+	return dataFile, size, nil
+}
+
+//compareIndex returns what is wrong with the index file compared to the entries built from the data, "" if nothing
+func compareIndex(path string, expected []byte) (string, error) {
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "is missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(current, expected) {
+		return "", nil
+	}
+	if len(current)%EachIndexLen != 0 {
+		return fmt.Sprintf("has a torn entry, %d bytes", len(current)), nil
+	}
+	for i := 0; i < len(current) && i < len(expected); i += EachIndexLen {
+		if !bytes.Equal(current[i:i+EachIndexLen], expected[i:i+EachIndexLen]) {
+			gotKey, gotValue := decodeIndex(current[i : i+EachIndexLen])
+			wantKey, wantValue := decodeIndex(expected[i : i+EachIndexLen])
+			return fmt.Sprintf("entry %d is (%d,%d), data has (%d,%d)", i/EachIndexLen, gotKey, gotValue, wantKey, wantValue), nil
+		}
+	}
+	return fmt.Sprintf("has %d entries, data has %d", len(current)/EachIndexLen, len(expected)/EachIndexLen), nil
+}
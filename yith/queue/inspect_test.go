@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+func TestVerifySegment(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "inspect", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	if _, _, err := diskQ.FillToDisk([]*message.Message{{Body: []byte("a"), Timestamp: 10}, {Body: []byte("b"), Timestamp: 20}}); err != nil {
+		t.Fatalf("fill to disk error : %v", err)
+	}
+	diskQ.Close()
+	paths, err := SegmentFiles("inspect/1")
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("segment files %v error %v", paths, err)
+	}
+	report, err := VerifySegment(paths[0])
+	if err != nil || len(report.Problems) != 0 || report.Records != 2 || report.StartOffset != 1 || report.EndOffset != 2 {
+		t.Fatalf("verify report %+v error %v", report, err)
+	}
+
+	//a torn record and a lost index entry
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open data file error : %v", err)
+	}
+	f.Write([]byte("torn"))
+	f.Close()
+	if err := os.Truncate("inspect/1/segment_1.index", EachIndexLen); err != nil {
+		t.Fatalf("truncate index error : %v", err)
+	}
+	report, err = VerifySegment(paths[0])
+	if err != nil || len(report.Problems) != 2 || !strings.Contains(report.Problems[1], "has 1 entries, data has 2") {
+		t.Fatalf("verify report %+v error %v", report, err)
+	}
+	if _, err := RebuildSegmentIndex(paths[0]); err != nil {
+		t.Fatalf("rebuild index error : %v", err)
+	}
+	report, err = VerifySegment(paths[0])
+	if err != nil || len(report.Problems) != 1 || report.ValidSize != report.Size-4 {
+		t.Fatalf("verify rebuilt report %+v error %v", report, err)
+	}
+}
@@ -0,0 +1,377 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+//memoryLog is the DiskQueue of MemoryEngine, records are kept in segments rolled by segment.bytes and segment.ms,
+//so retention, compaction and the log start offset behave as with segment files.
+//memorySegmentBytes is the segment.bytes if it is not set
+const memorySegmentBytes = 1 << 20
+
+type memoryLog struct {
+	cfg  *conf.TopicConf
+	lock sync.RWMutex
+	//the last segment takes the appends
+	segments       []*memorySegment
+	lastOffset     int64
+	logStartOffset int64
+	closed         bool
+	//called under lock, see OnAppend
+	onAppend func(msgs []*message.Message)
+}
+
+type memorySegment struct {
+	records  []*message.Message
+	size     int64
+	modified time.Time
+	//see DiskFile.rollTimestamp
+	rollTimestamp int64
+}
+
+func NewMemoryLog(cfg *conf.TopicConf) DiskQueue {
+	return &memoryLog{
+		cfg:            cfg,
+		logStartOffset: 1,
+	}
+}
+
+func (ml *memoryLog) FillToDisk(msgs []*message.Message) (int64, []*message.Message, error) {
+	msgs, err := prepareBatch(msgs, ml.cfg.CompressionType)
+	if err != nil {
+		return 0, nil, err
+	}
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.closed {
+		return 0, nil, ErrQueueClosed
+	}
+	for _, msg := range msgs {
+		if int64(msg.RecordSize()) > DiskFileSizeLimit {
+			return 0, nil, ErrMsgTooLarge
+		}
+	}
+	baseOffset := ml.lastOffset + 1
+	now := time.Now()
+	for _, msg := range msgs {
+		msg.Offset = ml.lastOffset + msg.OffsetCount()
+		if msg.Timestamp == 0 {
+			msg.Timestamp = now.UnixNano()
+		}
+		size := int64(msg.RecordSize())
+		if ml.rollDue(now, size) {
+			ml.segments = append(ml.segments, &memorySegment{rollTimestamp: now.UnixNano()})
+		}
+		seg := ml.active()
+		if len(seg.records) == 0 {
+			seg.rollTimestamp = maxInt64(seg.rollTimestamp, msg.Timestamp)
+		}
+		seg.records = append(seg.records, msg)
+		seg.size += size
+		seg.modified = now
+		ml.lastOffset = msg.Offset
+	}
+	if ml.onAppend != nil {
+		ml.onAppend(msgs)
+	}
+	return baseOffset, msgs, nil
+}
+
+func (ml *memoryLog) OnAppend(fn func(msgs []*message.Message)) {
+	ml.onAppend = fn
+}
+
+func (ml *memoryLog) active() *memorySegment {
+	return ml.segments[len(ml.segments)-1]
+}
+
+//rollDue is true if a record of size does not go to the active segment, the caller holds lock
+func (ml *memoryLog) rollDue(now time.Time, size int64) bool {
+	if len(ml.segments) == 0 {
+		return true
+	}
+	seg := ml.active()
+	if len(seg.records) == 0 {
+		return false
+	}
+	limit := int64(memorySegmentBytes)
+	if ml.cfg.SegmentBytes > 0 {
+		limit = ml.cfg.SegmentBytes
+	}
+	expired := ml.cfg.SegmentMs > 0 && now.UnixNano()-seg.rollTimestamp >= ml.cfg.SegmentMs*int64(time.Millisecond)
+	return seg.size+size > limit || expired
+}
+
+func (ml *memoryLog) PopFromDisk(msgOffset int64, amount int) (Records, error) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	if ml.closed {
+		return nil, ErrQueueClosed
+	}
+	if ml.lastOffset == 0 {
+		return nil, ErrNoneMsg
+	}
+	if msgOffset < ml.logStartOffset {
+		return nil, ErrOffsetOutOfRange
+	}
+	//a compressed batch is held by its last offset, like in the index
+	i := sort.Search(len(ml.segments), func(i int) bool {
+		records := ml.segments[i].records
+		return len(records) != 0 && records[len(records)-1].Offset >= msgOffset
+	})
+	data := make([]byte, 0)
+	for ; i < len(ml.segments); i++ {
+		records := ml.segments[i].records
+		n := sort.Search(len(records), func(n int) bool {
+			return records[n].Offset >= msgOffset
+		})
+		for _, msg := range records[n:] {
+			if len(data) != 0 && msg.BaseOffset() >= msgOffset+int64(amount) {
+				return bufferRecords(data), nil
+			}
+			data = message.AppendRecord(data, msg)
+		}
+	}
+	if len(data) == 0 {
+		return nil, ErrNoneMsg
+	}
+	return bufferRecords(data), nil
+}
+
+//DeleteExpiredSegments applies retention.* to the sealed segments, memory is bounded by retention.bytes
+func (ml *memoryLog) DeleteExpiredSegments() (int, error) {
+	if !ml.cfg.DeleteEnabled() {
+		return 0, nil
+	}
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	var totalSize int64
+	for _, seg := range ml.segments {
+		totalSize += seg.size
+	}
+	now := time.Now()
+	deleted := 0
+	for _, seg := range ml.segments[:ml.sealed()] {
+		if !outOfRetention(now, seg.modified, seg.size, totalSize, ml.cfg.RetentionMs, ml.cfg.RetentionBytes) {
+			break
+		}
+		totalSize -= seg.size
+		deleted++
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	ml.segments = append([]*memorySegment(nil), ml.segments[deleted:]...)
+	if startOffset := ml.startOffset(); startOffset > ml.logStartOffset {
+		ml.logStartOffset = startOffset
+	}
+	return deleted, nil
+}
+
+//sealed is the number of segments before the active one
+func (ml *memoryLog) sealed() int {
+	if len(ml.segments) == 0 {
+		return 0
+	}
+	return len(ml.segments) - 1
+}
+
+//startOffset is the first offset held, lastOffset+1 if there is none
+func (ml *memoryLog) startOffset() int64 {
+	for _, seg := range ml.segments {
+		if len(seg.records) != 0 {
+			return seg.records[0].BaseOffset()
+		}
+	}
+	return ml.lastOffset + 1
+}
+
+//Compact keeps the newest record of each key in the sealed segments, like diskQueue.Compact
+func (ml *memoryLog) Compact() (int, error) {
+	if !ml.cfg.CompactEnabled() {
+		return 0, nil
+	}
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	latest := make(map[string]int64)
+	for _, seg := range ml.segments {
+		for _, msg := range seg.records {
+			inners, err := innerRecords(msg)
+			if err != nil {
+				return 0, err
+			}
+			for _, inner := range inners {
+				if inner.Key != nil {
+					latest[string(inner.Key)] = inner.Offset
+				}
+			}
+		}
+	}
+
+	removed := 0
+	compacted := make([]*memorySegment, 0, len(ml.segments))
+	for _, seg := range ml.segments[:ml.sealed()] {
+		tombstoneExpired := time.Since(seg.modified) > time.Duration(ml.cfg.DeleteRetentionMs)*time.Millisecond
+		obsolete := func(msg *message.Message) bool {
+			return msg.Key != nil && (latest[string(msg.Key)] != msg.Offset || (msg.IsTombstone() && tombstoneExpired))
+		}
+		cleaned := &memorySegment{modified: seg.modified}
+		for _, msg := range seg.records {
+			inners, err := innerRecords(msg)
+			if err != nil {
+				return removed, err
+			}
+			kept := make([]*message.Message, 0, len(inners))
+			for _, inner := range inners {
+				if obsolete(inner) {
+					removed++
+					continue
+				}
+				kept = append(kept, inner)
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			//the records left are recompressed, one batch per run of contiguous offsets
+			if msg.IsCompressed() && len(kept) < len(inners) {
+				batches, err := message.CompressRuns(msg.Codec(), kept)
+				if err != nil {
+					return removed, err
+				}
+				for _, batch := range batches {
+					batch.Timestamp = msg.Timestamp
+					cleaned.records = append(cleaned.records, batch)
+					cleaned.size += int64(batch.RecordSize())
+				}
+				continue
+			}
+			cleaned.records = append(cleaned.records, msg)
+			cleaned.size += int64(msg.RecordSize())
+		}
+		if len(cleaned.records) != 0 {
+			compacted = append(compacted, cleaned)
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	ml.segments = append(compacted, ml.segments[ml.sealed():]...)
+	return removed, nil
+}
+
+//innerRecords returns the records of a compressed batch, msg itself otherwise
+func innerRecords(msg *message.Message) ([]*message.Message, error) {
+	if msg.IsCompressed() {
+		return msg.InnerMessages()
+	}
+	return []*message.Message{msg}, nil
+}
+
+//Offload has nothing to upload, memory topics are never tiered
+func (ml *memoryLog) Offload() (int, error) {
+	return 0, nil
+}
+
+func (ml *memoryLog) OffsetForTime(timestamp int64) (int64, error) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	for _, seg := range ml.segments {
+		for _, msg := range seg.records {
+			if msg.Timestamp < timestamp {
+				continue
+			}
+			if msg.BaseOffset() < ml.logStartOffset {
+				return ml.logStartOffset, nil
+			}
+			return msg.BaseOffset(), nil
+		}
+	}
+	return ml.lastOffset + 1, nil
+}
+
+func (ml *memoryLog) DeleteRecords(beforeOffset int64) (int64, error) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if beforeOffset > ml.lastOffset+1 {
+		return 0, ErrOffsetOutOfRange
+	}
+	if beforeOffset <= ml.logStartOffset {
+		return ml.logStartOffset, nil
+	}
+	ml.logStartOffset = beforeOffset
+	deleted := 0
+	for deleted < ml.sealed() {
+		records := ml.segments[deleted].records
+		if len(records) != 0 && records[len(records)-1].Offset >= beforeOffset {
+			break
+		}
+		deleted++
+	}
+	ml.segments = append([]*memorySegment(nil), ml.segments[deleted:]...)
+	return beforeOffset, nil
+}
+
+func (ml *memoryLog) TruncateTo(offset int64) error {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.closed {
+		return ErrQueueClosed
+	}
+	if offset > ml.lastOffset {
+		return nil
+	}
+	if offset < ml.logStartOffset {
+		return ErrOffsetOutOfRange
+	}
+	lastOffset := ml.logStartOffset - 1
+	remain := make([]*memorySegment, 0, len(ml.segments))
+	for _, seg := range ml.segments {
+		//a compressed batch holding offset is removed whole
+		n := sort.Search(len(seg.records), func(n int) bool {
+			return seg.records[n].Offset >= offset
+		})
+		if n == 0 {
+			break
+		}
+		if n < len(seg.records) {
+			seg.records = seg.records[:n:n]
+			seg.size = 0
+			for _, msg := range seg.records {
+				seg.size += int64(msg.RecordSize())
+			}
+		}
+		remain = append(remain, seg)
+		if last := seg.records[len(seg.records)-1].Offset; last > lastOffset {
+			lastOffset = last
+		}
+	}
+	ml.segments = remain
+	ml.lastOffset = lastOffset
+	return nil
+}
+
+func (ml *memoryLog) LogStartOffset() int64 {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	return ml.logStartOffset
+}
+
+func (ml *memoryLog) LastOffset() int64 {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	return ml.lastOffset
+}
+
+//Close drops all records
+func (ml *memoryLog) Close() error {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	ml.closed = true
+	ml.segments = nil
+	return nil
+}
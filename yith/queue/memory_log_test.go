@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+func TestMemoryLog(t *testing.T) {
+	ml := NewMemoryLog(&conf.TopicConf{RetentionBytes: 1, CleanupPolicy: "compact,delete"}).(*memoryLog)
+	for i := 0; i < 3; i++ {
+		if _, _, err := ml.FillToDisk([]*message.Message{{Key: []byte("k"), Body: []byte("abcde"), Timestamp: int64(i + 1)}}); err != nil {
+			t.Fatalf("fill error : %v", err)
+		}
+		//a segment per batch
+		ml.segments = append(ml.segments, &memorySegment{})
+	}
+	batch, err := message.CompressMessages(message.CodecGzip, []*message.Message{
+		{Offset: 0, Body: []byte("b"), Timestamp: 10},
+		{Offset: 1, Body: []byte("c"), Timestamp: 10},
+	})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	baseOffset, _, err := ml.FillToDisk([]*message.Message{batch, {Body: []byte("d"), Timestamp: 11}})
+	if err != nil || baseOffset != 4 || ml.lastOffset != 6 {
+		t.Fatalf("fill base offset %d last offset %d error %v", baseOffset, ml.lastOffset, err)
+	}
+	if offset, err := ml.OffsetForTime(10); err != nil || offset != 4 {
+		t.Fatalf("offset for time %d error %v", offset, err)
+	}
+
+	//the older records of key k are compacted away, their empty segments dropped
+	if removed, err := ml.Compact(); err != nil || removed != 2 || len(ml.segments) != 2 {
+		t.Fatalf("compact removed %d segments %d error %v", removed, len(ml.segments), err)
+	}
+	data, err := readRecords(ml.PopFromDisk(1, 10))
+	if err != nil {
+		t.Fatalf("pop error : %v", err)
+	}
+	if msgs, err := message.DecodeRecords(data); err != nil || len(msgs) != 4 || msgs[0].Offset != 3 || msgs[1].Offset != 4 {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
+	}
+
+	//the batch holding 5 is removed whole
+	if err := ml.TruncateTo(5); err != nil || ml.lastOffset != 3 {
+		t.Fatalf("truncate last offset %d error %v", ml.lastOffset, err)
+	}
+	ml.segments = append(ml.segments, &memorySegment{})
+	if baseOffset, _, err := ml.FillToDisk([]*message.Message{{Body: []byte("e")}}); err != nil || baseOffset != 4 {
+		t.Fatalf("fill after truncate base offset %d error %v", baseOffset, err)
+	}
+
+	//retention.bytes deletes the sealed segments
+	if deleted, err := ml.DeleteExpiredSegments(); err != nil || deleted != 1 || ml.LogStartOffset() != 4 {
+		t.Fatalf("delete expired deleted %d log start offset %d error %v", deleted, ml.LogStartOffset(), err)
+	}
+	if _, err := readRecords(ml.PopFromDisk(3, 1)); err != ErrOffsetOutOfRange {
+		t.Fatalf("pop deleted offset error is %v", err)
+	}
+	ml.Close()
+	if _, _, err := ml.FillToDisk([]*message.Message{{Body: []byte("f")}}); err != ErrQueueClosed {
+		t.Fatalf("fill closed log error is %v", err)
+	}
+}
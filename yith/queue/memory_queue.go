@@ -1,77 +1,107 @@
-//TODO: the memory_queue does not work in this version.
-
 package queue
 
 import (
-	"github.com/CrocdileChan/go-disruptor"
+	"sort"
+	"sync"
 	"yithQ/message"
 	"yithQ/yith/conf"
-
-	"encoding/json"
-	"fmt"
-	"net/http"
-)
-
-const (
-	//RingBufferCapacity = 1024
-	//RingBufferMask     = RingBufferCapacity - 1
-	Iterations = 1000000 * 100
-	//ReserveMany        = 16
 )
 
+//MemoryQueue keeps the newest records of a partition in a ring buffer,
+//so consumers near the tail are served without touching the disk
 type MemoryQueue interface {
-	FillToMemory(msg []*message.Message) error
-	PopFromMemory(writer http.ResponseWriter) error
+	//FillToMemory takes records as returned by FillToDisk, offsets assigned
+	FillToMemory(msgs []*message.Message)
+	//PopFromMemory returns false if popOffset is not held in memory
+	PopFromMemory(popOffset int64, amount int) ([]byte, bool)
+	//Reset drops all records, ep: after the disk queue was truncated
+	Reset()
 }
 
 type memoryQueue struct {
+	lock           sync.RWMutex
 	ringBufferMask int64
-	disruptor      disruptor.Disruptor
 	msgRingBuffer  []*message.Message
+	//the ring holds records with sequence [headSeq, tailSeq), record seq is at seq&ringBufferMask
+	headSeq int64
+	tailSeq int64
 }
 
+//NewMemoryQueue rounds RingBufferCapacity up to a power of 2, nil if the capacity is not set
 func NewMemoryQueue(cfg *conf.MemoryQueueConf) MemoryQueue {
-	mq := &memoryQueue{
-		msgRingBuffer: make([]*message.Message, cfg.RingBufferCapacity),
+	if cfg == nil || cfg.RingBufferCapacity <= 0 {
+		return nil
+	}
+	capacity := int64(1)
+	for capacity < cfg.RingBufferCapacity {
+		capacity <<= 1
+	}
+	return &memoryQueue{
+		ringBufferMask: capacity - 1,
+		msgRingBuffer:  make([]*message.Message, capacity),
 	}
-	mq.disruptor = disruptor.Configure(cfg.RingBufferCapacity).WithConsumerGroup(mq).Build()
-	mq.ringBufferMask = cfg.RingBufferCapacity - 1
-	return mq
 }
 
-func (mq *memoryQueue) FillToMemory(msgs []*message.Message) error {
-	writer := mq.disruptor.Writer()
-	reserveMany := int64(len(msgs))
-	seq := disruptor.InitialSequenceValue
-	for seq <= Iterations {
-		seq = writer.Reserve(reserveMany)
-		for i := seq - reserveMany + 1; i <= seq; i++ {
-			fmt.Printf("seq=%d \n", seq)
-			fmt.Printf("i=%d,ringbufferMask=%d \n", i, mq.ringBufferMask)
-			fmt.Printf("msgRingBuffer length is %d \n msgs length is %d \n", len(mq.msgRingBuffer), len(msgs))
-			mq.msgRingBuffer[i&mq.ringBufferMask] = msgs[i]
+func (mq *memoryQueue) FillToMemory(msgs []*message.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	//the ring only holds contiguous offsets, a failed append leaves a gap
+	if mq.tailSeq != mq.headSeq {
+		last := mq.msgRingBuffer[(mq.tailSeq-1)&mq.ringBufferMask]
+		if msgs[0].BaseOffset() <= last.Offset {
+			return
+		}
+		if msgs[0].BaseOffset() != last.Offset+1 {
+			mq.reset()
 		}
-		writer.Commit(seq-reserveMany+1, seq)
 	}
+	for _, msg := range msgs {
+		mq.msgRingBuffer[mq.tailSeq&mq.ringBufferMask] = msg
+		mq.tailSeq++
+	}
+	if mq.tailSeq-mq.headSeq > int64(len(mq.msgRingBuffer)) {
+		mq.headSeq = mq.tailSeq - int64(len(mq.msgRingBuffer))
+	}
+}
 
-	return nil
+func (mq *memoryQueue) PopFromMemory(popOffset int64, amount int) ([]byte, bool) {
+	mq.lock.RLock()
+	defer mq.lock.RUnlock()
+	if mq.tailSeq == mq.headSeq {
+		return nil, false
+	}
+	first := mq.msgRingBuffer[mq.headSeq&mq.ringBufferMask]
+	last := mq.msgRingBuffer[(mq.tailSeq-1)&mq.ringBufferMask]
+	if popOffset < first.BaseOffset() || popOffset > last.Offset {
+		return nil, false
+	}
+	//a compressed batch is held by its last offset, like in the index
+	n := sort.Search(int(mq.tailSeq-mq.headSeq), func(i int) bool {
+		return mq.msgRingBuffer[(mq.headSeq+int64(i))&mq.ringBufferMask].Offset >= popOffset
+	})
+	data := make([]byte, 0)
+	for seq := mq.headSeq + int64(n); seq < mq.tailSeq; seq++ {
+		msg := mq.msgRingBuffer[seq&mq.ringBufferMask]
+		if len(data) != 0 && msg.BaseOffset() >= popOffset+int64(amount) {
+			break
+		}
+		data = message.AppendRecord(data, msg)
+	}
+	return data, true
 }
 
-func (mq *memoryQueue) PopFromMemory(writer http.ResponseWriter) error {
-	mq.disruptor.Start(writer)
-	return nil
+func (mq *memoryQueue) Reset() {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	mq.reset()
 }
 
-func (mq *memoryQueue) Consume(writer http.ResponseWriter, lower, upper int64) {
-	msgs := make([]*message.Message, 0)
-	for seq := lower; seq <= upper; seq++ {
-		msg := mq.msgRingBuffer[lower&mq.ringBufferMask]
-		msgs = append(msgs, msg)
-	}
-	data, err := json.Marshal(msgs)
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write([]byte(err.Error()))
+func (mq *memoryQueue) reset() {
+	for seq := mq.headSeq; seq < mq.tailSeq; seq++ {
+		mq.msgRingBuffer[seq&mq.ringBufferMask] = nil
 	}
-	writer.Write(data)
+	mq.headSeq = mq.tailSeq
 }
@@ -1,7 +1,9 @@
 package queue
 
 import (
-	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 	"yithQ/message"
@@ -9,47 +11,134 @@ import (
 )
 
 func TestFillToMemory(t *testing.T) {
-	cfg := &conf.MemoryQueueConf{RingBufferCapacity: 1024 * 64}
-	mq := NewMemoryQueue(cfg)
-	msg1 := &message.Message{
-		ID:        123456,
-		Body:      []byte("abcde"),
-		Timestamp: time.Now().UnixNano(),
-	}
-	msg2 := &message.Message{
-		ID:        123457,
-		Body:      []byte("fghijk"),
-		Timestamp: time.Now().UnixNano(),
+	cfg := &conf.MemoryQueueConf{RingBufferCapacity: 3}
+	mq := NewMemoryQueue(cfg).(*memoryQueue)
+	if len(mq.msgRingBuffer) != 4 {
+		t.Fatalf("ring buffer capacity is %d, want 4", len(mq.msgRingBuffer))
 	}
 	msgs := make([]*message.Message, 0)
-	msgs = append(msgs, msg1, msg2)
-	err := mq.FillToMemory(msgs)
-	t.Log("fill finish")
-	if err != nil {
-		t.Fatal(err)
+	for offset := int64(1); offset <= 6; offset++ {
+		msgs = append(msgs, &message.Message{Offset: offset, Body: []byte("abcde"), Timestamp: time.Now().UnixNano()})
+	}
+	mq.FillToMemory(msgs[:2])
+	mq.FillToMemory(msgs[2:])
+	//only the newest 4 records are kept
+	if _, ok := mq.PopFromMemory(2, 1); ok {
+		t.Fatalf("evicted offset 2 is still in memory")
+	}
+	data, ok := mq.PopFromMemory(3, 10)
+	if !ok {
+		t.Fatalf("offset 3 is not in memory")
+	}
+	popped, err := message.DecodeRecords(data)
+	if err != nil || len(popped) != 4 || popped[0].Offset != 3 {
+		t.Fatalf("decode msgs %v error %v", popped, err)
+	}
+
+	//a gap in the offsets drops the older records
+	mq.FillToMemory([]*message.Message{{Offset: 9, Body: []byte("fghijk")}})
+	if _, ok := mq.PopFromMemory(6, 1); ok {
+		t.Fatalf("offset 6 before the gap is still in memory")
+	}
+	if _, ok := mq.PopFromMemory(9, 1); !ok {
+		t.Fatalf("offset 9 is not in memory")
 	}
 }
 
 func TestPopFromMemory(t *testing.T) {
-	cfg := &conf.MemoryQueueConf{RingBufferCapacity: 1024 * 64}
+	cfg := &conf.MemoryQueueConf{RingBufferCapacity: 16}
 	mq := NewMemoryQueue(cfg)
-	msg1 := &message.Message{
-		ID:        123456,
-		Body:      []byte("abcde"),
-		Timestamp: time.Now().UnixNano(),
+	batch, err := message.CompressMessages(message.CodecGzip, []*message.Message{
+		{Offset: 0, Body: []byte("b")},
+		{Offset: 1, Body: []byte("c")},
+	})
+	if err != nil {
+		t.Fatalf("compress error : %v", err)
+	}
+	batch.Offset = 3
+	mq.FillToMemory([]*message.Message{{Offset: 1, Body: []byte("a")}, batch, {Offset: 4, Body: []byte("d")}})
+
+	//the batch is served whole from an offset inside it
+	data, ok := mq.PopFromMemory(3, 1)
+	if !ok {
+		t.Fatalf("offset 3 is not in memory")
 	}
-	msg2 := &message.Message{
-		ID:        123457,
-		Body:      []byte("fghijk"),
-		Timestamp: time.Now().UnixNano(),
+	msgs, err := message.DecodeRecords(data)
+	if err != nil || len(msgs) != 2 || msgs[0].Offset != 2 || string(msgs[1].Body) != "c" {
+		t.Fatalf("decode msgs %v error %v", msgs, err)
 	}
-	msgs := make([]*message.Message, 0)
-	msgs = append(msgs, msg1, msg2)
-	err := mq.FillToMemory(msgs)
+	if _, ok := mq.PopFromMemory(5, 1); ok {
+		t.Fatalf("offset 5 beyond the tail is in memory")
+	}
+}
+
+func TestQueuePop(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "tail", 1, &conf.TopicConf{}, nil, nil)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	q := NewQueue(NewMemoryQueue(&conf.MemoryQueueConf{RingBufferCapacity: 2}), diskQ)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		if _, err := q.Fill([]*message.Message{{Body: []byte(body)}}); err != nil {
+			t.Fatalf("fill error : %v", err)
+		}
+	}
+	//offset 1 only exists on disk, offset 3 is still in memory
+	for offset, body := range map[int64]string{1: "a", 3: "c"} {
+		w := httptest.NewRecorder()
+		if err := q.Pop(offset, 1, w); err != nil {
+			t.Fatalf("pop offset %d error : %v", offset, err)
+		}
+		msgs, err := message.DecodeRecords(w.Body.Bytes())
+		if err != nil || len(msgs) == 0 || msgs[0].Offset != offset || string(msgs[0].Body) != body {
+			t.Fatalf("decode msgs %v at offset %d error %v", msgs, offset, err)
+		}
+	}
+	//the truncated offsets are gone from memory too
+	if err := q.TruncateTo(3); err != nil {
+		t.Fatalf("truncate error : %v", err)
+	}
+	if err := q.Pop(3, 1, httptest.NewRecorder()); err != ErrNoneMsg {
+		t.Fatalf("pop truncated offset error is %v", err)
+	}
+}
+
+func TestQueueConcurrentFill(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "tail", 1, &conf.TopicConf{}, nil, nil)
+	if err != nil {
+		t.Fatalf("new disk queue error : %v", err)
+	}
+	defer diskQ.Close()
+	mq := NewMemoryQueue(&conf.MemoryQueueConf{RingBufferCapacity: 64})
+	q := NewQueue(mq, diskQ)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 8; j++ {
+				if _, err := q.Fill([]*message.Message{{Body: []byte("a")}}); err != nil {
+					t.Errorf("fill error : %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	//the ring is filled in offset order, so no fill leaves a gap that drops the older records
+	data, ok := mq.PopFromMemory(1, 64)
+	if !ok {
+		t.Fatalf("offset 1 is not in memory")
+	}
+	msgs, err := message.DecodeRecords(data)
+	if err != nil || len(msgs) != 64 || msgs[63].Offset != 64 {
+		t.Fatalf("decode %d msgs error %v, want 64", len(msgs), err)
 	}
-	http.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
-		mq.PopFromMemory(writer)
-	})
 }
@@ -0,0 +1,255 @@
+package queue
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"yithQ/meta"
+	. "yithQ/util/logger"
+)
+
+//every partition lives in <data dir>/<topic>/<partition id>/ together with a metadata file,
+//so the topic and partition are never parsed back from file names
+const (
+	PartitionMetaFile = "partition.meta"
+	segmentFilePrefix = "segment"
+)
+
+var ErrInvalidTopicName error = errors.New("invalid topic name")
+var ErrPartitionMetaMismatch error = errors.New("partition metadata mismatch")
+
+type PartitionMeta struct {
+	Topic       string `json:"topic"`
+	PartitionID int    `json:"partition_id"`
+}
+
+func PartitionDir(dataDir, topic string, partitionID int) string {
+	return filepath.Join(dataDir, topic, strconv.Itoa(partitionID))
+}
+
+//FindDataDir returns the data dir already holding the partition, "" if there is none
+func FindDataDir(dataDirs []string, topic string, partitionID int) string {
+	for _, dataDir := range dataDirs {
+		if _, err := os.Stat(filepath.Join(PartitionDir(dataDir, topic, partitionID), PartitionMetaFile)); err == nil {
+			return dataDir
+		}
+	}
+	return ""
+}
+
+//ValidateTopicName rejects a topic name that is not a single path element, the topic is a directory of the data dirs
+func ValidateTopicName(topic string) error {
+	if topic == "" || topic == "." || topic == ".." || strings.ContainsAny(topic, `/\`) {
+		return errors.Wrap(ErrInvalidTopicName, topic)
+	}
+	return nil
+}
+
+//openPartitionDir creates the directory and metadata file of a new partition, or checks the metadata of an existing one
+func openPartitionDir(dataDir, topic string, partitionID int) (string, error) {
+	if err := ValidateTopicName(topic); err != nil {
+		return "", err
+	}
+	dir := PartitionDir(dataDir, topic, partitionID)
+	pm, err := readPartitionMeta(dir)
+	if err == nil {
+		if pm.Topic != topic || pm.PartitionID != partitionID {
+			return "", errors.Wrapf(ErrPartitionMetaMismatch, "%s holds %s-%d", dir, pm.Topic, pm.PartitionID)
+		}
+		return dir, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&PartitionMeta{Topic: topic, PartitionID: partitionID})
+	if err != nil {
+		return "", err
+	}
+	//write a temp file and rename it, a torn metadata file would make the partition unrecoverable
+	metaPath := filepath.Join(dir, PartitionMetaFile)
+	if err := writeFileSync(metaPath+".tmp", data); err != nil {
+		return "", err
+	}
+	return dir, os.Rename(metaPath+".tmp", metaPath)
+}
+
+func readPartitionMeta(dir string) (*PartitionMeta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, PartitionMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	pm := &PartitionMeta{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return nil, errors.Wrap(err, dir)
+	}
+	return pm, nil
+}
+
+//PickupTopicInfoFromDisk reports every partition found in the data dir and the size of its data files
+func PickupTopicInfoFromDisk(dataDir string) ([]meta.TopicMetadata, error) {
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	//not filepath.Glob, it hides the io errors of a failed disk
+	topicDirs, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	partitionDirs := make([]string, 0)
+	for _, topicDir := range topicDirs {
+		if !topicDir.IsDir() {
+			continue
+		}
+		fis, err := ioutil.ReadDir(filepath.Join(dataDir, topicDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				partitionDirs = append(partitionDirs, filepath.Join(dataDir, topicDir.Name(), fi.Name()))
+			}
+		}
+	}
+	topicInfos := make([]meta.TopicMetadata, 0)
+	for _, dir := range partitionDirs {
+		pm, err := readPartitionMeta(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".data") {
+				size += fi.Size()
+			}
+		}
+		topicInfos = append(topicInfos, meta.TopicMetadata{
+			Topic:       pm.Topic,
+			PartitionID: pm.PartitionID,
+			Size:        size,
+		})
+	}
+	return topicInfos, nil
+}
+
+//MigrateLegacySegments moves the segments written before the partition dirs, <topic>-<partitionID>_<seq>.data
+//and its indexes in legacyDir, into the partition dir in dataDirs holding the partition or the first data dir.
+//It returns the partitions migrated, ep: yith-1. The indexes of a segment are moved before its data, so a migration
+//interrupted by a crash is finished by the next one. A segment whose seq is taken in the partition dir is left
+func MigrateLegacySegments(legacyDir string, dataDirs []string) ([]string, error) {
+	fis, err := ioutil.ReadDir(legacyDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	migrated := make([]string, 0)
+	dirs := make(map[string]string)
+	for _, fi := range fis {
+		topic, partitionID, seq, ok := parseLegacySegment(fi)
+		if !ok {
+			continue
+		}
+		topicPartition := topic + "-" + strconv.Itoa(partitionID)
+		dir, ok := dirs[topicPartition]
+		if !ok {
+			if err := recoverCompaction(legacyDir, topicPartition); err != nil {
+				return migrated, err
+			}
+			dataDir := FindDataDir(dataDirs, topic, partitionID)
+			if dataDir == "" {
+				dataDir = dataDirs[0]
+			}
+			if dir, err = openPartitionDir(dataDir, topic, partitionID); err != nil {
+				return migrated, err
+			}
+			dirs[topicPartition] = dir
+			migrated = append(migrated, topicPartition)
+		}
+		segment := filepath.Join(dir, segmentFilePrefix+"_"+strconv.Itoa(seq))
+		if _, err := os.Stat(segment + ".data"); err == nil {
+			Lg.Errorf("legacy segment(%s) is not migrated, %s.data exists", fi.Name(), segment)
+			continue
+		}
+		legacy := filepath.Join(legacyDir, topicPartition+"_"+strconv.Itoa(seq))
+		for _, ext := range []string{".index", ".timeindex", ".data"} {
+			if err := moveFile(legacy+ext, segment+ext); err != nil && !os.IsNotExist(err) {
+				return migrated, err
+			}
+		}
+		Lg.Infof("migrate legacy segment(%s) to %s", fi.Name(), segment+".data")
+	}
+	return migrated, nil
+}
+
+//parseLegacySegment parses <topic>-<partitionID>_<seq>.data, the topic may hold '-' and '_'
+func parseLegacySegment(fi os.FileInfo) (topic string, partitionID int, seq int, ok bool) {
+	if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".data") {
+		return "", 0, 0, false
+	}
+	name := strings.TrimSuffix(fi.Name(), ".data")
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	seq, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	j := strings.LastIndex(name[:i], "-")
+	if j <= 0 {
+		return "", 0, 0, false
+	}
+	partitionID, err = strconv.Atoi(name[j+1 : i])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return name[:j], partitionID, seq, true
+}
+
+//moveFile renames src to dst, or copies it if they are on different file systems
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	tmp, err := os.OpenFile(dst+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, srcFile)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
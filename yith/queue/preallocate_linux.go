@@ -0,0 +1,23 @@
+//go:build linux
+
+package queue
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 //FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 //FALLOC_FL_PUNCH_HOLE
+)
+
+//fallocate reserves the blocks of f from offset on without changing its size, so appends and stat see no difference
+func fallocate(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, offset, length)
+}
+
+//releaseBlocks frees the blocks of f reserved from offset on
+func releaseBlocks(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package queue
+
+import "os"
+
+//segment.preallocate is a no-op without fallocate
+func fallocate(f *os.File, offset, length int64) error {
+	return nil
+}
+
+func releaseBlocks(f *os.File, offset, length int64) error {
+	return nil
+}
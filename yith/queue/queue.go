@@ -2,38 +2,108 @@ package queue
 
 import (
 	"net/http"
+	"strconv"
+	"sync"
 	"yithQ/message"
 )
 
 type Queue struct {
 	mq MemoryQueue
 	dq DiskQueue
+	//Fill holds it shared, TruncateTo exclusive, so no record truncated from disk is filled to memory after the reset
+	truncateLock sync.RWMutex
 }
 
+//NewQueue fills mq from the append loop of dq, so the ring sees the records in offset order
 func NewQueue(mq MemoryQueue, dq DiskQueue) *Queue {
+	if mq != nil {
+		dq.OnAppend(mq.FillToMemory)
+	}
 	return &Queue{
 		mq: mq,
 		dq: dq,
 	}
 }
 
-func (q *Queue) Fill(msgs []*message.Message) error {
-	/*err := q.mq.FillToMemory(msgs)
+//Fill writes msgs to disk, the memory queue only holds what is on disk, it returns the base offset of msgs
+func (q *Queue) Fill(msgs []*message.Message) (int64, error) {
+	q.truncateLock.RLock()
+	defer q.truncateLock.RUnlock()
+	baseOffset, _, err := q.dq.FillToDisk(msgs)
 	if err != nil {
-		return err
-	}*/
-	return q.dq.FillToDisk(msgs)
+		return 0, err
+	}
+	return baseOffset, nil
 }
 
+//Pop serves popOffset from memory if it is near the tail, otherwise from disk
 func (q *Queue) Pop(popOffset int64, amount int, writer http.ResponseWriter) error {
-	/*if popOffset == -1 {
-		q.mq.PopFromMemory(writer)
-		return nil
-	}*/
-	msgsData, err := q.dq.PopFromDisk(popOffset, amount)
+	if q.mq != nil && popOffset >= q.dq.LogStartOffset() {
+		if msgsData, ok := q.mq.PopFromMemory(popOffset, amount); ok {
+			writeRecords(writer, bufferRecords(msgsData))
+			return nil
+		}
+	}
+	records, err := q.dq.PopFromDisk(popOffset, amount)
 	if err != nil {
 		return err
 	}
-	writer.Write(msgsData)
+	defer records.Close()
+	writeRecords(writer, records)
 	return nil
 }
+
+//writeRecords sets Content-Length and Content-Type first, net/http only uses sendfile
+//for a response that is neither chunked nor sniffed
+func writeRecords(writer http.ResponseWriter, records Records) {
+	writer.Header().Set("Content-Length", strconv.FormatInt(records.Size(), 10))
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	records.WriteTo(writer)
+}
+
+func (q *Queue) DeleteExpiredSegments() (int, error) {
+	return q.dq.DeleteExpiredSegments()
+}
+
+func (q *Queue) Offload() (int, error) {
+	return q.dq.Offload()
+}
+
+func (q *Queue) Compact() (int, error) {
+	return q.dq.Compact()
+}
+
+//DeleteRecords returns the new log start offset, the memory queue is left as is, Pop checks the log start offset first
+func (q *Queue) DeleteRecords(beforeOffset int64) (int64, error) {
+	return q.dq.DeleteRecords(beforeOffset)
+}
+
+func (q *Queue) TruncateTo(offset int64) error {
+	q.truncateLock.Lock()
+	defer q.truncateLock.Unlock()
+	err := q.dq.TruncateTo(offset)
+	if q.mq != nil {
+		q.mq.Reset()
+	}
+	return err
+}
+
+func (q *Queue) Snapshot() (*PartitionSnapshot, error) {
+	return q.dq.Snapshot()
+}
+
+func (q *Queue) OffsetForTime(timestamp int64) (int64, error) {
+	return q.dq.OffsetForTime(timestamp)
+}
+
+func (q *Queue) LogStartOffset() int64 {
+	return q.dq.LogStartOffset()
+}
+
+func (q *Queue) LastOffset() int64 {
+	return q.dq.LastOffset()
+}
+
+func (q *Queue) Close() error {
+	return q.dq.Close()
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+//Records is the encoded records popped from a partition, written to the consumer once and then closed
+type Records interface {
+	io.WriterTo
+	io.Closer
+	//Size is the number of bytes WriteTo writes
+	Size() int64
+}
+
+//fileRecords is a range of a segment data file on its own fd. WriteTo hands an *io.LimitedReader
+//of the *os.File to the writer, so net/http and net.TCPConn send it with sendfile,
+//the records are neither mapped nor copied in userspace
+type fileRecords struct {
+	file *os.File
+	size int64
+}
+
+var errSegmentReplaced error = errors.New("segment replaced")
+
+//newFileRecords opens the segment file again, sendfile reads from the file offset so the fd of the segment can not be shared
+func newFileRecords(segment *os.File, position int64, size int64) (*fileRecords, error) {
+	f, err := os.Open(segment.Name())
+	if err != nil {
+		return nil, err
+	}
+	//compaction renames a new segment over the old one, never stream a file the positions were not read from
+	if err := checkSameFile(segment, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(position, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileRecords{file: f, size: size}, nil
+}
+
+func checkSameFile(segment *os.File, f *os.File) error {
+	segmentFi, err := segment.Stat()
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(segmentFi, fi) {
+		return errSegmentReplaced
+	}
+	return nil
+}
+
+func (r *fileRecords) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, &io.LimitedReader{R: r.file, N: r.size})
+}
+
+func (r *fileRecords) Close() error {
+	return r.file.Close()
+}
+
+func (r *fileRecords) Size() int64 {
+	return r.size
+}
+
+//bufferRecords are records held in memory, from the memory queue or a legacy segment
+type bufferRecords []byte
+
+func (r bufferRecords) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
+
+func (r bufferRecords) Close() error {
+	return nil
+}
+
+func (r bufferRecords) Size() int64 {
+	return int64(len(r))
+}
@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"yithQ/message"
+	"yithQ/yith/conf"
+)
+
+//readRecords reads popped records into memory
+func readRecords(records Records, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+	var buf bytes.Buffer
+	if _, err := records.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func TestFileRecords(t *testing.T) {
+	name := t.TempDir() + "/records"
+	if err := ioutil.WriteFile(name, []byte("headerrecordstail"), 0644); err != nil {
+		t.Fatalf("write file error : %v", err)
+	}
+	segment, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("open file error : %v", err)
+	}
+	defer segment.Close()
+	records, err := newFileRecords(segment, 6, 7)
+	if err != nil {
+		t.Fatalf("new file records error : %v", err)
+	}
+	defer records.Close()
+	w := httptest.NewRecorder()
+	writeRecords(w, records)
+	if w.Body.String() != "records" || w.Header().Get("Content-Length") != "7" {
+		t.Fatalf("write records %q, content length %s", w.Body.String(), w.Header().Get("Content-Length"))
+	}
+
+	//a file renamed over the segment, as compaction does, is not streamed
+	if err := ioutil.WriteFile(name+".cleaned", []byte("compacted"), 0644); err != nil {
+		t.Fatalf("write file error : %v", err)
+	}
+	if err := os.Rename(name+".cleaned", name); err != nil {
+		t.Fatalf("rename error : %v", err)
+	}
+	if _, err := newFileRecords(segment, 6, 7); err != errSegmentReplaced {
+		t.Fatalf("records of a replaced segment error is %v", err)
+	}
+}
+
+//the consume path before sendfile: mmap the range and copy it into the response,
+//unmapped here unlike the old read, so the benchmark does not run out of mappings
+func mmapRead(df *DiskFile, msgOffset int64, count int, w http.ResponseWriter) error {
+	_, startPosition, endPosition, err := df.readPosition(msgOffset, count)
+	if err != nil {
+		return err
+	}
+	pagesize := int64(syscall.Getpagesize())
+	alignedStart := startPosition - startPosition%pagesize
+	dataRef, err := syscall.Mmap(int(df.dataFile.Fd()), alignedStart, int(endPosition-alignedStart), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	defer syscall.Munmap(dataRef)
+	w.Write(dataRef[startPosition-alignedStart:])
+	return nil
+}
+
+func benchmarkPop(b *testing.B, pop func(dq *diskQueue, w http.ResponseWriter) error) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(b.TempDir())
+
+	diskQ, err := NewDiskQueue(".", "bench", 1, &conf.TopicConf{FlushPolicy: conf.FlushPolicyOS}, nil, nil)
+	if err != nil {
+		b.Fatalf("new disk queue error : %v", err)
+	}
+	dq := diskQ.(*diskQueue)
+	defer dq.Close()
+	body := make([]byte, 1024)
+	msgs := make([]*message.Message, 0)
+	for i := 0; i < 1024; i++ {
+		msgs = append(msgs, &message.Message{Body: body})
+	}
+	if _, _, err := dq.FillToDisk(msgs); err != nil {
+		b.Fatalf("fill to disk error : %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := pop(dq, w); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			b.Fatalf("get error : %v", err)
+		}
+		n, _ := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("status is %d", resp.StatusCode)
+		}
+		b.SetBytes(n)
+	}
+}
+
+func BenchmarkPopMmap(b *testing.B) {
+	benchmarkPop(b, func(dq *diskQueue, w http.ResponseWriter) error {
+		return mmapRead(dq.storeFiles.Load().([]*DiskFile)[0], 1, 1024, w)
+	})
+}
+
+func BenchmarkPopSendfile(b *testing.B) {
+	benchmarkPop(b, func(dq *diskQueue, w http.ResponseWriter) error {
+		records, err := dq.PopFromDisk(1, 1024)
+		if err != nil {
+			return err
+		}
+		defer records.Close()
+		writeRecords(w, records)
+		return nil
+	})
+}
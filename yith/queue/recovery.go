@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"yithQ/message"
+	. "yithQ/util/logger"
+)
+
+//recover truncates the segment back to its last valid record and rebuilds the index to match,
+//it is called on the last segment of a partition when it is reopened
+func (df *DiskFile) recover() error {
+	name := df.dataFile.Name()
+	if df.isLegacy() {
+		Lg.Warnf("segment(%s) is a legacy json segment, skip recovery", name)
+		return nil
+	}
+	size := atomic.LoadInt64(&df.size)
+	indexes, timeIndexes, validSize, err := scanSegment(df.dataFile, size)
+	if err != nil {
+		return err
+	}
+	if validSize < size {
+		Lg.Warnf("segment(%s) has torn or corrupted records from position %d, truncate %d bytes", name, validSize, size-validSize)
+		if err := df.dataFile.Truncate(validSize); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&df.size, validSize)
+	}
+
+	current, err := ioutil.ReadAll(io.NewSectionReader(df.indexFile, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, indexes) {
+		Lg.Warnf("index of segment(%s) has %d entries but data has %d records, rebuild it", name, len(current)/EachIndexLen, len(indexes)/EachIndexLen)
+		if err := df.indexFile.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := df.indexFile.Write(indexes); err != nil {
+			return err
+		}
+	}
+
+	current, err = ioutil.ReadAll(io.NewSectionReader(df.timeIndexFile, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, timeIndexes.entries) {
+		Lg.Warnf("time index of segment(%s) does not match its data, rebuild it", name)
+		if err := df.timeIndexFile.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := df.timeIndexFile.Write(timeIndexes.entries); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&df.maxTimestamp, timeIndexes.maxTimestamp)
+
+	var startOffset, endOffset int64
+	if len(indexes) != 0 {
+		_, startPosition := decodeIndex(indexes[:EachIndexLen])
+		startOffset, err = readBaseOffset(df.dataFile, startPosition)
+		if err != nil {
+			return err
+		}
+		endOffset, _ = decodeIndex(indexes[len(indexes)-EachIndexLen:])
+	}
+	atomic.StoreInt64(&df.startOffset, startOffset)
+	atomic.StoreInt64(&df.endOffset, endOffset)
+
+	return df.fileSync()
+}
+
+//scanSegment returns the offset and time index of all valid records of a data file,
+//and the position where the valid records end
+func scanSegment(dataFile *os.File, size int64) ([]byte, *timeIndexBuilder, int64, error) {
+	indexes := make([]byte, 0)
+	timeIndexes := &timeIndexBuilder{}
+	validSize, err := walkSegment(dataFile, size, func(rec *SegmentRecord) error {
+		indexes = append(indexes, encodeIndex(rec.Msg.Offset, rec.Position)...)
+		timeIndexes.add(rec.Msg.Timestamp, rec.BaseOffset)
+		return nil
+	})
+	if _, ok := err.(*CorruptionError); err != nil && !ok {
+		return nil, nil, 0, err
+	}
+	return indexes, timeIndexes, validSize, nil
+}
+
+//walkSegment calls fn for every valid record of a data file in order and returns the position where they end,
+//the error is a *CorruptionError if the walk stopped at a torn or corrupted record before size
+func walkSegment(dataFile *os.File, size int64, fn func(rec *SegmentRecord) error) (int64, error) {
+	reader := bufio.NewReaderSize(io.NewSectionReader(dataFile, SegmentHeaderLen, size-SegmentHeaderLen), 1<<20)
+	position := int64(SegmentHeaderLen)
+	lastOffset := int64(-1)
+	head := make([]byte, message.RecordLogOverhead)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			if err == io.EOF {
+				return position, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return position, &CorruptionError{Position: position, Reason: ErrTornRecord}
+			}
+			return position, err
+		}
+		offset, recordSize, err := message.RecordHead(head)
+		if err != nil {
+			return position, &CorruptionError{Position: position, Reason: err}
+		}
+		if offset <= lastOffset {
+			return position, &CorruptionError{Position: position, Reason: ErrOffsetNotIncreasing}
+		}
+		if int64(recordSize) > DiskFileSizeLimit || position+int64(recordSize) > size {
+			return position, &CorruptionError{Position: position, Reason: ErrTornRecord}
+		}
+		record := make([]byte, recordSize)
+		copy(record, head)
+		if _, err := io.ReadFull(reader, record[message.RecordLogOverhead:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return position, &CorruptionError{Position: position, Reason: ErrTornRecord}
+			}
+			return position, err
+		}
+		msg, _, err := message.DecodeRecord(record)
+		if err != nil {
+			return position, &CorruptionError{Position: position, Reason: err}
+		}
+		baseOffset, err := recordBaseOffset(msg)
+		if err != nil {
+			return position, &CorruptionError{Position: position, Reason: err}
+		}
+		if baseOffset <= lastOffset {
+			return position, &CorruptionError{Position: position, Reason: ErrOffsetNotIncreasing}
+		}
+		if err := fn(&SegmentRecord{Position: position, Size: recordSize, BaseOffset: baseOffset, Msg: msg}); err != nil {
+			return position, err
+		}
+		position += int64(recordSize)
+		lastOffset = offset
+	}
+}
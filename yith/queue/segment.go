@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"yithQ/message"
+)
+
+//segment header at the head of every .data file:
+//
+//	magic   uint32
+//	version uint16
+//	flags   uint16
+//	keyID   uint32  the key of an encrypted segment, since SegmentVersionV2
+//	reserved [4]byte
+const (
+	SegmentMagic         uint32 = 0x59495448 //"YITH"
+	SegmentHeaderLen            = 16
+	legacySegmentVersion uint16 = 0 //json + ',' records without header
+	SegmentVersionV1     uint16 = 1
+	//adds flags and keyID, only encrypted segments are written with it so the others stay readable by older brokers
+	SegmentVersionV2      uint16 = 2
+	CurrentSegmentVersion        = SegmentVersionV2
+
+	segmentFlagEncrypted uint16 = 1
+)
+
+var ErrUnknownSegmentVersion error = errors.New("unknown segment version")
+
+type segmentHeader struct {
+	version uint16
+	flags   uint16
+	keyID   uint32
+}
+
+func (h segmentHeader) encrypted() bool {
+	return h.flags&segmentFlagEncrypted != 0
+}
+
+func encodeSegmentHeader(version uint16) []byte {
+	return segmentHeader{version: version}.encode()
+}
+
+func encodeEncryptedSegmentHeader(keyID uint32) []byte {
+	return segmentHeader{version: SegmentVersionV2, flags: segmentFlagEncrypted, keyID: keyID}.encode()
+}
+
+func (h segmentHeader) encode() []byte {
+	header := make([]byte, SegmentHeaderLen)
+	binary.BigEndian.PutUint32(header, SegmentMagic)
+	binary.BigEndian.PutUint16(header[4:], h.version)
+	binary.BigEndian.PutUint16(header[6:], h.flags)
+	binary.BigEndian.PutUint32(header[8:], h.keyID)
+	return header
+}
+
+//readSegmentHeader returns legacySegmentVersion if the data file has no header
+func readSegmentHeader(f *os.File, size int64) (segmentHeader, error) {
+	if size < SegmentHeaderLen {
+		return segmentHeader{version: legacySegmentVersion}, nil
+	}
+	header := make([]byte, SegmentHeaderLen)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return segmentHeader{}, err
+	}
+	if binary.BigEndian.Uint32(header) != SegmentMagic {
+		return segmentHeader{version: legacySegmentVersion}, nil
+	}
+	h := segmentHeader{version: binary.BigEndian.Uint16(header[4:])}
+	if h.version > CurrentSegmentVersion {
+		return segmentHeader{}, ErrUnknownSegmentVersion
+	}
+	if h.version >= SegmentVersionV2 {
+		h.flags = binary.BigEndian.Uint16(header[6:])
+		h.keyID = binary.BigEndian.Uint32(header[8:])
+	}
+	return h, nil
+}
+
+//convertLegacyRecords re-encodes json records of a legacy segment (without the trailing ',') to the record format
+func convertLegacyRecords(data []byte, firstOffset int64) ([]byte, error) {
+	var msgs []*message.Message
+	err := json.Unmarshal([]byte("["+string(data)+"]"), &msgs)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]byte, 0, len(data))
+	for i, msg := range msgs {
+		msg.Offset = firstOffset + int64(i)
+		records = message.AppendRecord(records, msg)
+	}
+	return records, nil
+}
@@ -0,0 +1,248 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"yithQ/message"
+)
+
+//PartitionSnapshot is a point-in-time copy of a partition log taken while it goes on being written.
+//Local segments are reopened under filesLock and cut at their size at that moment,
+//so retention, compaction and new appends after it do not change what is read
+type PartitionSnapshot struct {
+	LogStartOffset int64
+	LastOffset     int64
+	Segments       []*SnapshotSegment
+	files          []*os.File
+}
+
+type SnapshotSegment struct {
+	Seq         int
+	StartOffset int64
+	EndOffset   int64
+	ModTime     time.Time
+	//the .data, .index and .timeindex of the segment in this order
+	Files []*SnapshotFile
+}
+
+type SnapshotFile struct {
+	Ext    string
+	Size   int64
+	Reader io.Reader
+}
+
+var segmentExts = []string{".data", ".index", ".timeindex"}
+
+//Close closes the files held open by the snapshot
+func (s *PartitionSnapshot) Close() error {
+	var err error
+	for _, f := range s.files {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.files = nil
+	return err
+}
+
+func (dq *diskQueue) Snapshot() (*PartitionSnapshot, error) {
+	snapshot := &PartitionSnapshot{}
+	//the remote segments are pinned until they are downloaded, retention deletes them after releasing filesLock
+	if dq.remote != nil {
+		dq.remote.pinLock.RLock()
+		defer dq.remote.pinLock.RUnlock()
+	}
+	dq.filesLock.Lock()
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	snapshot.LogStartOffset = dq.LogStartOffset()
+	var remoteSegments []RemoteSegment
+	if dq.remote != nil {
+		remoteSegments = dq.remote.getSegments()
+	}
+	local := make([]*SnapshotSegment, 0, len(storeFiles))
+	for _, df := range storeFiles {
+		seg, err := df.snapshot(snapshot)
+		if err != nil {
+			dq.filesLock.Unlock()
+			snapshot.Close()
+			return nil, err
+		}
+		local = append(local, seg)
+	}
+	dq.filesLock.Unlock()
+
+	//the remote segments that are no longer on local disk, downloaded in full since they are sealed
+	for _, rs := range remoteSegments {
+		if len(storeFiles) != 0 && rs.Seq >= storeFiles[0].seq {
+			break
+		}
+		//dropped by retention, not deleted remotely yet
+		if rs.EndOffset < snapshot.LogStartOffset {
+			continue
+		}
+		seg, err := dq.remote.snapshot(rs, snapshot)
+		if err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+		snapshot.Segments = append(snapshot.Segments, seg)
+	}
+	snapshot.Segments = append(snapshot.Segments, local...)
+	snapshot.LastOffset = snapshot.LogStartOffset - 1
+	for _, seg := range snapshot.Segments {
+		if seg.EndOffset > snapshot.LastOffset {
+			snapshot.LastOffset = seg.EndOffset
+		}
+	}
+	return snapshot, nil
+}
+
+//snapshot reopens the files of the segment, the index entries of records beyond the data size are left out.
+//A record is written to the data file before its index entries and the size is moved after both, so the cut is consistent
+func (df *DiskFile) snapshot(snapshot *PartitionSnapshot) (*SnapshotSegment, error) {
+	size := atomic.LoadInt64(&df.size)
+	files := make([]*os.File, 0, len(segmentExts))
+	for _, segmentFile := range []*os.File{df.dataFile, df.indexFile, df.timeIndexFile} {
+		f, err := os.Open(segmentFile.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshot.files = append(snapshot.files, f)
+		files = append(files, f)
+	}
+	dataFi, err := files[0].Stat()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := files[1].Stat()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := searchEntries(files[1], fi.Size()/EachIndexLen, func(msgOffset, position int64) bool {
+		return position >= size
+	})
+	if err != nil {
+		return nil, err
+	}
+	seg := &SnapshotSegment{Seq: df.seq, ModTime: dataFi.ModTime()}
+	if entries != 0 {
+		seg.StartOffset = df.getStartOffset()
+		seg.EndOffset, _, err = readEntry(files[1], entries-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fi, err = files[2].Stat()
+	if err != nil {
+		return nil, err
+	}
+	timeEntries, err := searchEntries(files[2], fi.Size()/EachIndexLen, func(timestamp, msgOffset int64) bool {
+		return msgOffset > seg.EndOffset
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range []int64{size, entries * EachIndexLen, timeEntries * EachIndexLen} {
+		seg.Files = append(seg.Files, &SnapshotFile{
+			Ext:    segmentExts[i],
+			Size:   n,
+			Reader: io.NewSectionReader(files[i], 0, n),
+		})
+	}
+	return seg, nil
+}
+
+//searchEntries returns the first entry of an index file for which f is true, entries if there is none
+func searchEntries(indexFile *os.File, entries int64, f func(first, second int64) bool) (int64, error) {
+	var searchErr error
+	i := sort.Search(int(entries), func(i int) bool {
+		first, second, err := readEntry(indexFile, int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return f(first, second)
+	})
+	return int64(i), searchErr
+}
+
+func readEntry(indexFile *os.File, entry int64) (int64, int64, error) {
+	index := make([]byte, EachIndexLen)
+	if _, err := indexFile.ReadAt(index, entry*EachIndexLen); err != nil {
+		return 0, 0, err
+	}
+	first, second := decodeIndex(index)
+	return first, second, nil
+}
+
+//snapshot downloads a remote segment to a temp dir of the cache, the files are removed once opened
+func (rl *remoteLog) snapshot(rs RemoteSegment, snapshot *PartitionSnapshot) (*SnapshotSegment, error) {
+	if err := os.MkdirAll(rl.cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(rl.cacheDir, "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	seg := &SnapshotSegment{Seq: rs.Seq, StartOffset: rs.StartOffset, EndOffset: rs.EndOffset, ModTime: rs.ModTime}
+	name := segmentFilePrefix + "_" + strconv.Itoa(rs.Seq)
+	for _, ext := range segmentExts {
+		path := filepath.Join(dir, name+ext)
+		if err := rl.getFile(name+ext, path); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.files = append(snapshot.files, f)
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		seg.Files = append(seg.Files, &SnapshotFile{Ext: ext, Size: fi.Size(), Reader: f})
+	}
+	return seg, nil
+}
+
+//Snapshot encodes the segments as segment files in memory
+func (ml *memoryLog) Snapshot() (*PartitionSnapshot, error) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	snapshot := &PartitionSnapshot{
+		LogStartOffset: ml.logStartOffset,
+		LastOffset:     ml.lastOffset,
+	}
+	for i, seg := range ml.segments {
+		data := encodeSegmentHeader(SegmentVersionV1)
+		indexes := make([]byte, 0, len(seg.records)*EachIndexLen)
+		timeIndexes := &timeIndexBuilder{}
+		for _, msg := range seg.records {
+			indexes = append(indexes, encodeIndex(msg.Offset, int64(len(data)))...)
+			timeIndexes.add(msg.Timestamp, msg.BaseOffset())
+			data = message.AppendRecord(data, msg)
+		}
+		ss := &SnapshotSegment{Seq: i + 1, ModTime: seg.modified}
+		if len(seg.records) != 0 {
+			ss.StartOffset = seg.records[0].BaseOffset()
+			ss.EndOffset = seg.records[len(seg.records)-1].Offset
+		}
+		for j, content := range [][]byte{data, indexes, timeIndexes.entries} {
+			ss.Files = append(ss.Files, &SnapshotFile{
+				Ext:    segmentExts[j],
+				Size:   int64(len(content)),
+				Reader: bytes.NewReader(content),
+			})
+		}
+		snapshot.Segments = append(snapshot.Segments, ss)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,542 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yithQ/yith/conf"
+)
+
+//tiered storage: the leader uploads the sealed segments of a partition to an object store,
+//under <topic>/<partition id>/ together with a manifest listing them in offset order.
+//Uploaded segments are deleted locally by local.retention.*, and fetched back on demand when consumed
+const (
+	remoteManifestKey = "manifest.json"
+	remoteCacheDir    = "remote-cache"
+	//fetched segments kept in remoteCacheDir
+	remoteCacheSegments = 2
+)
+
+var ErrUnknownObjectStore error = errors.New("unknown object store type")
+
+//ObjectStore is the remote storage of sealed segments, keys are paths separated by '/'
+type ObjectStore interface {
+	Put(key string, r io.Reader) error
+	//Get returns an error matching os.ErrNotExist if the key does not exist
+	Get(key string) (io.ReadCloser, error)
+	//Delete is nil if the key does not exist
+	Delete(key string) error
+}
+
+//NewObjectStore returns nil if remote_storage is not configured
+func NewObjectStore(cfg *conf.RemoteStorageConf) (ObjectStore, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Type {
+	case conf.RemoteStorageLocal:
+		if cfg.Dir == "" {
+			return nil, errors.New("dir of local remote storage is not set")
+		}
+		return NewLocalObjectStore(cfg.Dir), nil
+	}
+	return nil, errors.Wrap(ErrUnknownObjectStore, cfg.Type)
+}
+
+//LocalObjectStore keeps every object as a file under dir
+type LocalObjectStore struct {
+	dir string
+}
+
+func NewLocalObjectStore(dir string) *LocalObjectStore {
+	return &LocalObjectStore{dir: dir}
+}
+
+func (s *LocalObjectStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+//Put writes a temp file and renames it, so Get never sees a partial object
+func (s *LocalObjectStore) Put(key string, r io.Reader) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *LocalObjectStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *LocalObjectStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//RemoteSegment is an entry of the manifest
+type RemoteSegment struct {
+	Seq          int   `json:"seq"`
+	StartOffset  int64 `json:"start_offset"`
+	EndOffset    int64 `json:"end_offset"`
+	Size         int64 `json:"size"`
+	MaxTimestamp int64 `json:"max_timestamp"`
+	//mod time of the local segment, retention.ms counts from it
+	ModTime time.Time `json:"mod_time"`
+}
+
+type remoteLog struct {
+	store    ObjectStore
+	prefix   string
+	cacheDir string
+	//manifestLock serializes the changes of the manifest, it is held across the object store calls
+	manifestLock sync.Mutex
+	//pinLock is held shared while a snapshot downloads segments, deleteThrough holds it exclusive
+	pinLock sync.RWMutex
+	//lock guards segments, cached and fetching, it is never held across an object store call
+	lock     sync.Mutex
+	segments []RemoteSegment
+	//fetched segments, the oldest fetched first
+	cached []*DiskFile
+	//the downloads in flight by seq, a segment is downloaded once however many readers wait for it
+	fetching map[int]*remoteFetch
+	//the segments are uploaded as stored, encrypted ones are opened with its keys
+	encryption *encryption
+}
+
+type remoteFetch struct {
+	done chan struct{}
+	df   *DiskFile
+	err  error
+}
+
+//remoteReadRetries bounds the retries of a read whose fetched segment was evicted before it was read
+const remoteReadRetries = 3
+
+//openRemoteLog loads the manifest of the partition, the fetched segments of the last run are dropped
+func openRemoteLog(store ObjectStore, dir, topic string, partitionID int, enc *encryption) (*remoteLog, error) {
+	rl := &remoteLog{
+		store:      store,
+		prefix:     topic + "/" + strconv.Itoa(partitionID) + "/",
+		cacheDir:   filepath.Join(dir, remoteCacheDir),
+		segments:   make([]RemoteSegment, 0),
+		cached:     make([]*DiskFile, 0),
+		fetching:   make(map[int]*remoteFetch),
+		encryption: enc,
+	}
+	if err := os.RemoveAll(rl.cacheDir); err != nil {
+		return nil, err
+	}
+	r, err := store.Get(rl.prefix + remoteManifestKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return rl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&rl.segments); err != nil {
+		return nil, errors.Wrap(err, rl.prefix+remoteManifestKey)
+	}
+	return rl, nil
+}
+
+func (rl *remoteLog) getSegments() []RemoteSegment {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.segments
+}
+
+//lastSeq is 0 if nothing was uploaded
+func (rl *remoteLog) lastSeq() int {
+	segments := rl.getSegments()
+	if len(segments) == 0 {
+		return 0
+	}
+	return segments[len(segments)-1].Seq
+}
+
+//saveManifest replaces the manifest with segments, the caller holds manifestLock
+func (rl *remoteLog) saveManifest(segments []RemoteSegment) error {
+	data, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	if err := rl.store.Put(rl.prefix+remoteManifestKey, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	rl.lock.Lock()
+	rl.segments = segments
+	rl.lock.Unlock()
+	return nil
+}
+
+//upload puts the files of a sealed segment first, a segment is only in the manifest once it is complete
+func (rl *remoteLog) upload(df *DiskFile) error {
+	for _, f := range []*os.File{df.dataFile, df.indexFile, df.timeIndexFile} {
+		if err := rl.putFile(f.Name()); err != nil {
+			return err
+		}
+	}
+	modTime, err := df.modTime()
+	if err != nil {
+		return err
+	}
+	rl.manifestLock.Lock()
+	defer rl.manifestLock.Unlock()
+	current := rl.getSegments()
+	segments := make([]RemoteSegment, len(current), len(current)+1)
+	copy(segments, current)
+	return rl.saveManifest(append(segments, RemoteSegment{
+		Seq:          df.seq,
+		StartOffset:  df.getStartOffset(),
+		EndOffset:    df.getEndOffset(),
+		Size:         atomic.LoadInt64(&df.size),
+		MaxTimestamp: df.getMaxTimestamp(),
+		ModTime:      modTime,
+	}))
+}
+
+func (rl *remoteLog) putFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rl.store.Put(rl.prefix+filepath.Base(name), f)
+}
+
+//deleteThrough removes the segments up to seq from the manifest first, a crash leaves unreferenced objects behind
+//instead of a manifest referencing deleted ones. Deleting segments that are gone already is a no-op,
+//so the callers decide what to delete under filesLock and call it after releasing filesLock
+func (rl *remoteLog) deleteThrough(seq int) error {
+	rl.pinLock.Lock()
+	defer rl.pinLock.Unlock()
+	rl.manifestLock.Lock()
+	defer rl.manifestLock.Unlock()
+	current := rl.getSegments()
+	n := 0
+	for n < len(current) && current[n].Seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := rl.saveManifest(current[n:]); err != nil {
+		return err
+	}
+	for _, seg := range current[:n] {
+		for _, ext := range []string{".data", ".index", ".timeindex"} {
+			if err := rl.store.Delete(rl.prefix + segmentFilePrefix + "_" + strconv.Itoa(seg.Seq) + ext); err != nil {
+				return err
+			}
+		}
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	remain := make([]*DiskFile, 0, len(rl.cached))
+	for _, df := range rl.cached {
+		if df.seq > seq {
+			remain = append(remain, df)
+		} else if err := df.delete(); err != nil {
+			return err
+		}
+	}
+	rl.cached = remain
+	return nil
+}
+
+//read serves msgOffset from the first remote segment whose EndOffset >= msgOffset,
+//the records stay readable on their own fd if the segment is evicted meanwhile
+func (rl *remoteLog) read(msgOffset int64, amount int) (Records, error) {
+	for retries := 0; ; retries++ {
+		segments := rl.getSegments()
+		//the segment may have been deleted by retention after the caller checked the log start offset
+		if len(segments) == 0 || msgOffset < segments[0].StartOffset {
+			return nil, ErrOffsetOutOfRange
+		}
+		i := sort.Search(len(segments), func(i int) bool {
+			return segments[i].EndOffset >= msgOffset
+		})
+		if i == len(segments) {
+			return nil, ErrNoneMsg
+		}
+		df, err := rl.fetch(segments[i].Seq)
+		if err != nil {
+			return nil, err
+		}
+		records, err := df.read(msgOffset, amount)
+		if evicted(err) && retries < remoteReadRetries {
+			continue
+		}
+		return records, err
+	}
+}
+
+//offsetForTime searches the remote segments below localStartOffset, the others are searched locally
+func (rl *remoteLog) offsetForTime(timestamp int64, localStartOffset int64) (int64, bool, error) {
+	for _, seg := range rl.getSegments() {
+		if seg.StartOffset >= localStartOffset {
+			break
+		}
+		if seg.MaxTimestamp < timestamp {
+			continue
+		}
+		for retries := 0; ; retries++ {
+			df, err := rl.fetch(seg.Seq)
+			if err != nil {
+				return 0, false, err
+			}
+			msgOffset, ok, err := df.offsetForTime(timestamp)
+			if evicted(err) && retries < remoteReadRetries {
+				continue
+			}
+			if err != nil || ok {
+				return msgOffset, ok, err
+			}
+			break
+		}
+	}
+	return 0, false, nil
+}
+
+//evicted is true for the errors of reading a fetched segment deleted meanwhile
+func evicted(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrNotExist)
+}
+
+//fetch returns the cached segment, or downloads it without lock and evicts the oldest fetched one,
+//concurrent fetches of the same segment wait for one download
+func (rl *remoteLog) fetch(seq int) (*DiskFile, error) {
+	rl.lock.Lock()
+	for _, df := range rl.cached {
+		if df.seq == seq {
+			rl.lock.Unlock()
+			return df, nil
+		}
+	}
+	if f, ok := rl.fetching[seq]; ok {
+		rl.lock.Unlock()
+		<-f.done
+		return f.df, f.err
+	}
+	f := &remoteFetch{done: make(chan struct{})}
+	rl.fetching[seq] = f
+	rl.lock.Unlock()
+
+	f.df, f.err = rl.download(seq)
+
+	rl.lock.Lock()
+	delete(rl.fetching, seq)
+	if f.err == nil {
+		f.err = rl.addCached(f.df)
+	}
+	rl.lock.Unlock()
+	close(f.done)
+	return f.df, f.err
+}
+
+//addCached keeps a downloaded segment unless retention deleted it meanwhile, the caller holds lock
+func (rl *remoteLog) addCached(df *DiskFile) error {
+	i := sort.Search(len(rl.segments), func(i int) bool {
+		return rl.segments[i].Seq >= df.seq
+	})
+	if i == len(rl.segments) || rl.segments[i].Seq != df.seq {
+		df.delete()
+		return ErrOffsetOutOfRange
+	}
+	rl.cached = append(rl.cached, df)
+	if len(rl.cached) > remoteCacheSegments {
+		oldest := rl.cached[0]
+		rl.cached = rl.cached[1:]
+		return oldest.delete()
+	}
+	return nil
+}
+
+func (rl *remoteLog) download(seq int) (*DiskFile, error) {
+	if err := os.MkdirAll(rl.cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	name := segmentFilePrefix + "_" + strconv.Itoa(seq)
+	for _, ext := range []string{".data", ".index", ".timeindex"} {
+		if err := rl.getFile(name+ext, filepath.Join(rl.cacheDir, name+ext)); err != nil {
+			return nil, err
+		}
+	}
+	return newDiskFile(filepath.Join(rl.cacheDir, segmentFilePrefix), seq, true, rl.encryption)
+}
+
+func (rl *remoteLog) getFile(key, path string) error {
+	r, err := rl.store.Get(rl.prefix + key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (rl *remoteLog) close() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for _, df := range rl.cached {
+		df.close()
+	}
+}
+
+//Offload uploads the sealed segments newer than the last uploaded one and returns how many were uploaded
+func (dq *diskQueue) Offload() (int, error) {
+	if dq.remote == nil {
+		return 0, nil
+	}
+	//segments are only deleted by DeleteExpiredSegments, which the cleaner runs after Offload
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	lastSeq := dq.remote.lastSeq()
+	uploaded := 0
+	for i := 0; i < len(storeFiles)-1; i++ {
+		df := storeFiles[i]
+		if df.seq <= lastSeq || df.getEndOffset() == 0 {
+			continue
+		}
+		if err := dq.remote.upload(df); err != nil {
+			return uploaded, err
+		}
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+//deleteTieredSegments applies retention.* to the whole log by deleting the oldest remote segments,
+//then deletes the local copies of uploaded segments that are gone remotely or out of local.retention.*.
+//The remote segments are deleted after filesLock is released
+func (dq *diskQueue) deleteTieredSegments() (int, error) {
+	deleted, deletedSeq, err := dq.dropTieredSegments()
+	if err == nil && deletedSeq != 0 {
+		err = dq.remote.deleteThrough(deletedSeq)
+	}
+	return deleted, err
+}
+
+//dropTieredSegments moves the log start offset, deletes the local segments and returns the seq of the last remote
+//segment to delete, 0 if none
+func (dq *diskQueue) dropTieredSegments() (int, int, error) {
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	segments := dq.remote.getSegments()
+	var uploadedSeq int
+	if len(segments) != 0 {
+		uploadedSeq = segments[len(segments)-1].Seq
+	}
+	var totalSize, localSize int64
+	for _, seg := range segments {
+		totalSize += seg.Size
+	}
+	for _, df := range storeFiles {
+		size := atomic.LoadInt64(&df.size)
+		localSize += size
+		if df.seq > uploadedSeq {
+			totalSize += size
+		}
+	}
+
+	now := time.Now()
+	remoteDeleted := 0
+	for _, seg := range segments {
+		if !outOfRetention(now, seg.ModTime, seg.Size, totalSize, dq.cfg.RetentionMs, dq.cfg.RetentionBytes) {
+			break
+		}
+		totalSize -= seg.Size
+		remoteDeleted++
+	}
+	var deletedSeq int
+	if remoteDeleted != 0 {
+		deletedSeq = segments[remoteDeleted-1].Seq
+	}
+
+	localRetentionMs, localRetentionBytes := dq.cfg.LocalRetention()
+	localDeleted := 0
+	//the last segment is the writing one and never deleted, nor are the ones not uploaded yet
+	for i := 0; i < len(storeFiles)-1 && storeFiles[i].seq <= uploadedSeq; i++ {
+		df := storeFiles[i]
+		size := atomic.LoadInt64(&df.size)
+		if df.seq > deletedSeq {
+			modTime, err := df.modTime()
+			if err != nil {
+				return 0, 0, err
+			}
+			if !outOfRetention(now, modTime, size, localSize, localRetentionMs, localRetentionBytes) {
+				break
+			}
+		}
+		localSize -= size
+		localDeleted++
+	}
+	if remoteDeleted == 0 && localDeleted == 0 {
+		return 0, 0, nil
+	}
+
+	remainFiles := make([]*DiskFile, len(storeFiles)-localDeleted)
+	copy(remainFiles, storeFiles[localDeleted:])
+	//the log start offset moves before the segments are dropped, see popFromSegments.
+	//DeleteRecords may have moved it into the first segment kept already
+	if remoteDeleted < len(segments) {
+		dq.advanceLogStartOffset(segments[remoteDeleted].StartOffset)
+	} else {
+		dq.advanceLogStartOffset(dq.startOffsetOf(remainFiles))
+	}
+	dq.storeFiles.Store(remainFiles)
+
+	for _, df := range storeFiles[:localDeleted] {
+		if err := df.delete(); err != nil {
+			return remoteDeleted + localDeleted, deletedSeq, err
+		}
+	}
+	return remoteDeleted + localDeleted, deletedSeq, nil
+}
+
+//localStartOffset is the first offset still on local disk
+func (dq *diskQueue) localStartOffset() int64 {
+	return dq.startOffsetOf(dq.storeFiles.Load().([]*DiskFile))
+}
+
+func (dq *diskQueue) startOffsetOf(storeFiles []*DiskFile) int64 {
+	if len(storeFiles) != 0 && storeFiles[0].getStartOffset() != 0 {
+		return storeFiles[0].getStartOffset()
+	}
+	return dq.getLastOffset() + 1
+}
@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+//the .timeindex file of a segment holds an entry (timestamp, offset) for every record whose timestamp
+//is larger than all records before it in the segment, entries are encoded like the offset index.
+//So the first entry whose timestamp >= t points exactly at the first record at or after t
+
+type timeIndexBuilder struct {
+	maxTimestamp int64
+	entries      []byte
+}
+
+func (b *timeIndexBuilder) add(timestamp, msgOffset int64) {
+	if timestamp > b.maxTimestamp {
+		b.maxTimestamp = timestamp
+		b.entries = append(b.entries, encodeIndex(timestamp, msgOffset)...)
+	}
+}
+
+//openTimeIndex returns the time index file and the timestamps of its first and last entry
+func openTimeIndex(name string, seq int) (*os.File, int64, int64, error) {
+	timeIndexf, err := os.OpenFile(name+"_"+strconv.Itoa(seq)+".timeindex", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	fi, err := timeIndexf.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var firstTimestamp, maxTimestamp int64
+	if fi.Size() >= EachIndexLen {
+		entry := make([]byte, EachIndexLen)
+		if _, err := timeIndexf.ReadAt(entry, 0); err != nil {
+			return nil, 0, 0, err
+		}
+		firstTimestamp, _ = decodeIndex(entry)
+		if _, err := timeIndexf.ReadAt(entry, fi.Size()/EachIndexLen*EachIndexLen-EachIndexLen); err != nil {
+			return nil, 0, 0, err
+		}
+		maxTimestamp, _ = decodeIndex(entry)
+	}
+	return timeIndexf, firstTimestamp, maxTimestamp, nil
+}
+
+func (df *DiskFile) getMaxTimestamp() int64 {
+	return atomic.LoadInt64(&df.maxTimestamp)
+}
+
+//offsetForTime returns the offset of the first record whose timestamp >= timestamp, false if there is none
+func (df *DiskFile) offsetForTime(timestamp int64) (int64, bool, error) {
+	if df.getMaxTimestamp() < timestamp {
+		return 0, false, nil
+	}
+	fi, err := df.timeIndexFile.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	entries := int(fi.Size() / EachIndexLen)
+	var searchErr error
+	entry := make([]byte, EachIndexLen)
+	i := sort.Search(entries, func(i int) bool {
+		if _, err := df.timeIndexFile.ReadAt(entry, int64(i)*EachIndexLen); err != nil {
+			searchErr = err
+			return true
+		}
+		ts, _ := decodeIndex(entry)
+		return ts >= timestamp
+	})
+	if searchErr != nil {
+		return 0, false, searchErr
+	}
+	if i == entries {
+		return 0, false, nil
+	}
+	if _, err := df.timeIndexFile.ReadAt(entry, int64(i)*EachIndexLen); err != nil {
+		return 0, false, err
+	}
+	_, msgOffset := decodeIndex(entry)
+	return msgOffset, true, nil
+}
+
+//OffsetForTime returns the first offset whose record timestamp >= timestamp(unix nano),
+//the next offset to be written if all records are older
+func (dq *diskQueue) OffsetForTime(timestamp int64) (int64, error) {
+	if dq.remote != nil {
+		msgOffset, ok, err := dq.remote.offsetForTime(timestamp, dq.localStartOffset())
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if msgOffset < dq.LogStartOffset() {
+				return dq.LogStartOffset(), nil
+			}
+			return msgOffset, nil
+		}
+	}
+	for _, df := range dq.storeFiles.Load().([]*DiskFile) {
+		//legacy segments have no time index
+		if df.isLegacy() {
+			continue
+		}
+		msgOffset, ok, err := df.offsetForTime(timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if msgOffset < dq.LogStartOffset() {
+				return dq.LogStartOffset(), nil
+			}
+			return msgOffset, nil
+		}
+	}
+	return dq.getLastOffset() + 1, nil
+}
@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	. "yithQ/util/logger"
+)
+
+//DeleteRecords moves the log start offset forward and persists it in a checkpoint, so the records before it
+//stay hidden after a restart. Segments entirely before it are deleted, a segment holding it is only hidden
+//until retention deletes it. TruncateTo cuts the tail of the log instead, ep: the divergent tail of a replica
+const logStartOffsetFile = "log-start-offset"
+
+var ErrTruncateUploaded error = errors.New("can not truncate segments uploaded to remote storage")
+
+type truncateRequest struct {
+	offset int64
+	result chan error
+}
+
+//DeleteRecords makes beforeOffset the log start offset and returns the new log start offset,
+//which is larger if retention already deleted beyond beforeOffset.
+//The remote segments before it are deleted after filesLock is released
+func (dq *diskQueue) DeleteRecords(beforeOffset int64) (int64, error) {
+	logStartOffset, remoteSeq, err := dq.deleteRecords(beforeOffset)
+	if err == nil && remoteSeq != 0 {
+		err = dq.remote.deleteThrough(remoteSeq)
+	}
+	return logStartOffset, err
+}
+
+//deleteRecords moves the log start offset, deletes the local segments before it
+//and returns the seq of the last remote segment before it, 0 if none
+func (dq *diskQueue) deleteRecords(beforeOffset int64) (int64, int, error) {
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+
+	if beforeOffset > dq.getLastOffset()+1 {
+		return 0, 0, ErrOffsetOutOfRange
+	}
+	if beforeOffset <= dq.LogStartOffset() {
+		return dq.LogStartOffset(), 0, nil
+	}
+	if err := writeLogStartOffset(filepath.Dir(dq.fileNamePrefix), beforeOffset); err != nil {
+		return 0, 0, err
+	}
+	//before the segments are dropped, see popFromSegments
+	dq.advanceLogStartOffset(beforeOffset)
+
+	remoteSeq := 0
+	if dq.remote != nil {
+		for _, seg := range dq.remote.getSegments() {
+			if seg.EndOffset >= beforeOffset {
+				break
+			}
+			remoteSeq = seg.Seq
+		}
+	}
+
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	deleted := 0
+	//the last segment is the writing one and never deleted
+	for deleted < len(storeFiles)-1 && storeFiles[deleted].getEndOffset() < beforeOffset {
+		deleted++
+	}
+	if deleted == 0 {
+		return beforeOffset, remoteSeq, nil
+	}
+	remainFiles := make([]*DiskFile, len(storeFiles)-deleted)
+	copy(remainFiles, storeFiles[deleted:])
+	dq.storeFiles.Store(remainFiles)
+	for _, df := range storeFiles[:deleted] {
+		if err := df.delete(); err != nil {
+			return beforeOffset, remoteSeq, err
+		}
+	}
+	Lg.Infof("delete records of partition(%s) before offset %d, %d segments deleted", dq.fileNamePrefix, beforeOffset, deleted)
+	return beforeOffset, remoteSeq, nil
+}
+
+//TruncateTo removes the records from offset on, so offset is the next one written.
+//A compressed batch holding offset is removed whole, offset must not be before the local segments
+func (dq *diskQueue) TruncateTo(offset int64) error {
+	req := &truncateRequest{
+		offset: offset,
+		result: make(chan error, 1),
+	}
+	select {
+	case dq.truncateCh <- req:
+	case <-dq.closing:
+		return ErrQueueClosed
+	}
+	return <-req.result
+}
+
+//truncateTo runs in the append loop, which owns writingFile and lastFileSeq.
+//It takes compactLock first, the segment holding offset is replaced through .cleaned files as compaction does
+func (dq *diskQueue) truncateTo(offset int64) error {
+	if offset > dq.getLastOffset() {
+		return nil
+	}
+	dq.compactLock.Lock()
+	defer dq.compactLock.Unlock()
+	dq.filesLock.Lock()
+	defer dq.filesLock.Unlock()
+
+	storeFiles := dq.storeFiles.Load().([]*DiskFile)
+	if offset < dq.LogStartOffset() || offset < dq.startOffsetOf(storeFiles) {
+		return ErrOffsetOutOfRange
+	}
+	if dq.remote != nil {
+		if segments := dq.remote.getSegments(); len(segments) != 0 && segments[len(segments)-1].EndOffset >= offset {
+			return ErrTruncateUploaded
+		}
+	}
+	i := findSegmentByOffset(storeFiles, offset)
+	if i == len(storeFiles) {
+		return nil
+	}
+	//the segments after the one holding offset are dropped before it is cut, readers retry on the deleted ones
+	remainFiles := make([]*DiskFile, i+1)
+	copy(remainFiles, storeFiles[:i+1])
+	dq.storeFiles.Store(remainFiles)
+	for _, df := range storeFiles[i+1:] {
+		if err := df.delete(); err != nil {
+			return err
+		}
+	}
+	//the segment is never cut in place, a reader streaming it would send less than the size it announced
+	cleaned, err := storeFiles[i].truncatedCopy(offset)
+	if err != nil {
+		return err
+	}
+	df, err := dq.swapSegment(cleaned)
+	if err != nil {
+		return err
+	}
+	df.isFull = false
+	truncatedFiles := make([]*DiskFile, i+1)
+	copy(truncatedFiles, remainFiles)
+	truncatedFiles[i] = df
+	dq.storeFiles.Store(truncatedFiles)
+	storeFiles[i].close()
+	dq.writingFile = df
+	dq.lastFileSeq = df.seq
+
+	lastOffset := df.getEndOffset()
+	for j := i - 1; lastOffset == 0 && j >= 0; j-- {
+		lastOffset = storeFiles[j].getEndOffset()
+	}
+	//the offsets before the log start offset are never written again
+	if lastOffset < dq.LogStartOffset()-1 {
+		lastOffset = dq.LogStartOffset() - 1
+	}
+	atomic.StoreInt64(&dq.lastOffset, lastOffset)
+	dq.flusher.truncated(lastOffset)
+	Lg.Infof("truncate partition(%s) to offset %d, last offset is %d", dq.fileNamePrefix, offset, lastOffset)
+	return nil
+}
+
+//truncatedCopy writes the segment up to the first record holding offset and its indexes to .cleaned files
+func (df *DiskFile) truncatedCopy(offset int64) (*cleanedSegment, error) {
+	if df.isLegacy() {
+		return nil, errors.Wrap(ErrLegacySegment, df.dataFile.Name())
+	}
+	modTime, err := df.modTime()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]byte, 0)
+	timeIndexes := &timeIndexBuilder{}
+	errCut := errors.New("cut")
+	cutPosition, err := walkSegment(df.dataFile, atomic.LoadInt64(&df.size), func(rec *SegmentRecord) error {
+		if rec.BaseOffset >= offset || rec.Msg.Offset >= offset {
+			return errCut
+		}
+		indexes = append(indexes, encodeIndex(rec.Msg.Offset, rec.Position)...)
+		timeIndexes.add(rec.Msg.Timestamp, rec.BaseOffset)
+		return nil
+	})
+	if err != nil && err != errCut {
+		return nil, err
+	}
+	cleaned := &cleanedSegment{df: df, size: cutPosition, modTime: modTime}
+	if err := copyFileSync(df.dataFile.Name()+cleanedSuffix, io.NewSectionReader(df.dataFile, 0, cutPosition)); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := writeFileSync(df.indexFile.Name()+cleanedSuffix, indexes); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	if err := writeFileSync(df.timeIndexFile.Name()+cleanedSuffix, timeIndexes.entries); err != nil {
+		cleaned.remove()
+		return nil, err
+	}
+	return cleaned, nil
+}
+
+//readLogStartOffset returns 0 if the partition has no checkpoint
+func readLogStartOffset(dir string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, logStartOffsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, filepath.Join(dir, logStartOffsetFile))
+	}
+	return offset, nil
+}
+
+func writeLogStartOffset(dir string, offset int64) error {
+	path := filepath.Join(dir, logStartOffsetFile)
+	if err := writeFileSync(path+".tmp", []byte(strconv.FormatInt(offset, 10))); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 	"yithQ/message"
 	"yithQ/meta"
 	"yithQ/status"
@@ -35,17 +36,31 @@ func NewServe(cfg *conf.Config) *Serve {
 		panic(err)
 	}
 
-	topicMetadata, err := queue.PickupTopicInfoFromDisk()
+	objectStore, err := queue.NewObjectStore(cfg.RemoteStorage)
 	if err != nil {
-		Lg.Fatalf("pick up topic info from disk error : %v", err)
+		panic(err)
 	}
-	tps, err := watcher.Pickup(topicMetadata)
+	keys, err := queue.NewKeyProvider(cfg.Encryption)
+	if err != nil {
+		panic(err)
+	}
+	//brokers before the partition dirs wrote the segments to the working dir
+	migrated, err := queue.MigrateLegacySegments(".", cfg.GetDataDirs())
+	if err != nil {
+		Lg.Fatalf("migrate legacy segments error : %v", err)
+	}
+	if len(migrated) != 0 {
+		Lg.Infof("migrate the legacy segments of %v to data dirs", migrated)
+	}
+	node := NewNode(ip, cfg, objectStore, keys)
+	tps, err := watcher.Pickup(node.PickupTopicInfoFromDisk())
 	if err != nil {
 		Lg.Fatalf("pick up for connecting to zero error : %v", err)
 	}
-	node := NewNode(ip)
 	for _, tp := range tps {
-		node.AddTopicPartition(tp.Topic, tp.PartitionID, tp.IsReplica)
+		if err := node.AddTopicPartition(tp.Topic, tp.PartitionID, tp.IsReplica); err != nil {
+			Lg.Errorf("load topic(%s) partition(%d) error : %v", tp.Topic, tp.PartitionID, err)
+		}
 	}
 	s := &Serve{
 		cfg:      cfg,
@@ -78,15 +93,36 @@ func (s *Serve) Run() {
 		Lg.Info("client for [consume] listen port ", s.cfg.ConsumerPort)
 		r := router.NewRouter()
 		r.HandleFunc(http.MethodPost, "/consume", s.SendMsgToConsumers)
+		r.HandleFunc(http.MethodPost, "/offset-for-time", s.OffsetForTime)
 		http.ListenAndServe(s.cfg.ConsumerPort, r)
 	}()
 
+	if s.cfg.AdminPort != "" {
+		go func() {
+			Lg.Info("client for [admin] listen port ", s.cfg.AdminPort)
+			r := router.NewRouter()
+			r.HandleFunc(http.MethodPost, "/delete-records", s.DeleteRecords)
+			r.HandleFunc(http.MethodGet, "/backup", s.Backup)
+			r.HandleFunc(http.MethodPost, "/restore", s.Restore)
+			http.ListenAndServe(s.cfg.AdminPort, r)
+		}()
+	}
+
+	go func() {
+		cleaner, err := NewCleaner(s.node, s.cfg.RetentionCheckInterval)
+		if err != nil {
+			Lg.Fatalf("new cleaner error : %v", err)
+		}
+		cleaner.Run()
+	}()
+
 	s.watcher.PushChangeToZero(meta.NodeChange, nil)
 	go func() {
 		Lg.Infof("send heartbeat to zero(%s)", s.cfg.ZeroAddress)
-		s.watcher.SendHeartbeatToZero()
+		s.watcher.SendHeartbeatToZero(s.node.Heartbeat)
 	}()
 
+	s.watcher.HandleSignal(meta.WriteTxnMarkers, s.WriteTxnMarkers)
 	go func() {
 		metadataChan := make(chan *meta.Metadata, 0)
 		go s.watcher.WatchZero(metadataChan)
@@ -146,12 +182,50 @@ func (s *Serve) ReceiveMsgFromProducers(w http.ResponseWriter, req *http.Request
 		}
 	}
 
+	if msgs.TransactionID != 0 && msgs.ProducerID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a transactional batch needs a producer id"))
+		return
+	}
+	delayed := msgs.DeliverAt > time.Now().UnixNano()
+	if delayed && msgs.TransactionID != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a transactional batch cannot be delayed"))
+		return
+	}
+
 	var replicaErrCh chan error
 	var wg sync.WaitGroup
-	if s.cfg.ReplicaFactory != 0 {
+	//the delay log is kept by the leader only
+	if s.cfg.ReplicaFactory != 0 && !delayed {
 		go s.replicateToOtherNodes(msgs.Topic, data, replicaErrCh, wg)
 	}
-	err = s.node.ProduceTopicPartition(msgs.Topic, msgs.PartitionID, msgs.Msgs)
+	var baseOffset int64
+	if delayed {
+		baseOffset, err = s.node.ProduceDelayed(msgs.Topic, msgs.PartitionID, msgs.ProducerID, msgs.Sequence, msgs.DeliverAt, msgs.Msgs)
+	} else if msgs.ProducerID != 0 {
+		baseOffset, err = s.node.ProduceIdempotent(msgs.Topic, msgs.PartitionID, msgs.ProducerID, msgs.Sequence, msgs.TransactionID, msgs.Msgs)
+	} else {
+		baseOffset, err = s.node.ProduceTopicPartition(msgs.Topic, msgs.PartitionID, msgs.Msgs)
+	}
+	if errors.Is(err, OutOfOrderSequence) {
+		//the batch is not written, the producer takes a new producer id
+		Lg.Warnf("producer(%s) produce msgs to topic(%s) partition(%d) error : %v", req.RemoteAddr, msgs.Topic, msgs.PartitionID, err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(status.OutOfOrderSequence))
+		return
+	}
+	if errors.Is(err, TransactionFenced) || errors.Is(err, InvalidTransaction) {
+		Lg.Warnf("producer(%s) produce msgs to topic(%s) partition(%d) error : %v", req.RemoteAddr, msgs.Topic, msgs.PartitionID, err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(errors.Cause(err).Error()))
+		return
+	}
+	if err == PartitionOffline {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(status.PartitionOffline))
+		return
+	}
 	if err != nil {
 		Lg.Errorf("producer(%s) produce msgs to topic(%s) error : %v", req.RemoteAddr, msgs.Topic, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -168,7 +242,9 @@ func (s *Serve) ReceiveMsgFromProducers(w http.ResponseWriter, req *http.Request
 		return
 	}
 
+	//the base offset assigned to the batch
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.FormatInt(baseOffset, 10)))
 }
 
 func (s *Serve) SendMsgToConsumers(w http.ResponseWriter, req *http.Request) {
@@ -207,7 +283,21 @@ func (s *Serve) SendMsgToConsumers(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte(status.MetaChanged))
 		return
 	}
-	err = s.node.Consume(topic, partitionID, offset, amount, w)
+	if message.IsolationLevel(req.FormValue("isolation")) == message.ReadCommitted {
+		err = s.node.ConsumeCommitted(topic, partitionID, offset, amount, w)
+	} else {
+		err = s.node.Consume(topic, partitionID, offset, amount, w)
+	}
+	if err == queue.ErrOffsetOutOfRange {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(status.OffsetOutOfRange))
+		return
+	}
+	if err == PartitionOffline {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(status.PartitionOffline))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string(err.Error())))
@@ -215,6 +305,172 @@ func (s *Serve) SendMsgToConsumers(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+//OffsetForTime answers the first offset whose timestamp(unix nano) >= the requested one
+func (s *Serve) OffsetForTime(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	topic := req.FormValue("topic")
+	partitionID, err := strconv.Atoi(req.FormValue("partitionID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	timestamp, err := strconv.ParseInt(req.FormValue("timestamp"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	offset, err := s.node.OffsetForTime(topic, partitionID, timestamp)
+	if err != nil {
+		Lg.Errorf("consumer(%s) find offset of topic(%s) partition(%d) for time(%d) error : %v", req.RemoteAddr, topic, partitionID, timestamp, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte(strconv.FormatInt(offset, 10)))
+}
+
+//DeleteRecords moves the log start offset of a partition forward to offset and answers the new log start offset,
+//the records before it are never served again
+func (s *Serve) DeleteRecords(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	topic := req.FormValue("topic")
+	partitionID, err := strconv.Atoi(req.FormValue("partitionID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	offset, err := strconv.ParseInt(req.FormValue("offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logStartOffset, err := s.node.DeleteRecords(topic, partitionID, offset)
+	if err == queue.ErrOffsetOutOfRange {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(status.OffsetOutOfRange))
+		return
+	}
+	if err == PartitionOffline {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(status.PartitionOffline))
+		return
+	}
+	if err != nil {
+		Lg.Errorf("admin(%s) delete records of topic(%s) partition(%d) before offset %d error : %v", req.RemoteAddr, topic, partitionID, offset, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	Lg.Infof("admin(%s) delete records of topic(%s) partition(%d) before offset %d", req.RemoteAddr, topic, partitionID, offset)
+	w.Write([]byte(strconv.FormatInt(logStartOffset, 10)))
+}
+
+//WriteTxnMarkers writes the markers ending a transaction into the partitions led by this node, zero sends
+//them again until they all succeed
+func (s *Serve) WriteTxnMarkers(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var markers meta.TxnMarkers
+	if err := json.Unmarshal(data, &markers); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, tp := range markers.Partitions {
+		err := s.node.WriteTxnMarker(tp.Topic, tp.PartitionID, markers.ProducerID, markers.TransactionID, markers.Commit)
+		if err != nil {
+			Lg.Errorf("zero(%s) write marker of producer %d transaction %d into topic(%s) partition(%d) error : %v",
+				req.RemoteAddr, markers.ProducerID, markers.TransactionID, tp.Topic, tp.PartitionID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+}
+
+//Backup streams a backup archive of the leader partitions of a topic on this node, writes go on meanwhile
+func (s *Serve) Backup(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	topic := req.FormValue("topic")
+	snapshot, err := s.node.SnapshotTopic(topic)
+	if err == TopicNotExist {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err == PartitionOffline {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(status.PartitionOffline))
+		return
+	}
+	if err != nil {
+		Lg.Errorf("admin(%s) snapshot topic(%s) error : %v", req.RemoteAddr, topic, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer snapshot.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	//the status is sent already, a failure leaves a truncated archive the restore rejects
+	if err := snapshot.WriteArchive(w); err != nil {
+		Lg.Errorf("admin(%s) backup topic(%s) error : %v", req.RemoteAddr, topic, err)
+		return
+	}
+	Lg.Infof("admin(%s) backup topic(%s) partitions %d", req.RemoteAddr, topic, len(snapshot.Manifest.Partitions))
+}
+
+//Restore recreates the partitions of a backup archive on this node and registers them with zero,
+//it answers the manifest of the restored partitions
+func (s *Serve) Restore(w http.ResponseWriter, req *http.Request) {
+	manifest, err := s.node.RestoreTopic(req.Body)
+	if errors.Is(err, queue.ErrInvalidBackup) || errors.Is(err, RestoreNotDurable) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, queue.ErrPartitionExists) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		Lg.Errorf("admin(%s) restore error : %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, bp := range manifest.Partitions {
+		err = s.watcher.PushChangeToZero(meta.TopicReplicaAddChange, meta.TopicMetadata{
+			Topic:          manifest.Topic,
+			PartitionID:    bp.PartitionID,
+			IsReplica:      false,
+			ReplicaFactory: s.cfg.ReplicaFactory,
+		})
+		if err != nil {
+			Lg.Errorf("admin(%s) restore topic(%s) partition(%d) [PUSH change to zero] error : %v", req.RemoteAddr, manifest.Topic, bp.PartitionID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	Lg.Infof("admin(%s) restore topic(%s) partitions %d", req.RemoteAddr, manifest.Topic, len(manifest.Partitions))
+	w.Write(data)
+}
+
 func (s *Serve) checkeMetadataVersion(metaVersion uint32) bool {
 	return s.metadata.Load().(*meta.Metadata).Version == metaVersion
 }
@@ -0,0 +1,307 @@
+package yith
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"yithQ/message"
+	"yithQ/status"
+)
+
+//transactions of a partition: the batches of a transaction are written as they come and their offset ranges are kept
+//until zero has the marker ending it written. read_committed consumers are served up to the last stable offset,
+//the first offset of the open transactions, and without the ranges of the aborted ones.
+//The state is rewritten to the transactions file of a durable partition when a transaction begins and ends,
+//not for every batch. A transaction found open on load may have had batches whose ranges were not written,
+//it is taken to span the log from its first offset on, so aborting it hides the records of others written meanwhile.
+//The ranges beyond the log recovered on open are dropped. A partition restored from a backup starts without transactions
+const transactionsFileName = "transactions"
+
+var TransactionFenced error = errors.New(status.TransactionFenced)
+var InvalidTransaction error = errors.New(status.InvalidTransaction)
+
+type offsetRange struct {
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+}
+
+type openTransaction struct {
+	TransactionID int64 `json:"transaction_id"`
+	//no record of the transaction is before it, taken before its first batch is written
+	First  int64         `json:"first"`
+	Ranges []offsetRange `json:"ranges"`
+	//a batch of it is being written, its marker waits for it
+	writing bool
+}
+
+type endedTransaction struct {
+	TransactionID int64     `json:"transaction_id"`
+	Ended         time.Time `json:"ended"`
+}
+
+type transactionState struct {
+	//by producer id
+	Open map[int64]*openTransaction `json:"open"`
+	//the last transaction ended of each producer, a batch of it or an older one is fenced
+	Ended   map[int64]*endedTransaction `json:"ended"`
+	Aborted []offsetRange               `json:"aborted"`
+}
+
+type partitionTransactions struct {
+	//guards state, read_committed consumers hold it shared. It is not held while a batch is written,
+	//the first offset of a transaction is taken before so the last stable offset is never past its records
+	lock sync.RWMutex
+	//signaled on lock when a batch is written
+	written *sync.Cond
+	//"" if the partition is not durable
+	path  string
+	state transactionState
+}
+
+//loadTransactions reads the transactions file of the partition dir, dir is "" for a partition that is not durable.
+//lastOffset is the last offset of the log recovered
+func loadTransactions(dir string, lastOffset int64) (*partitionTransactions, error) {
+	pt := &partitionTransactions{state: transactionState{
+		Open:  make(map[int64]*openTransaction),
+		Ended: make(map[int64]*endedTransaction),
+	}}
+	pt.written = sync.NewCond(&pt.lock)
+	if dir == "" {
+		return pt, nil
+	}
+	pt.path = filepath.Join(dir, transactionsFileName)
+	data, err := ioutil.ReadFile(pt.path)
+	if os.IsNotExist(err) {
+		return pt, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pt.state); err != nil {
+		return nil, errors.Wrap(err, pt.path)
+	}
+	if pt.state.Open == nil {
+		pt.state.Open = make(map[int64]*openTransaction)
+	}
+	if pt.state.Ended == nil {
+		pt.state.Ended = make(map[int64]*endedTransaction)
+	}
+	for _, open := range pt.state.Open {
+		//a file without first offsets
+		if open.First == 0 && len(open.Ranges) != 0 {
+			open.First = open.Ranges[0].First
+		}
+		open.Ranges = nil
+		if lastOffset >= open.First {
+			open.Ranges = []offsetRange{{First: open.First, Last: lastOffset}}
+		}
+	}
+	return pt, nil
+}
+
+//produce writes a batch of the transaction of producerID with fill and keeps its offsets, nextOffset is not past
+//the offset the batch is written at. The batches of a producer are not written concurrently, see producerStates
+func (pt *partitionTransactions) produce(producerID, transactionID int64, msgs []*message.Message, nextOffset func() int64, fill func([]*message.Message) (int64, error)) (int64, error) {
+	pt.lock.Lock()
+	if ended, ok := pt.state.Ended[producerID]; ok && transactionID <= ended.TransactionID {
+		pt.lock.Unlock()
+		return 0, errors.Wrapf(TransactionFenced, "producer %d transaction %d ended", producerID, transactionID)
+	}
+	open, ok := pt.state.Open[producerID]
+	if ok && open.TransactionID != transactionID {
+		pt.lock.Unlock()
+		if transactionID < open.TransactionID {
+			return 0, errors.Wrapf(TransactionFenced, "producer %d transaction %d, %d is open", producerID, transactionID, open.TransactionID)
+		}
+		return 0, errors.Wrapf(InvalidTransaction, "producer %d transaction %d, %d is not ended", producerID, transactionID, open.TransactionID)
+	}
+	if !ok {
+		open = &openTransaction{TransactionID: transactionID, First: nextOffset()}
+		pt.state.Open[producerID] = open
+		//a transaction that failed to begin is left open without records, its marker ends it
+		if err := pt.persist(); err != nil {
+			pt.lock.Unlock()
+			return 0, err
+		}
+	}
+	open.writing = true
+	pt.lock.Unlock()
+
+	baseOffset, err := fill(msgs)
+
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	open.writing = false
+	pt.written.Broadcast()
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, msg := range msgs {
+		count += msg.OffsetCount()
+	}
+	open.Ranges = append(open.Ranges, offsetRange{First: baseOffset, Last: baseOffset + count - 1})
+	return baseOffset, nil
+}
+
+//writeMarker writes the marker ending the transaction with fill, a transaction without records in the partition
+//or ended already takes no marker
+func (pt *partitionTransactions) writeMarker(producerID, transactionID int64, commit bool, fill func([]*message.Message) (int64, error)) error {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	for open, ok := pt.state.Open[producerID]; ok && open.writing; open, ok = pt.state.Open[producerID] {
+		pt.written.Wait()
+	}
+	if ended, ok := pt.state.Ended[producerID]; ok && transactionID <= ended.TransactionID {
+		return nil
+	}
+	if open, ok := pt.state.Open[producerID]; ok && open.TransactionID <= transactionID {
+		controlType := message.ControlAbort
+		if commit {
+			controlType = message.ControlCommit
+		}
+		if _, err := fill([]*message.Message{message.NewControlRecord(controlType, producerID, time.Now().UnixNano())}); err != nil {
+			return err
+		}
+		//an older transaction still open missed its marker, it can only have been aborted
+		if !commit || open.TransactionID < transactionID {
+			pt.state.Aborted = append(pt.state.Aborted, open.Ranges...)
+		}
+		delete(pt.state.Open, producerID)
+	}
+	pt.state.Ended[producerID] = &endedTransaction{TransactionID: transactionID, Ended: time.Now()}
+	return pt.persist()
+}
+
+//read calls pop with the last stable offset and the aborted ranges from offset on, -1 if no transaction is open
+func (pt *partitionTransactions) read(offset int64, pop func(lastStableOffset int64, aborted []offsetRange) error) error {
+	pt.lock.RLock()
+	defer pt.lock.RUnlock()
+	lastStableOffset := int64(-1)
+	for _, open := range pt.state.Open {
+		if lastStableOffset == -1 || open.First < lastStableOffset {
+			lastStableOffset = open.First
+		}
+	}
+	aborted := make([]offsetRange, 0)
+	for _, r := range pt.state.Aborted {
+		if r.Last >= offset {
+			aborted = append(aborted, r)
+		}
+	}
+	return pop(lastStableOffset, aborted)
+}
+
+//truncate drops the ranges from offset on, ep: the records removed by TruncateTo
+func (pt *partitionTransactions) truncate(offset int64) error {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	for producerID, open := range pt.state.Open {
+		open.Ranges = truncateRanges(open.Ranges, offset)
+		if len(open.Ranges) == 0 && !open.writing {
+			delete(pt.state.Open, producerID)
+		}
+	}
+	pt.state.Aborted = truncateRanges(pt.state.Aborted, offset)
+	return pt.persist()
+}
+
+func truncateRanges(ranges []offsetRange, offset int64) []offsetRange {
+	kept := ranges[:0]
+	for _, r := range ranges {
+		if r.First >= offset {
+			continue
+		}
+		if r.Last >= offset {
+			r.Last = offset - 1
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+//clean drops the aborted ranges before logStartOffset and the ended transactions of the producers idle since before,
+//it returns how many aborted ranges were dropped
+func (pt *partitionTransactions) clean(logStartOffset int64, before time.Time) (int, error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	aborted := pt.state.Aborted[:0]
+	for _, r := range pt.state.Aborted {
+		if r.Last >= logStartOffset {
+			aborted = append(aborted, r)
+		}
+	}
+	dropped := len(pt.state.Aborted) - len(aborted)
+	pt.state.Aborted = aborted
+	expired := 0
+	for producerID, ended := range pt.state.Ended {
+		if ended.Ended.Before(before) {
+			delete(pt.state.Ended, producerID)
+			expired++
+		}
+	}
+	if dropped == 0 && expired == 0 {
+		return 0, nil
+	}
+	return dropped, pt.persist()
+}
+
+//persist rewrites the transactions file, the caller holds lock
+func (pt *partitionTransactions) persist() error {
+	if pt.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&pt.state)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pt.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(pt.path+".tmp", pt.path)
+}
+
+//filterCommitted returns the records of data before lastStableOffset and out of the aborted ranges,
+//and the offset after the last record it read. A compressed batch is never split by a range, so its offset is enough
+func filterCommitted(data []byte, offset, lastStableOffset int64, aborted []offsetRange) ([]byte, int64, error) {
+	committed := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		recordOffset, size, err := message.RecordLength(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if lastStableOffset != -1 && recordOffset >= lastStableOffset {
+			break
+		}
+		if !inRanges(aborted, recordOffset) {
+			committed = append(committed, data[:size]...)
+		}
+		offset = recordOffset + 1
+		data = data[size:]
+	}
+	return committed, offset, nil
+}
+
+func inRanges(ranges []offsetRange, offset int64) bool {
+	for _, r := range ranges {
+		if offset >= r.First && offset <= r.Last {
+			return true
+		}
+	}
+	return false
+}
@@ -34,11 +34,8 @@ func NewWatcher(zero, heartbeatInterval, watchPort string) (*Watcher, error) {
 	}, nil
 }
 
-func (w *Watcher) SendHeartbeatToZero() error {
-	req, err := http.NewRequest("GET", w.zero+"/"+meta.Heartbeat.String(), nil)
-	if err != nil {
-		return err
-	}
+//SendHeartbeatToZero posts the heartbeat built by heartbeat() to zero every heartbeat interval
+func (w *Watcher) SendHeartbeatToZero(heartbeat func() *meta.NodeHeartbeat) {
 	cli := &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConns:        1, //MaxIdleConns=len(zero_addresses)
@@ -51,16 +48,19 @@ func (w *Watcher) SendHeartbeatToZero() error {
 	for {
 		select {
 		case <-ticker.C:
-			resp, err := cli.Do(req)
+			byt, err := json.Marshal(heartbeat())
+			if err != nil {
+				Lg.Errorf("encode heartbeat error : %v", err)
+				continue
+			}
+			resp, err := cli.Post(w.zero+"/"+meta.Heartbeat.String(), "application/json", bytes.NewReader(byt))
 			if err != nil {
-				Lg.Errorf("send heartbeat to zero(%s) error : %v ", req.RemoteAddr, err)
+				Lg.Errorf("send heartbeat to zero(%s) error : %v ", w.zero, err)
 				continue
 			}
 			resp.Body.Close()
 		}
 	}
-
-	return nil
 }
 
 func (w *Watcher) WatchZero(metadataChan chan<- *meta.Metadata) {
@@ -89,6 +89,11 @@ func (w *Watcher) WatchZero(metadataChan chan<- *meta.Metadata) {
 	http.ListenAndServe(w.watchPort, nil)
 }
 
+//HandleSignal serves signal from zero on the watch port, the metadata pushed by zero goes to "/"
+func (w *Watcher) HandleSignal(signal meta.Signal, handler http.HandlerFunc) {
+	http.HandleFunc("/"+signal.String(), handler)
+}
+
 func (w *Watcher) PushChangeToZero(signal meta.Signal, change interface{}) error {
 	var byt []byte
 	var err error
@@ -12,6 +12,11 @@ type Config struct {
 
 	HeartbeatTimeout string `yaml:"heartbeat_timeout"`
 
+	//the transactions of the producers are kept in this file, in memory only if it is not set
+	TransactionLog string `yaml:"transaction_log"`
+	//a transaction not ended within it is aborted, 1m by default
+	TransactionTimeout string `yaml:"transaction_timeout"`
+
 	LoggerLevel string `yaml:"logger_level"`
 }
 
@@ -0,0 +1,337 @@
+package zero
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yithQ/meta"
+	"yithQ/status"
+	"yithQ/util/logger"
+)
+
+//zero coordinates the transactions of the producers: a producer begins a transaction, adds each partition before
+//its first batch to it, then commits or aborts. Once decided the transaction is prepared and its markers are
+//written into every partition it added, until they all are it is retried in the background.
+//A transaction not ended within transaction_timeout is aborted. The transactions are rewritten to
+//transaction_log on every change, so the decided ones are completed after a restart
+const defaultTransactionTimeout = time.Minute
+
+var ErrInvalidTransaction error = errors.New(status.InvalidTransaction)
+
+type transactionCoordinator struct {
+	lock sync.Mutex
+	//"" keeps the transactions in memory only
+	path    string
+	timeout time.Duration
+	//by producer id
+	transactions      map[int64]*meta.Transaction
+	lastTransactionID int64
+	yithWatchPort     string
+	//the node leading a partition now, "" if zero does not know it
+	leader func(topic string, partitionID int) string
+}
+
+func newTransactionCoordinator(path string, timeout time.Duration, yithWatchPort string, leader func(topic string, partitionID int) string) (*transactionCoordinator, error) {
+	tc := &transactionCoordinator{
+		path:              path,
+		timeout:           timeout,
+		transactions:      make(map[int64]*meta.Transaction),
+		lastTransactionID: time.Now().UnixNano() / int64(time.Millisecond) << producerIDSequenceBits,
+		yithWatchPort:     yithWatchPort,
+		leader:            leader,
+	}
+	if path == "" {
+		return tc, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	transactions := make([]*meta.Transaction, 0)
+	if err := json.Unmarshal(data, &transactions); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	for _, txn := range transactions {
+		tc.transactions[txn.ProducerID] = txn
+		if txn.TransactionID > tc.lastTransactionID {
+			tc.lastTransactionID = txn.TransactionID
+		}
+		//the producer has the whole timeout again to end it
+		if txn.State == meta.TxnOngoing {
+			txn.Updated = time.Now()
+		}
+	}
+	return tc, nil
+}
+
+//begin returns the id of a new transaction of producerID, the last one must be completed
+func (tc *transactionCoordinator) begin(producerID int64) (int64, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if txn, ok := tc.transactions[producerID]; ok {
+		return 0, errors.Wrapf(ErrInvalidTransaction, "producer %d transaction %d is %s", producerID, txn.TransactionID, txn.State)
+	}
+	tc.lastTransactionID++
+	tc.transactions[producerID] = &meta.Transaction{
+		ProducerID:    producerID,
+		TransactionID: tc.lastTransactionID,
+		State:         meta.TxnOngoing,
+		Updated:       time.Now(),
+	}
+	return tc.lastTransactionID, tc.persist()
+}
+
+func (tc *transactionCoordinator) addPartitions(req *meta.TxnRequest) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	txn, err := tc.ongoing(req)
+	if err != nil {
+		return err
+	}
+	for _, tp := range req.Partitions {
+		added := false
+		for i, txnTP := range txn.Partitions {
+			if txnTP.Topic == tp.Topic && txnTP.PartitionID == tp.PartitionID {
+				txn.Partitions[i].Node = tp.Node
+				added = true
+			}
+		}
+		if !added {
+			txn.Partitions = append(txn.Partitions, tp)
+		}
+	}
+	txn.Updated = time.Now()
+	return tc.persist()
+}
+
+//end decides the transaction, it is completed once its markers are written
+func (tc *transactionCoordinator) end(req *meta.TxnRequest) (*meta.Transaction, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	txn, err := tc.ongoing(req)
+	if err != nil {
+		return nil, err
+	}
+	txn.State = meta.TxnPrepareAbort
+	if req.Commit {
+		txn.State = meta.TxnPrepareCommit
+	}
+	txn.Updated = time.Now()
+	return tc.copyOf(txn), tc.persist()
+}
+
+//ongoing returns the transaction of req if it is not ended, the caller holds lock
+func (tc *transactionCoordinator) ongoing(req *meta.TxnRequest) (*meta.Transaction, error) {
+	txn, ok := tc.transactions[req.ProducerID]
+	if !ok || txn.TransactionID != req.TransactionID || txn.State != meta.TxnOngoing {
+		//ep: aborted for the timeout
+		return nil, errors.Wrapf(ErrInvalidTransaction, "producer %d transaction %d is not ongoing", req.ProducerID, req.TransactionID)
+	}
+	return txn, nil
+}
+
+//pending aborts the transactions out of the timeout and returns the decided ones whose markers are to be written
+func (tc *transactionCoordinator) pending() ([]*meta.Transaction, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	expired := false
+	pending := make([]*meta.Transaction, 0)
+	for _, txn := range tc.transactions {
+		if txn.State == meta.TxnOngoing && time.Since(txn.Updated) > tc.timeout {
+			logger.Lg.Warnf("abort producer %d transaction %d, not ended within %v", txn.ProducerID, txn.TransactionID, tc.timeout)
+			txn.State = meta.TxnPrepareAbort
+			txn.Updated = time.Now()
+			expired = true
+		}
+		if txn.State != meta.TxnOngoing {
+			pending = append(pending, tc.copyOf(txn))
+		}
+	}
+	if expired {
+		return pending, tc.persist()
+	}
+	return pending, nil
+}
+
+//complete writes the markers of a decided transaction and forgets it once all are written
+func (tc *transactionCoordinator) complete(txn *meta.Transaction) error {
+	if err := tc.writeMarkers(txn); err != nil {
+		return err
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if current, ok := tc.transactions[txn.ProducerID]; ok && current.TransactionID == txn.TransactionID {
+		delete(tc.transactions, txn.ProducerID)
+	}
+	return tc.persist()
+}
+
+//writeMarkers posts the markers to the watch port of the leaders of the partitions, a node writes a marker once.
+//The leader is looked up on every attempt so the markers follow a partition moved since it was added,
+//the node the producer sent it to is only used while zero does not know the partition, ep: after a restart
+func (tc *transactionCoordinator) writeMarkers(txn *meta.Transaction) error {
+	nodePartitions := make(map[string][]meta.TxnPartition)
+	for _, tp := range txn.Partitions {
+		node := tc.leader(tp.Topic, tp.PartitionID)
+		if node == "" {
+			node = tp.Node
+		}
+		nodePartitions[node] = append(nodePartitions[node], tp)
+	}
+	for node, partitions := range nodePartitions {
+		byt, err := json.Marshal(&meta.TxnMarkers{
+			ProducerID:    txn.ProducerID,
+			TransactionID: txn.TransactionID,
+			Commit:        txn.State == meta.TxnPrepareCommit,
+			Partitions:    partitions,
+		})
+		if err != nil {
+			return err
+		}
+		url := "http://" + strings.Split(node, ":")[0] + tc.yithWatchPort + "/" + meta.WriteTxnMarkersStr
+		resp, err := http.Post(url, "application/json", bytes.NewReader(byt))
+		if err != nil {
+			return errors.Wrapf(err, "write markers of producer %d transaction %d to yith(%s)", txn.ProducerID, txn.TransactionID, node)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("write markers of producer %d transaction %d to yith(%s) : %s", txn.ProducerID, txn.TransactionID, node, data)
+		}
+	}
+	return nil
+}
+
+func (tc *transactionCoordinator) copyOf(txn *meta.Transaction) *meta.Transaction {
+	copied := *txn
+	copied.Partitions = append([]meta.TxnPartition(nil), txn.Partitions...)
+	return &copied
+}
+
+//persist rewrites the transaction log, the caller holds lock
+func (tc *transactionCoordinator) persist() error {
+	if tc.path == "" {
+		return nil
+	}
+	transactions := make([]*meta.Transaction, 0, len(tc.transactions))
+	for _, txn := range tc.transactions {
+		transactions = append(transactions, txn)
+	}
+	data, err := json.Marshal(transactions)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tc.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tc.path+".tmp", tc.path)
+}
+
+//completeTransactions aborts the transactions out of the timeout and retries the markers not written
+func (z *Zero) completeTransactions() {
+	interval := z.txns.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			pending, err := z.txns.pending()
+			if err != nil {
+				logger.Lg.Errorf("persist transactions error : %v", err)
+			}
+			for _, txn := range pending {
+				if err := z.txns.complete(txn); err != nil {
+					logger.Lg.Warnf("complete producer %d transaction %d error : %v", txn.ProducerID, txn.TransactionID, err)
+				}
+			}
+		}
+	}
+}
+
+func (z *Zero) BeginTxn(w http.ResponseWriter, req *http.Request) {
+	txnReq, ok := readTxnRequest(w, req)
+	if !ok {
+		return
+	}
+	transactionID, err := z.txns.begin(txnReq.ProducerID)
+	if err != nil {
+		writeTxnError(w, req, err)
+		return
+	}
+	w.Write([]byte(strconv.FormatInt(transactionID, 10)))
+}
+
+func (z *Zero) AddPartitionsToTxn(w http.ResponseWriter, req *http.Request) {
+	txnReq, ok := readTxnRequest(w, req)
+	if !ok {
+		return
+	}
+	if err := z.txns.addPartitions(txnReq); err != nil {
+		writeTxnError(w, req, err)
+	}
+}
+
+//EndTxn answers once the transaction is decided, its markers not written yet are retried in the background
+func (z *Zero) EndTxn(w http.ResponseWriter, req *http.Request) {
+	txnReq, ok := readTxnRequest(w, req)
+	if !ok {
+		return
+	}
+	txn, err := z.txns.end(txnReq)
+	if err != nil {
+		writeTxnError(w, req, err)
+		return
+	}
+	if err := z.txns.complete(txn); err != nil {
+		logger.Lg.Warnf("complete producer %d transaction %d error : %v, retry later", txn.ProducerID, txn.TransactionID, err)
+	}
+}
+
+func readTxnRequest(w http.ResponseWriter, req *http.Request) (*meta.TxnRequest, bool) {
+	byt, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		txnReq := &meta.TxnRequest{}
+		if err = json.Unmarshal(byt, txnReq); err == nil {
+			return txnReq, true
+		}
+	}
+	logger.Lg.Errorf("producer(%s) transaction request error : %v", req.RemoteAddr, err)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+	return nil, false
+}
+
+func writeTxnError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, ErrInvalidTransaction) {
+		logger.Lg.Warnf("producer(%s) transaction error : %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(status.InvalidTransaction))
+		return
+	}
+	logger.Lg.Errorf("producer(%s) transaction error : %v", req.RemoteAddr, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
+}
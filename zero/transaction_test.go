@@ -0,0 +1,110 @@
+package zero
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"yithQ/meta"
+	"yithQ/util/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.NewLogger(os.Stdout, "debug")
+	os.Exit(m.Run())
+}
+
+func TestTransactionCoordinator(t *testing.T) {
+	var lock sync.Mutex
+	markers := make([]meta.TxnMarkers, 0)
+	yith := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/"+meta.WriteTxnMarkersStr {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var m meta.TxnMarkers
+		if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		markers = append(markers, m)
+		lock.Unlock()
+	}))
+	defer yith.Close()
+	node := strings.TrimPrefix(yith.URL, "http://")
+	watchPort := node[strings.LastIndex(node, ":"):]
+
+	path := filepath.Join(t.TempDir(), "transactions")
+	//the partition moved to the node of yith since the producer added it
+	leader := func(topic string, partitionID int) string {
+		if topic == "orders" && partitionID == 1 {
+			return node
+		}
+		return ""
+	}
+	txns, err := newTransactionCoordinator(path, time.Minute, watchPort, leader)
+	if err != nil {
+		t.Fatalf("new transaction coordinator error : %v", err)
+	}
+	z := &Zero{txns: txns}
+	post := func(handler http.HandlerFunc, txnReq *meta.TxnRequest) *httptest.ResponseRecorder {
+		byt, _ := json.Marshal(txnReq)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(byt)))
+		return w
+	}
+	w := post(z.BeginTxn, &meta.TxnRequest{ProducerID: 7})
+	transactionID, err := strconv.ParseInt(w.Body.String(), 10, 64)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("begin txn code %d body %s", w.Code, w.Body.String())
+	}
+	if w := post(z.BeginTxn, &meta.TxnRequest{ProducerID: 7}); w.Code != http.StatusConflict {
+		t.Fatalf("begin a second txn code %d", w.Code)
+	}
+	w = post(z.AddPartitionsToTxn, &meta.TxnRequest{ProducerID: 7, TransactionID: transactionID,
+		Partitions: []meta.TxnPartition{{Topic: "orders", PartitionID: 1, Node: "old-leader.invalid:9000"}}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("add partitions code %d body %s", w.Code, w.Body.String())
+	}
+	if w := post(z.EndTxn, &meta.TxnRequest{ProducerID: 7, TransactionID: transactionID + 1, Commit: true}); w.Code != http.StatusConflict {
+		t.Fatalf("end another txn code %d", w.Code)
+	}
+	if w := post(z.EndTxn, &meta.TxnRequest{ProducerID: 7, TransactionID: transactionID, Commit: true}); w.Code != http.StatusOK {
+		t.Fatalf("end txn code %d body %s", w.Code, w.Body.String())
+	}
+	if len(markers) != 1 || !markers[0].Commit || markers[0].TransactionID != transactionID || markers[0].Partitions[0].Topic != "orders" {
+		t.Fatalf("markers written %+v", markers)
+	}
+
+	//a transaction out of the timeout is aborted, even after a restart
+	nextID, err := txns.begin(7)
+	if err != nil || nextID <= transactionID {
+		t.Fatalf("begin txn %d error %v", nextID, err)
+	}
+	txns, err = newTransactionCoordinator(path, 0, watchPort, leader)
+	if err != nil {
+		t.Fatalf("reload transaction coordinator error : %v", err)
+	}
+	pending, err := txns.pending()
+	if err != nil || len(pending) != 1 || pending[0].State != meta.TxnPrepareAbort {
+		t.Fatalf("pending txns %+v error %v", pending, err)
+	}
+	if err := txns.complete(pending[0]); err != nil {
+		t.Fatalf("complete txn error : %v", err)
+	}
+	if _, err := txns.begin(7); err != nil {
+		t.Fatalf("begin txn after abort error : %v", err)
+	}
+	if err := txns.addPartitions(&meta.TxnRequest{ProducerID: 7, TransactionID: nextID}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("add partitions to the aborted txn error is %v", err)
+	}
+}
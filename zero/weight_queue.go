@@ -101,6 +101,18 @@ func (wq *WeightQueue) TopicNode() map[meta.TopicMetadata]string {
 	return wq.topicNode
 }
 
+//FindNodeWithTopicPartitionID returns the node of the partition, "" if it is on none
+func (wq *WeightQueue) FindNodeWithTopicPartitionID(topic string, partitionID int, isReplica bool) string {
+	wq.RLock()
+	defer wq.RUnlock()
+	for tm, node := range wq.topicNode {
+		if tm.Topic == topic && tm.PartitionID == partitionID && tm.IsReplica == isReplica {
+			return node
+		}
+	}
+	return ""
+}
+
 func (wq *WeightQueue) AllNodes() []string {
 	wq.RLock()
 	defer wq.RUnlock()
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,12 +15,18 @@ import (
 	"yithQ/util/router"
 )
 
+const producerIDSequenceBits = 12
+
 type Zero struct {
 	weightQueue      *WeightQueue
 	cfg              *Config
 	metadataVersion  uint32
 	nodeTimer        *sync.Map //map[string]*time.Timer
+	nodeHeartbeat    *sync.Map //map[string]*meta.NodeHeartbeat, the last heartbeat of each node
 	heartbeatTimeout time.Duration
+	//the last producer id handed out, see InitProducerID
+	lastProducerID int64
+	txns           *transactionCoordinator
 }
 
 func NewZero(cfg *Config) *Zero {
@@ -27,18 +34,35 @@ func NewZero(cfg *Config) *Zero {
 	if err != nil {
 		logger.Lg.Fatalf("parse heartbeatTimeout(%s) to duration error : %v", cfg.HeartbeatTimeout, err)
 	}
+	txnTimeout := defaultTransactionTimeout
+	if cfg.TransactionTimeout != "" {
+		if txnTimeout, err = time.ParseDuration(cfg.TransactionTimeout); err != nil {
+			logger.Lg.Fatalf("parse transactionTimeout(%s) to duration error : %v", cfg.TransactionTimeout, err)
+		}
+	}
+	weightQueue := NewWeightQueue()
+	txns, err := newTransactionCoordinator(cfg.TransactionLog, txnTimeout, cfg.YithWatchPort, func(topic string, partitionID int) string {
+		return weightQueue.FindNodeWithTopicPartitionID(topic, partitionID, false)
+	})
+	if err != nil {
+		logger.Lg.Fatalf("load transaction log(%s) error : %v", cfg.TransactionLog, err)
+	}
 	return &Zero{
-		weightQueue:      NewWeightQueue(),
+		weightQueue:      weightQueue,
 		cfg:              cfg,
 		metadataVersion:  0,
 		nodeTimer:        &sync.Map{},
+		nodeHeartbeat:    &sync.Map{},
 		heartbeatTimeout: timeout,
+		lastProducerID:   time.Now().UnixNano() / int64(time.Millisecond) << producerIDSequenceBits,
+		txns:             txns,
 	}
 }
 
 func (z *Zero) Run() {
 	logger.Lg.Info("zero start running ...")
 	go z.ListenYith()
+	go z.completeTransactions()
 	select {}
 }
 
@@ -48,10 +72,15 @@ func (z *Zero) ListenYith() {
 
 	r := router.NewRouter()
 	r.HandleFunc(http.MethodGet, "/"+meta.HeartbeatStr, z.ReceiveHeartbeat)
+	r.HandleFunc(http.MethodPost, "/"+meta.HeartbeatStr, z.ReceiveHeartbeat)
 	r.HandleFunc(http.MethodPost, "/"+meta.TopicReplicaAddChangeStr, z.AddTopicReplica)
 	r.HandleFunc(http.MethodGet, "/"+meta.FetchMetadataStr, z.ForFetchMetadata)
 	r.HandleFunc(http.MethodPost, "/"+meta.TopicPartitionDeleteChangeStr, z.DeleteTopicPartition)
 	r.HandleFunc(http.MethodPost, "/"+meta.PickupStr, z.YithPickup)
+	r.HandleFunc(http.MethodPost, "/"+meta.InitProducerIDStr, z.InitProducerID)
+	r.HandleFunc(http.MethodPost, "/"+meta.BeginTxnStr, z.BeginTxn)
+	r.HandleFunc(http.MethodPost, "/"+meta.AddPartitionsToTxnStr, z.AddPartitionsToTxn)
+	r.HandleFunc(http.MethodPost, "/"+meta.EndTxnStr, z.EndTxn)
 	http.ListenAndServe(z.cfg.ListenPort, r)
 
 }
@@ -162,7 +191,20 @@ func (z *Zero) YithPickup(w http.ResponseWriter, req *http.Request) {
 	w.Write(byt)
 }
 
+//InitProducerID hands out an id to an idempotent producer. Zero keeps nothing on disk, so the ids start from
+//its start time in milliseconds << producerIDSequenceBits and stay unique across restarts unless more than
+//1<<producerIDSequenceBits ids a millisecond were handed out
+func (z *Zero) InitProducerID(w http.ResponseWriter, req *http.Request) {
+	producerID := atomic.AddInt64(&z.lastProducerID, 1)
+	logger.Lg.Debugf("init producer id %d for producer(%s)", producerID, req.RemoteAddr)
+	w.Write([]byte(strconv.FormatInt(producerID, 10)))
+}
+
+//ReceiveHeartbeat keeps the node alive, a POST heartbeat also carries the usage of its log dirs
 func (z *Zero) ReceiveHeartbeat(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		z.receiveLogDirs(req)
+	}
 	timer, ok := z.nodeTimer.Load(req.RemoteAddr)
 	if !ok {
 		f := func() {
@@ -177,6 +219,32 @@ func (z *Zero) ReceiveHeartbeat(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (z *Zero) receiveLogDirs(req *http.Request) {
+	byt, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Lg.Errorf("yith(%s) heartbeat [read http body] error : %v", req.RemoteAddr, err)
+		return
+	}
+	heartbeat := &meta.NodeHeartbeat{}
+	if err := json.Unmarshal(byt, heartbeat); err != nil {
+		logger.Lg.Errorf("yith(%s) heartbeat [json decode] error : %v", req.RemoteAddr, err)
+		return
+	}
+	var lastOffline map[string]bool
+	if lastI, ok := z.nodeHeartbeat.Load(req.RemoteAddr); ok {
+		lastOffline = make(map[string]bool)
+		for _, usage := range lastI.(*meta.NodeHeartbeat).LogDirs {
+			lastOffline[usage.Path] = usage.Offline
+		}
+	}
+	for _, usage := range heartbeat.LogDirs {
+		if usage.Offline && !lastOffline[usage.Path] {
+			logger.Lg.Warnf("log dir(%s) of yith(%s) is offline : %s", usage.Path, req.RemoteAddr, usage.Error)
+		}
+	}
+	z.nodeHeartbeat.Store(req.RemoteAddr, heartbeat)
+}
+
 func (z *Zero) addTopicReplica(yithNode string, topic meta.TopicMetadata) {
 	nodes := z.weightQueue.PopNodesWithout(topic.ReplicaFactory, yithNode)
 	for i, node := range nodes {
@@ -197,4 +265,5 @@ func (z *Zero) yithNodeExpire(yithAddr string) {
 	logger.Lg.Warnf("yith_node(%s) expired!", yithAddr)
 	z.weightQueue.DeleteNode(yithAddr)
 	z.nodeTimer.Delete(yithAddr)
+	z.nodeHeartbeat.Delete(yithAddr)
 }